@@ -0,0 +1,57 @@
+package bsonex
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// low level helpers appending raw BSON encoded data.
+
+func appendCString(dst []byte, s string) []byte {
+	return append(append(dst, s...), 0x00)
+}
+
+func appendStringValue(dst []byte, s string) []byte {
+	dst = appendInt32(dst, int32(len(s)+1))
+	return appendCString(dst, s)
+}
+
+func appendInt32(dst []byte, i int32) []byte {
+	return append(dst, byte(i), byte(i>>8), byte(i>>16), byte(i>>24))
+}
+
+func appendInt64(dst []byte, i int64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(i))
+	return append(dst, b[:]...)
+}
+
+func appendDouble(dst []byte, f float64) []byte {
+	return appendInt64(dst, int64(math.Float64bits(f)))
+}
+
+func appendElementHeader(dst []byte, t ValueType, key string) []byte {
+	return appendCString(append(dst, t), key)
+}
+
+// appendElement appends an element with a key read from another document.
+func appendElement(dst []byte, key []byte, v Value) []byte {
+	dst = append(append(dst, v.valueType), key...)
+	return append(append(dst, 0x00), v.valueData...)
+}
+
+// startDocument reserves space for a length prefix and returns its position,
+// endDocument appends the terminator and fills in the length.
+func startDocument(dst []byte) ([]byte, int) {
+	return append(dst, 0, 0, 0, 0), len(dst)
+}
+
+func endDocument(dst []byte, start int) []byte {
+	return setLength(append(dst, 0x00), start)
+}
+
+// setLength writes the length of dst[start:] as int32 at start.
+func setLength(dst []byte, start int) []byte {
+	binary.LittleEndian.PutUint32(dst[start:], uint32(len(dst)-start))
+	return dst
+}
@@ -2,8 +2,6 @@ package bsonex
 
 import (
 	"bytes"
-	"encoding/json"
-	"fmt"
 	"strings"
 )
 
@@ -13,31 +11,127 @@ func (b BSON) String() string {
 	return string(BSONEX{BSON: b}.MustToJson())
 }
 func (b BSON) Lookup(key string) (val Value) {
+	val, err := b.LookupErr(key)
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+// LookupErr is like Lookup but returns an error instead of panicking when
+// the document is malformed along the path.
+func (b BSON) LookupErr(key string) (val Value, err error) {
 	if key == "" {
 		return
 	}
-	val = Value{valueType: TypeDocument, valueData: b}
-	sp := strings.Split(key, ".")
-	for _, k := range sp {
-		val = BSON(val.valueData).lookupOne(k)
-		if val.valueType == TypeEmpty {
-			return
+	return b.LookupPathErr(strings.Split(key, "."))
+}
+
+// LookupAll returns all values at the dotted path key, following MongoDB
+// query semantics: when an array is met on the way, the rest of the path is
+// looked up in each of its documents, and numeric keys also select array
+// elements by index. Arrays at the end of the path are returned as is.
+func (b BSON) LookupAll(key string) []Value {
+	vals, err := b.LookupAllErr(key)
+	if err != nil {
+		panic(err)
+	}
+	return vals
+}
+
+// LookupAllErr is like LookupAll but returns an error instead of panicking
+// when the document is malformed along the path.
+func (b BSON) LookupAllErr(key string) ([]Value, error) {
+	if key == "" {
+		return nil, nil
+	}
+	return lookupAll(nil, Value{TypeDocument, b}, strings.Split(key, "."), false)
+}
+
+// lookupAll appends the values found at path below v to dst. If missing is
+// set, an empty Value is added for every branch where the path does not
+// exist.
+func lookupAll(dst []Value, v Value, path []string, missing bool) ([]Value, error) {
+	if len(path) == 0 {
+		return append(dst, v), nil
+	}
+	switch v.valueType {
+	case TypeDocument:
+		child, err := BSON(v.valueData).lookupOne(path[0])
+		if err != nil {
+			return dst, err
+		}
+		if !child.IsEmpty() {
+			return lookupAll(dst, child, path[1:], missing)
+		}
+	case TypeArray:
+		n := len(dst)
+		if isArrayIndex(path[0]) {
+			child, err := BSON(v.valueData).lookupOne(path[0])
+			if err != nil {
+				return dst, err
+			}
+			if !child.IsEmpty() {
+				if dst, err = lookupAll(dst, child, path[1:], missing); err != nil {
+					return dst, err
+				}
+			}
+		}
+		it := BSON(v.valueData).Elements()
+		for it.Next() {
+			if it.val.valueType != TypeDocument {
+				continue
+			}
+			var err error
+			if dst, err = lookupAll(dst, it.val, path, missing); err != nil {
+				return dst, err
+			}
+		}
+		if it.err != nil || len(dst) > n {
+			return dst, it.err
 		}
 	}
-	return
+	if missing {
+		dst = append(dst, Value{})
+	}
+	return dst, nil
 }
 
-func (b BSON) lookupOne(key string) (val Value) {
-	elements := b[4 : len(b)-1]
-	keyb := []byte(key)
-	for elements != nil {
-		ckey, cval, next := getElement(elements)
-		if ckey != nil && bytes.Equal(ckey, keyb) {
-			return cval
+func isArrayIndex(key string) bool {
+	if key == "" || (key[0] == '0' && len(key) > 1) {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < '0' || key[i] > '9' {
+			return false
 		}
-		elements = next
 	}
-	return
+	return true
+}
+
+func (b BSON) lookupOne(key string) (val Value, err error) {
+	it := b.Elements()
+	for it.Next() {
+		if string(it.key) == key {
+			return it.val, nil
+		}
+	}
+	return Value{}, it.err
+}
+
+// elements checks the document header and terminator and returns the bytes
+// between them.
+func (b BSON) elements() (BSON, error) {
+	if len(b) < 5 {
+		return nil, &TruncatedError{Need: 5, Have: len(b)}
+	}
+	if l := getint(b); l != len(b) {
+		return nil, &LengthError{Length: l}
+	}
+	if b[len(b)-1] != 0x00 {
+		return nil, &TerminatorError{Pos{Offset: int64(len(b) - 1)}}
+	}
+	return b[4 : len(b)-1], nil
 }
 
 type toSearchValue struct {
@@ -64,61 +158,129 @@ func (b BSON) FastContains(v toSearchValue) bool {
 }
 
 func (b BSON) Map() (vals M) {
+	vals, err := b.MapErr()
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+// MapErr is like Map but returns an error instead of panicking on malformed
+// data.
+func (b BSON) MapErr() (vals M, err error) {
 	vals = make(M)
-	elements := b[4 : len(b)-1]
-	for elements != nil {
-		ckey, cval, next := getElement(elements)
-		if ckey != nil {
-			vals[string(ckey)] = cval.Value()
+	err = b.each(func(key []byte, val Value) error {
+		v, err := val.ValueErr()
+		if err != nil {
+			return err
 		}
-		elements = next
-	}
+		vals[string(key)] = v
+		return nil
+	})
 	return
 }
 
-func (b BSON) ToValueMap() (vals map[string]Value) {
-	vals = make(map[string]Value)
-	elements := b[4 : len(b)-1]
-	for elements != nil {
-		ckey, cval, next := getElement(elements)
-		if ckey != nil {
-			vals[string(ckey)] = cval
+// D is like Map but keeps the order of keys, nested documents are decoded
+// as D too.
+func (b BSON) D() D {
+	d, err := b.DErr()
+	must(err)
+	return d
+}
+
+// DErr is like D but returns an error instead of panicking on malformed
+// data.
+func (b BSON) DErr() (d D, err error) {
+	d = D{}
+	err = b.each(func(key []byte, val Value) error {
+		v, err := val.valueD()
+		if err != nil {
+			return err
 		}
-		elements = next
+		d = append(d, E{Key: string(key), Value: v})
+		return nil
+	})
+	return
+}
+
+func (b BSON) ToValueMap() (vals map[string]Value) {
+	vals, err := b.ToValueMapErr()
+	if err != nil {
+		panic(err)
 	}
 	return
 }
 
+// ToValueMapErr is like ToValueMap but returns an error instead of panicking
+// on malformed data.
+func (b BSON) ToValueMapErr() (vals map[string]Value, err error) {
+	vals = make(map[string]Value)
+	err = b.each(func(key []byte, val Value) error {
+		vals[string(key)] = val
+		return nil
+	})
+	return
+}
+
 func (b BSON) Array() (arr []interface{}) {
-	elements := b[4 : len(b)-1]
-	for elements != nil {
-		ckey, cval, next := getElement(elements)
-		if ckey != nil {
-			arr = append(arr, cval.Value())
-		}
-		elements = next
+	arr, err := b.ArrayErr()
+	if err != nil {
+		panic(err)
 	}
 	return
 }
 
-func (b BSON) ToValueArray() (arr []Value) {
-	elements := b[4 : len(b)-1]
-	for elements != nil {
-		ckey, cval, next := getElement(elements)
-		if ckey != nil {
-			arr = append(arr, cval)
+// ArrayErr is like Array but returns an error instead of panicking on
+// malformed data.
+func (b BSON) ArrayErr() (arr []interface{}, err error) {
+	err = b.each(func(key []byte, val Value) error {
+		v, err := val.ValueErr()
+		if err != nil {
+			return err
 		}
-		elements = next
+		arr = append(arr, v)
+		return nil
+	})
+	return
+}
+
+func (b BSON) ToValueArray() (arr []Value) {
+	arr, err := b.ToValueArrayErr()
+	if err != nil {
+		panic(err)
 	}
 	return
 }
 
+// ToValueArrayErr is like ToValueArray but returns an error instead of
+// panicking on malformed data.
+func (b BSON) ToValueArrayErr() (arr []Value, err error) {
+	err = b.each(func(key []byte, val Value) error {
+		arr = append(arr, val)
+		return nil
+	})
+	return
+}
+
+// each calls f for every element of b. Errors returned by f are reported
+// relative to the start of b.
+func (b BSON) each(f func(key []byte, val Value) error) error {
+	it := b.Elements()
+	for it.Next() {
+		if err := f(it.key, it.val); err != nil {
+			return withOffset(withKey(err, it.key), it.valueOffset())
+		}
+	}
+	return it.err
+}
+
 func (b BSON) Unmarshal(out interface{}) (err error) {
 	return Unmarshal(b, out)
 }
 
+// ToJson converts b to plain JSON, keeping the order of keys.
 func (b BSON) ToJson() (s []byte, err error) {
-	return json.Marshal(b.Map())
+	return b.AppendJSON(make([]byte, 0, len(b)+len(b)/2))
 }
 
 func (b BSON) MustToJson() (s []byte) {
@@ -130,45 +292,100 @@ func (b BSON) MustToJson() (s []byte) {
 }
 
 func getElement(b BSON) (key []byte, val Value, next BSON) {
+	key, val, next, err := readElement(b)
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+// readElement parses the first element of b with bounds checking. Error
+// positions are relative to the start of b.
+func readElement(b BSON) (key []byte, val Value, next BSON, err error) {
 	if len(b) == 0 {
-		return nil, val, nil
+		return nil, val, nil, nil
 	}
 	elementType := b[0]
-	keyStart, keyEnd := 1, bytes.IndexByte(b, 0x00)
-	key = b[keyStart:keyEnd]
-	var valb []byte
-	switch elementType {
+	keyEnd := bytes.IndexByte(b, 0x00)
+	if keyEnd == 0 {
+		return nil, val, nil, &InvalidTypeError{Type: elementType}
+	}
+	if keyEnd < 0 {
+		return nil, val, nil, &TerminatorError{Pos{Offset: 1}}
+	}
+	key = b[1:keyEnd]
+	valb := b[keyEnd+1:]
+	n, err := valueSize(elementType, valb)
+	if err != nil {
+		return nil, val, nil, withKey(withOffset(err, keyEnd+1), key)
+	}
+	if n < 0 {
+		return nil, val, nil, &InvalidTypeError{Pos{Key: string(key)}, elementType}
+	}
+	val, next = Value{elementType, valb[:n]}, valb[n:]
+	return
+}
+
+func isValidType(t ValueType) bool {
+	return t >= TypeDouble && t <= TypeDecimal128 || t == TypeMinKey || t == TypeMaxKey
+}
+
+// valueSize returns the size of the value of type t at the start of b, or -1
+// if t is not a valid type.
+func valueSize(t ValueType, b []byte) (n int, err error) {
+	switch t {
 	case TypeDouble, TypeDatetime, TypeTimestamp, TypeInt64:
-		valb = b[keyEnd+1 : keyEnd+1+8]
-	case TypeString, TypeJSCode, TypeSymbol, TypeJSCodeScope:
-		strLen := getint(b[keyEnd+1 : keyEnd+1+4])
-		valb = b[keyEnd+1 : keyEnd+1+4+strLen]
-	case TypeDocument, TypeArray:
-		Len := getint(b[keyEnd+1 : keyEnd+1+4])
-		valb = b[keyEnd+1 : keyEnd+1+Len]
+		n = 8
+	case TypeString, TypeJSCode, TypeSymbol, TypeDBPointer:
+		if len(b) < 4 {
+			return 0, &TruncatedError{Need: 4, Have: len(b)}
+		}
+		strLen := getint(b)
+		if strLen < 1 {
+			return 0, &LengthError{Length: strLen}
+		}
+		n = 4 + strLen
+		if t == TypeDBPointer {
+			n += 12
+		}
+	case TypeDocument, TypeArray, TypeJSCodeScope:
+		if len(b) < 4 {
+			return 0, &TruncatedError{Need: 4, Have: len(b)}
+		}
+		n = getint(b)
+		if n < 5 || t == TypeJSCodeScope && n < 4+5+5 {
+			return 0, &LengthError{Length: n}
+		}
 	case TypeBinary:
-		Len := getint(b[keyEnd+1 : keyEnd+1+4])
-		valb = b[keyEnd+1 : keyEnd+1+4+1+Len]
+		if len(b) < 4 {
+			return 0, &TruncatedError{Need: 4, Have: len(b)}
+		}
+		n = 4 + 1 + getint(b)
 	case TypeUndefined, TypeNull, TypeMinKey, TypeMaxKey:
 		// no value
 	case TypeObjectId:
-		valb = b[keyEnd+1 : keyEnd+1+12]
+		n = 12
 	case TypeBoolean:
-		valb = b[keyEnd+1 : keyEnd+1+1]
+		n = 1
 	case TypeRegex:
-		i := bytes.IndexByte(b[keyEnd+1:], 0x00)
-		i2 := bytes.IndexByte(b[keyEnd+1+i+1:], 0x00)
-		valb = b[keyEnd+1 : keyEnd+1+i+1+i2+1]
-	case TypeDBPointer:
-		strLen := getint(b[keyEnd+1 : keyEnd+1+4])
-		valb = b[keyEnd+1 : keyEnd+1+4+int(strLen)+12]
+		i := bytes.IndexByte(b, 0x00)
+		if i < 0 {
+			return 0, &TerminatorError{}
+		}
+		i2 := bytes.IndexByte(b[i+1:], 0x00)
+		if i2 < 0 {
+			return 0, &TerminatorError{Pos{Offset: int64(i + 1)}}
+		}
+		n = i + 1 + i2 + 1
 	case TypeInt32:
-		valb = b[keyEnd+1 : keyEnd+1+4]
+		n = 4
 	case TypeDecimal128:
-		valb = b[keyEnd+1 : keyEnd+1+16]
+		n = 16
 	default:
-		panic(fmt.Sprintf("invalid bson type %#v", elementType))
+		return -1, nil
+	}
+	if n > len(b) {
+		return 0, &TruncatedError{Need: n, Have: len(b)}
 	}
-	val, next = Value{elementType, valb}, b[len(key)+1+len(valb)+1:]
 	return
 }
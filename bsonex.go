@@ -2,10 +2,71 @@ package bsonex
 
 import (
 	"bufio"
+	"context"
 	"io"
 	"sync"
 )
 
+// Options configures a Decoder, zero fields take the default value.
+type Options struct {
+	// BufferSize is the size of the read buffer, 4 MiB by default. In
+	// recovery mode documents that fit in it are checked before they are
+	// consumed.
+	BufferSize int
+	// BatchSize is the most documents Do hands to a worker at once, 100 by
+	// default.
+	BatchSize int
+	// BatchBytes ends a batch early once its documents add up to this many
+	// bytes, 1 MiB by default, so large documents are spread over the
+	// workers and small ones are not sent one channel operation at a time.
+	BatchBytes int
+	// QueueDepth is the number of batches waiting for a worker, 2*parallel
+	// by default.
+	QueueDepth int
+	// MaxDocumentSize is the largest document length prefix accepted, 16 MiB
+	// by default. Larger ones are reported as a *LengthError before anything
+	// is allocated.
+	MaxDocumentSize int
+	// ZeroCopy makes ForEach, Do and DoOrdered reuse the memory of the
+	// documents they pass to callbacks instead of allocating each one. A
+	// document is then only valid until the callback returns, or for
+	// DoOrdered until its sinkFn returns, use BSONEX.Clone to keep it.
+	// ForEach slices documents straight out of the read buffer when they fit
+	// in it, Do and DoOrdered read batches into pooled buffers. It has no
+	// effect in recovery mode.
+	ZeroCopy bool
+}
+
+const (
+	defaultBufferSize      = 4 << 20
+	defaultBatchSize       = 100
+	defaultBatchBytes      = 1 << 20
+	defaultMaxDocumentSize = 16 << 20
+)
+
+func (o Options) withDefaults() Options {
+	if o.BufferSize <= 0 {
+		o.BufferSize = defaultBufferSize
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = defaultBatchSize
+	}
+	if o.BatchBytes <= 0 {
+		o.BatchBytes = defaultBatchBytes
+	}
+	if o.MaxDocumentSize <= 0 {
+		o.MaxDocumentSize = defaultMaxDocumentSize
+	}
+	return o
+}
+
+func (o Options) queueDepth(parallel int) int {
+	if o.QueueDepth > 0 {
+		return o.QueueDepth
+	}
+	return parallel * 2
+}
+
 type BSONEX struct {
 	BSON
 	offset   int64
@@ -24,85 +85,282 @@ func (b *BSONEX) Size() int {
 	return len(b.BSON)
 }
 
+// Clone returns a copy of b that owns its bytes, to keep a document passed
+// to a callback in zero copy mode, see Options.ZeroCopy.
+func (b BSONEX) Clone() BSONEX {
+	b.BSON = append(BSON(nil), b.BSON...)
+	return b
+}
+
 func (b BSONEX) String() string {
 	return string(b.MustToJson())
 }
 
+// Validate is like BSON.Validate but the returned error also carries the
+// stream offset of the document.
+func (b BSONEX) Validate() error {
+	return withDocOffset(b.BSON.Validate(), b.offset)
+}
+
 func NewDecoder(r io.Reader) *Decoder {
-	return &Decoder{bufio.NewReaderSize(r, 4<<20)}
+	return NewDecoderWithOptions(r, Options{})
+}
+
+func NewDecoderWithOptions(r io.Reader, opts Options) *Decoder {
+	opts = opts.withDefaults()
+	d := &Decoder{r: bufio.NewReaderSize(r, opts.BufferSize), opts: opts}
+	d.bufs.New = func() interface{} {
+		buf := make([]byte, 0, opts.BatchBytes)
+		return &buf
+	}
+	return d
 }
 
 type Decoder struct {
-	r io.Reader
+	r      *bufio.Reader
+	opts   Options
+	offset int64
+	onSkip func(start, end int64, err error)
+	buf    []byte    // reused by ForEach in zero copy mode
+	bufs   sync.Pool // *[]byte batch buffers in zero copy mode
+}
+
+// SetRecover turns on recovery mode. Instead of failing at the first bad
+// document, the decoder validates every document and, after a bad one, scans
+// forward byte by byte for the next plausible document header (sane length,
+// valid first element type, trailing 0x00) and resumes from there. Each
+// skipped byte range [start, end) of the stream is reported to onSkip along
+// with the error that caused it. Passing nil turns recovery mode off.
+func (d *Decoder) SetRecover(onSkip func(start, end int64, err error)) {
+	d.onSkip = onSkip
+}
+
+// Offset returns the stream offset of the next document to be read.
+func (d *Decoder) Offset() int64 {
+	return d.offset
 }
 
+// ForEach calls f on every document in order and returns the first error of
+// f unchanged.
 func (d *Decoder) ForEach(f func(b BSONEX) error) (err error) {
-	var offset int64
+	return d.ForEachContext(context.Background(), f)
+}
+
+// ForEachContext is like ForEach but stops before the next document once ctx
+// is done, returning ctx.Err(). A read blocked in the underlying reader is not
+// interrupted.
+func (d *Decoder) ForEachContext(ctx context.Context, f func(b BSONEX) error) error {
+	err := d.forEach(ctx, f)
+	if e, ok := err.(*CallbackError); ok {
+		return e.Err
+	}
+	return err
+}
+
+// forEach is ForEachContext with the errors of f wrapped in a *CallbackError,
+// for Do and DoOrdered with a single goroutine.
+func (d *Decoder) forEach(ctx context.Context, f func(b BSONEX) error) error {
 	for {
-		one, err := d.ReadOne()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var one []byte
+		var err error
+		peeked := false
+		if d.zeroCopy() {
+			one, peeked, err = d.readShared()
+		} else {
+			one, err = d.ReadOne()
+		}
 		if err != nil {
 			if err == io.EOF {
-				break
+				return nil
 			}
 			return err
 		}
-		err = f(BSONEX{BSON: one, offset: offset})
-		offset += int64(len(one))
+		b := BSONEX{BSON: one, offset: d.offset - int64(len(one))}
+		if peeked {
+			b.offset = d.offset
+		}
+		err = f(b)
+		if peeked {
+			n, _ := d.r.Discard(len(one))
+			d.offset += int64(n)
+		}
 		if err != nil {
-			return err
+			return callbackError(&b, err)
 		}
 	}
-	return
 }
 
+func (d *Decoder) zeroCopy() bool {
+	return d.opts.ZeroCopy && d.onSkip == nil
+}
+
+// readShared reads the next document without allocating. It is sliced from
+// the read buffer when it fits, peeked reports that it still has to be
+// discarded, otherwise it is read into d.buf. Either way it is only valid
+// until the next read.
+func (d *Decoder) readShared() (one []byte, peeked bool, err error) {
+	header, err := d.r.Peek(4)
+	if len(header) == 4 {
+		docLen := getint(header)
+		if docLen >= 5 && docLen <= d.opts.MaxDocumentSize && docLen <= d.r.Size() {
+			one, err = d.r.Peek(docLen)
+			if len(one) == docLen && one[docLen-1] == 0x00 {
+				return one[:docLen:docLen], true, nil
+			}
+		}
+	}
+	// bufio returns a read error only once
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	// readDocument reports what is wrong with it
+	one, err = d.readInto(d.buf)
+	if cap(one) > cap(d.buf) {
+		d.buf = one[:0]
+	}
+	return one, false, err
+}
+
+// Do calls f on every document from parallel goroutines, in batches sized by
+// Options, see BSONEX.RunnerID. The first error stops the reading and the
+// workers, and is returned once they are all done. Errors of f are wrapped in
+// a *CallbackError.
 func (d *Decoder) Do(parallel int, f func(b BSONEX) error) (err error) {
+	return d.DoContext(context.Background(), parallel, f)
+}
+
+// DoContext is like Do but stops reading and dispatching documents as soon as
+// ctx is done or any call of f fails. It returns the first error, either from
+// reading, from f or ctx.Err(), after all the workers have returned.
+func (d *Decoder) DoContext(ctx context.Context, parallel int, f func(b BSONEX) error) error {
 	if parallel <= 1 {
-		return d.ForEach(f)
+		return d.forEach(ctx, f)
 	}
-	ch := make(chan []*BSONEX, parallel*2)
-	errCh := make(chan error, parallel)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	failed := &firstError{cancel: cancel}
+
+	ch := make(chan *batch, d.opts.queueDepth(parallel))
 	var wg sync.WaitGroup
 	wg.Add(parallel)
-	defer wg.Wait()
 	for i := 0; i < parallel; i++ {
 		go func(id int) {
 			defer wg.Done()
 			for bs := range ch {
-				for _, b := range bs {
+				for i := range bs.docs {
+					if err := ctx.Err(); err != nil {
+						failed.set(err)
+						return
+					}
+					b := &bs.docs[i]
 					b.runnerID = id
-					err := f(*b)
-					if err != nil {
-						errCh <- err
+					if err := f(*b); err != nil {
+						failed.set(callbackError(b, err))
 						return
 					}
 				}
+				d.release(bs)
 			}
 		}(i)
 	}
-	defer close(ch)
-	var bs []*BSONEX
-	var offset int64
+	err := d.dispatch(ctx, func(bs *batch) bool {
+		select {
+		case ch <- bs:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+	if err != nil {
+		failed.set(err)
+	}
+	close(ch)
+	wg.Wait()
+	return failed.err
+}
+
+// firstError keeps the first error of a pipeline and cancels it.
+type firstError struct {
+	once   sync.Once
+	err    error
+	cancel context.CancelFunc
+}
+
+func (e *firstError) set(err error) {
+	e.once.Do(func() {
+		e.err = err
+		e.cancel()
+	})
+}
+
+// batch is a run of documents read by dispatch. In zero copy mode they are
+// read into buf as long as they fit, which goes back to the pool once the
+// batch is done with.
+type batch struct {
+	docs []BSONEX
+	buf  *[]byte
+}
+
+// dispatch reads documents into batches of Options.BatchSize documents or
+// Options.BatchBytes bytes and passes them to send until the end of input or
+// ctx is done. send returns false if ctx is done.
+func (d *Decoder) dispatch(ctx context.Context, send func(bs *batch) bool) error {
+	bs := d.newBatch()
+	size := 0
 	for {
-		one, err := d.ReadOne()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-		bs = append(bs, &BSONEX{BSON: one, offset: offset})
-		offset += int64(len(one))
-		if len(bs) == 100 {
-			select {
-			case ch <- bs:
-				bs = nil
-			case err = <-errCh:
+		var one []byte
+		var err error
+		if bs.buf != nil {
+			free := (*bs.buf)[len(*bs.buf):cap(*bs.buf)]
+			if one, err = d.readInto(free); err == nil && len(one) <= len(free) {
+				*bs.buf = (*bs.buf)[:len(*bs.buf)+len(one)]
+			}
+		} else {
+			one, err = d.ReadOne()
+		}
+		if err != nil {
+			if err != io.EOF {
 				return err
 			}
+			break
+		}
+		bs.docs = append(bs.docs, BSONEX{BSON: one, offset: d.offset - int64(len(one))})
+		size += len(one)
+		if len(bs.docs) >= d.opts.BatchSize || size >= d.opts.BatchBytes {
+			if !send(bs) {
+				return ctx.Err()
+			}
+			bs, size = d.newBatch(), 0
 		}
 	}
-	ch <- bs
-	return
+	if len(bs.docs) > 0 && !send(bs) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (d *Decoder) newBatch() *batch {
+	bs := &batch{docs: make([]BSONEX, 0, d.opts.BatchSize)}
+	if d.zeroCopy() {
+		bs.buf = d.bufs.Get().(*[]byte)
+	}
+	return bs
+}
+
+// release puts the buffer of bs back to the pool, the documents must not be
+// used anymore.
+func (d *Decoder) release(bs *batch) {
+	if bs.buf != nil {
+		*bs.buf = (*bs.buf)[:0]
+		d.bufs.Put(bs.buf)
+		bs.buf = nil
+	}
 }
 
 func (d *Decoder) Decode(v interface{}) (err error) {
@@ -113,6 +371,166 @@ func (d *Decoder) Decode(v interface{}) (err error) {
 	return Unmarshal(one, v)
 }
 
+// ReadOne reads the next document. It returns io.EOF at a clean end of the
+// stream, otherwise framing problems are reported as *TruncatedError,
+// *LengthError or *TerminatorError carrying the stream offset of the document.
+// In recovery mode bad documents are skipped, see SetRecover.
 func (d *Decoder) ReadOne() (one []byte, err error) {
-	return ReadOne(d.r)
+	if d.onSkip != nil {
+		return d.readRecover()
+	}
+	return d.readOne()
+}
+
+func (d *Decoder) readOne() (one []byte, err error) {
+	return d.readInto(nil)
+}
+
+// readInto reads the next document into buf if it has the capacity.
+func (d *Decoder) readInto(buf []byte) (one []byte, err error) {
+	one, n, err := readDocument(d.r, d.offset, d.opts.MaxDocumentSize, buf)
+	d.offset += n
+	return one, err
+}
+
+// ReadOne reads a single document from r without buffering past its end.
+func ReadOne(r io.Reader) (BSON, error) {
+	one, _, err := readDocument(r, 0, defaultMaxDocumentSize, nil)
+	return one, err
+}
+
+// readDocument reads the document at stream offset offset from r into buf, or
+// a new slice if buf is too small, returning the number of bytes consumed. A
+// length prefix above max is rejected before the document is allocated.
+func readDocument(r io.Reader, offset int64, max int, buf []byte) (one []byte, consumed int64, err error) {
+	var header [4]byte
+	n, err := io.ReadFull(r, header[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = &TruncatedError{Pos{DocOffset: offset}, 4, n}
+		}
+		return nil, int64(n), err
+	}
+	docLen := getint(header[:])
+	if docLen < 5 || docLen > max {
+		return nil, 4, &LengthError{Pos{DocOffset: offset}, docLen}
+	}
+	if cap(buf) >= docLen {
+		// cap the slice so appending to the document can not overwrite the
+		// ones read after it into the same buffer
+		one = buf[:docLen:docLen]
+	} else {
+		one = make([]byte, docLen)
+	}
+	copy(one, header[:])
+	n, err = io.ReadFull(r, one[4:])
+	consumed = int64(4 + n)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = &TruncatedError{Pos{DocOffset: offset, Offset: 4}, docLen - 4, n}
+		}
+		return nil, consumed, err
+	}
+	if one[docLen-1] != 0x00 {
+		return nil, consumed, &TerminatorError{Pos{DocOffset: offset, Offset: int64(docLen - 1)}}
+	}
+	return one, consumed, nil
+}
+
+// readRecover reads the next valid document, skipping over bad bytes.
+func (d *Decoder) readRecover() (one []byte, err error) {
+	start := d.offset
+	var cause error
+	for {
+		var skip int
+		one, skip, err = d.tryOne()
+		if err == nil || err == io.EOF {
+			break
+		}
+		if _, ok := err.(interface{ pos() *Pos }); !ok {
+			return nil, err // I/O error
+		}
+		if cause == nil {
+			cause = err
+		}
+		n, _ := d.r.Discard(skip)
+		d.offset += int64(n)
+	}
+	if end := d.offset - int64(len(one)); end > start {
+		d.onSkip(start, end, cause)
+	}
+	return
+}
+
+// tryOne reads a document at the current position if it looks valid. When it
+// does not, it returns how many bytes have to be skipped before the next try:
+// 1 if the header is not plausible, the whole document if only its content is
+// bad, or 0 if the bad document has already been consumed.
+func (d *Decoder) tryOne() (one []byte, skip int, err error) {
+	offset := d.offset
+	header, err := d.r.Peek(4)
+	if len(header) == 0 && err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if len(header) < 4 {
+		if err == io.EOF {
+			err = &TruncatedError{Pos{DocOffset: offset}, 4, len(header)}
+		}
+		return nil, len(header), err
+	}
+	docLen := getint(header)
+	if docLen < 5 || docLen > d.opts.MaxDocumentSize {
+		return nil, 1, &LengthError{Pos{DocOffset: offset}, docLen}
+	}
+	if docLen > d.r.Size() {
+		// too large to look at as a whole before consuming it, check the
+		// elements that fit into the buffer first
+		window, err := d.r.Peek(d.r.Size())
+		if len(window) < d.r.Size() {
+			if err == io.EOF {
+				err = &TruncatedError{Pos{DocOffset: offset, Offset: 4}, docLen - 4, len(window) - 4}
+			}
+			return nil, 1, err
+		}
+		elements := BSON(window[4:])
+		for len(elements) > 0 {
+			_, _, next, err := readElement(elements)
+			if _, ok := err.(*TruncatedError); ok {
+				break
+			}
+			if err != nil {
+				return nil, 1, withDocOffset(withOffset(err, len(window)-len(elements)), offset)
+			}
+			elements = next
+		}
+		one, err = d.readOne()
+		if err == nil {
+			err = withDocOffset(BSON(one).Validate(), offset)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		return one, 0, nil
+	}
+	buf, err := d.r.Peek(docLen)
+	if len(buf) < docLen {
+		if err == io.EOF {
+			err = &TruncatedError{Pos{DocOffset: offset, Offset: 4}, docLen - 4, len(buf) - 4}
+		}
+		return nil, 1, err
+	}
+	if buf[docLen-1] != 0x00 {
+		return nil, 1, &TerminatorError{Pos{DocOffset: offset, Offset: int64(docLen - 1)}}
+	}
+	if docLen > 5 && !isValidType(buf[4]) || docLen == 5 && buf[4] != 0x00 {
+		return nil, 1, &InvalidTypeError{Pos{DocOffset: offset, Offset: 4}, buf[4]}
+	}
+	if err = BSON(buf).Validate(); err != nil {
+		return nil, docLen, withDocOffset(err, offset)
+	}
+	one = make([]byte, docLen)
+	copy(one, buf)
+	n, _ := d.r.Discard(docLen)
+	d.offset += int64(n)
+	return
 }
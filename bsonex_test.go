@@ -1,12 +1,20 @@
 package bsonex
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	gbson "github.com/globalsign/mgo/bson"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -46,23 +54,25 @@ var (
 	ts, _ = NewMongoTimestamp(now, 1)
 	id    = NewObjectId()
 	doc   = M{
-		"float64":   float64(-7.8),                                  // 0x01
-		"string":    "value of str",                                 // 0x02
-		"doc":       M{"int64": int64(321)},                         // 0x03
-		"array":     []int64{22, 33},                                // 0x04
-		"binary":    []byte("binary val"),                           // 0x05
-		"undefined": Undefined,                                      // 0x06
-		"objid":     NewObjectId(),                                  // 0x07
-		"true":      true,                                           // 0x08
-		"false":     false,                                          // 0x08
-		"timestamp": ts,                                             // 0x09
-		"null":      nil,                                            // 0x0A
-		"regex":     RegEx{Pattern: "pattern[a-z]+", Options: "is"}, // 0x0B
-		"DBPointer": DBPointer{Namespace: "test.rs", Id: id},        // 0x0C
-		// 0x0D JavaScript code
-		"int32": int32(-456), // 0x10
-		"time":  now,         // 0x11
-		"int64": int64(-123), // 0x12
+		"float64":   float64(-7.8),                                     // 0x01
+		"string":    "value of str",                                    // 0x02
+		"doc":       M{"int64": int64(321)},                            // 0x03
+		"array":     []int64{22, 33},                                   // 0x04
+		"binary":    []byte("binary val"),                              // 0x05
+		"undefined": Undefined,                                         // 0x06
+		"objid":     NewObjectId(),                                     // 0x07
+		"true":      true,                                              // 0x08
+		"false":     false,                                             // 0x08
+		"timestamp": ts,                                                // 0x09
+		"null":      nil,                                               // 0x0A
+		"regex":     RegEx{Pattern: "pattern[a-z]+", Options: "is"},    // 0x0B
+		"DBPointer": DBPointer{Namespace: "test.rs", Id: id},           // 0x0C
+		"js":        JavaScript{Code: "f()"},                           // 0x0D
+		"symbol":    Symbol("sym"),                                     // 0x0E
+		"jsscope":   JavaScript{Code: "g(a)", Scope: M{"a": int32(1)}}, // 0x0F
+		"int32":     int32(-456),                                       // 0x10
+		"time":      now,                                               // 0x11
+		"int64":     int64(-123),                                       // 0x12
 		// 0x13
 		"min": MinKey,
 		"max": MaxKey,
@@ -75,15 +85,30 @@ func TestJson(t *testing.T) {
 	o, err := Marshal(doc)
 	assert.NoError(t, err)
 	b := BSON(o)
-	assert.Equal(t, string(bj), b.String())
+	assert.JSONEq(t, string(bj), b.String())
 	bj2, err := json.Marshal(b.ToValueMap())
 	assert.NoError(t, err)
-	assert.Equal(t, string(bj2), b.String())
+	assert.JSONEq(t, string(bj2), b.String())
 	vo, err := Marshal(b.ToValueMap())
 	assert.NoError(t, err)
 	assert.Equal(t, BSON(b).ToValueMap(), BSON(vo).ToValueMap())
 	assert.Equal(t, BSON(b).Map(), BSON(vo).Map())
-	assert.Equal(t, BSON(b).String(), BSON(vo).String())
+	assert.JSONEq(t, BSON(b).String(), BSON(vo).String())
+}
+
+func TestJsonOrder(t *testing.T) {
+	o, err := Marshal(gbson.D{
+		{Name: "z", Value: 1},
+		{Name: "a", Value: gbson.D{{Name: "y", Value: "<\"\u2028>"}, {Name: "b", Value: []interface{}{}}}},
+		{Name: "m", Value: 1.5e-7},
+		{Name: "$sort", Value: gbson.D{{Name: "k2", Value: -1}, {Name: "k1", Value: 1}}},
+	})
+	assert.NoError(t, err)
+	want := `{"z":1,"a":{"y":"<\"\u2028>","b":[]},"m":1.5e-7,"$sort":{"k2":-1,"k1":1}}`
+	assert.Equal(t, want, BSON(o).String())
+	assert.Equal(t, `{"k2":-1,"k1":1}`, BSON(o).Lookup("$sort").String())
+	_, err = BSON(o).Lookup("m").MarshalJSON()
+	assert.NoError(t, err)
 }
 
 func TestValueMap(t *testing.T) {
@@ -126,6 +151,12 @@ func TestBsonGet(t *testing.T) {
 	assert.Equal(t, ts, bs.Lookup("timestamp").MongoTimestamp())
 	assert.Equal(t, "test.rs", bs.Lookup("DBPointer").DBPointer().Namespace)
 	assert.Equal(t, id, bs.Lookup("DBPointer").DBPointer().Id)
+	assert.Equal(t, "f()", bs.Lookup("js").JSCode())
+	assert.Equal(t, Symbol("sym"), bs.Lookup("symbol").Symbol())
+	code, scope := bs.Lookup("jsscope").JSCodeWithScope()
+	assert.Equal(t, "g(a)", code)
+	assert.Equal(t, int32(1), scope.Lookup("a").Int32())
+	assert.Equal(t, doc["jsscope"], bs.Lookup("jsscope").Value())
 	assert.Equal(t, int64(321), bs.Lookup("doc.int64").Int64(), "Lookup many")
 	assert.Equal(t, int64(0), bs.Lookup("doc.x").Int64(), "Lookup many")
 	assert.Equal(t, int64(0), bs.Lookup("doc.x.x").Int64(), "Lookup many")
@@ -169,6 +200,355 @@ func TestDo(t *testing.T) {
 	}
 }
 
+// repeatReader yields doc over and over.
+type repeatReader struct {
+	doc []byte
+	off int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.doc[r.off:])
+		n += c
+		r.off = (r.off + c) % len(r.doc)
+	}
+	return n, nil
+}
+
+// leakCheck tracks the reads of r and the callbacks of a Do call, to check
+// that none of them is still running or starts once the call returned.
+type leakCheck struct {
+	t       *testing.T
+	r       io.Reader
+	running int32
+	done    int32
+}
+
+func (c *leakCheck) Read(p []byte) (int, error) {
+	defer c.track()()
+	return c.r.Read(p)
+}
+
+// track marks the start of a read or callback, the returned func its end.
+func (c *leakCheck) track() func() {
+	atomic.AddInt32(&c.running, 1)
+	if atomic.LoadInt32(&c.done) != 0 {
+		c.t.Error("read or callback after Do returned")
+	}
+	return func() { atomic.AddInt32(&c.running, -1) }
+}
+
+// returned checks that nothing runs anymore and fails on anything later.
+func (c *leakCheck) returned(msgAndArgs ...interface{}) {
+	atomic.StoreInt32(&c.done, 1)
+	assert.Equal(c.t, int32(0), atomic.LoadInt32(&c.running), msgAndArgs...)
+}
+
+func TestDoContext(t *testing.T) {
+	doc, _ := Marshal(M{"a": 1})
+	errStop := errors.New("stop")
+	for _, parallel := range []int{1, 4} {
+		var calls int32
+		lc := &leakCheck{t: t, r: &repeatReader{doc: doc}}
+		err := NewDecoder(lc).DoContext(context.Background(), parallel, func(b BSONEX) error {
+			defer lc.track()()
+			n := atomic.AddInt32(&calls, 1)
+			if n > 1000-int32(parallel) && n < 1000 {
+				// the other workers are still busy when Do stops
+				time.Sleep(5 * time.Millisecond)
+			}
+			if n == 1000 {
+				return errStop
+			}
+			return nil
+		})
+		assert.True(t, errors.Is(err, errStop), parallel)
+		lc.returned(parallel)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		calls = 0
+		lc = &leakCheck{t: t, r: &repeatReader{doc: doc}}
+		err = NewDecoder(lc).DoContext(ctx, parallel, func(b BSONEX) error {
+			defer lc.track()()
+			n := atomic.AddInt32(&calls, 1)
+			if n > 1000-int32(parallel) && n < 1000 {
+				// the other workers are still busy when Do stops
+				time.Sleep(5 * time.Millisecond)
+			}
+			if n == 1000 {
+				cancel()
+			}
+			return nil
+		})
+		assert.Equal(t, context.Canceled, err, parallel)
+		// documents already handed to a worker may still be running
+		assert.True(t, atomic.LoadInt32(&calls) < 1000+int32(parallel), parallel)
+		lc.returned(parallel)
+	}
+
+	// read errors are returned once the workers are done
+	bad := append(append([]byte(nil), doc...), 1, 0, 0, 0)
+	lc := &leakCheck{t: t, r: bytes.NewReader(bad)}
+	err := NewDecoder(lc).DoContext(context.Background(), 4, func(b BSONEX) error {
+		defer lc.track()()
+		return nil
+	})
+	assert.IsType(t, &LengthError{}, err)
+	lc.returned()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = NewDecoder(bytes.NewReader(doc)).ForEachContext(ctx, func(b BSONEX) error {
+		t.Fatal("called after cancel")
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestDoErrors(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	for i := 0; i < 250; i++ {
+		assert.NoError(t, e.Encode(M{"i": i}))
+	}
+	stream := buf.Bytes()
+	size := int64(len(stream) / 250)
+	errStop := errors.New("stop")
+	errLater := errors.New("later")
+	for _, parallel := range []int{1, 4, 16} {
+		// a failure in the last, partial batch is not lost
+		lc := &leakCheck{t: t, r: bytes.NewReader(stream)}
+		err := NewDecoder(lc).Do(parallel, func(b BSONEX) error {
+			defer lc.track()()
+			if b.Lookup("i").Int32() == 249 {
+				return errStop
+			}
+			return nil
+		})
+		var ce *CallbackError
+		if assert.True(t, errors.As(err, &ce), parallel) {
+			assert.Equal(t, 249*size, ce.DocOffset)
+			assert.True(t, ce.RunnerID >= 0 && ce.RunnerID < parallel)
+			assert.Equal(t, errStop, ce.Err)
+		}
+		lc.returned(parallel)
+
+		// the first error wins over the ones of the calls still running
+		var waiting, failed int32
+		lc = &leakCheck{t: t, r: bytes.NewReader(stream)}
+		err = NewDecoderWithOptions(lc, Options{BatchSize: 1}).Do(parallel, func(b BSONEX) error {
+			defer lc.track()()
+			i := b.Lookup("i").Int32()
+			if i == 100 {
+				// fail once the other workers are running
+				for atomic.LoadInt32(&waiting) < int32(parallel-1) {
+					time.Sleep(time.Millisecond)
+				}
+				atomic.StoreInt32(&failed, 1)
+				return errStop
+			}
+			if i > 100 && i < 100+int32(parallel) {
+				// and make them fail after it
+				atomic.AddInt32(&waiting, 1)
+				for atomic.LoadInt32(&failed) == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				time.Sleep(10 * time.Millisecond)
+				return errLater
+			}
+			return nil
+		})
+		ce = nil
+		if assert.True(t, errors.As(err, &ce), parallel) {
+			assert.Equal(t, errStop, ce.Err, parallel)
+			assert.Equal(t, 100*size, ce.DocOffset)
+			assert.True(t, ce.RunnerID >= 0 && ce.RunnerID < parallel)
+		}
+		lc.returned(parallel)
+
+		// every worker failing does not block the reader, the error is the
+		// one of a failed call
+		var mu sync.Mutex
+		offsets := map[int64]int{}
+		lc = &leakCheck{t: t, r: bytes.NewReader(stream)}
+		err = NewDecoder(lc).Do(parallel, func(b BSONEX) error {
+			defer lc.track()()
+			mu.Lock()
+			offsets[b.Offset()] = b.RunnerID()
+			mu.Unlock()
+			return errStop
+		})
+		lc.returned(parallel)
+		ce = nil
+		if assert.True(t, errors.As(err, &ce), parallel) {
+			runner, ok := offsets[ce.DocOffset]
+			assert.True(t, ok, parallel)
+			assert.Equal(t, runner, ce.RunnerID)
+			assert.Equal(t, errStop, ce.Err)
+		}
+		assert.True(t, len(offsets) <= parallel)
+
+		// a read error stops the workers
+		bad := append(append([]byte(nil), stream...), 1, 0, 0, 0)
+		var calls int32
+		lc = &leakCheck{t: t, r: bytes.NewReader(bad)}
+		err = NewDecoder(lc).Do(parallel, func(b BSONEX) error {
+			defer lc.track()()
+			atomic.AddInt32(&calls, 1)
+			return nil
+		})
+		assert.IsType(t, &LengthError{}, err)
+		assert.True(t, atomic.LoadInt32(&calls) <= 250)
+		lc.returned(parallel)
+	}
+
+	// ForEach returns the error of f as is, also in zero copy mode
+	for _, opts := range []Options{{}, {ZeroCopy: true}} {
+		err := NewDecoderWithOptions(bytes.NewReader(stream), opts).ForEach(func(b BSONEX) error {
+			return errStop
+		})
+		assert.Equal(t, errStop, err)
+		var ce *CallbackError
+		nested := &CallbackError{DocOffset: 1, Err: errStop}
+		err = NewDecoderWithOptions(bytes.NewReader(stream), opts).ForEach(func(b BSONEX) error {
+			return nested
+		})
+		assert.True(t, errors.As(err, &ce))
+		assert.Same(t, nested, ce)
+	}
+}
+
+func TestDecoderOptions(t *testing.T) {
+	doc, _ := Marshal(M{"a": 1})
+	stream := bytes.Repeat(doc, 250)
+	assert.Equal(t, 4<<20, NewDecoder(nil).r.Size())
+	assert.Equal(t, 1<<10, NewDecoderWithOptions(nil, Options{BufferSize: 1 << 10}).r.Size())
+
+	batches := func(opts Options) (sizes []int) {
+		d := NewDecoderWithOptions(bytes.NewReader(stream), opts)
+		err := d.dispatch(context.Background(), func(bs *batch) bool {
+			sizes = append(sizes, len(bs.docs))
+			return true
+		})
+		assert.NoError(t, err)
+		return
+	}
+	assert.Equal(t, []int{100, 100, 50}, batches(Options{}))
+	assert.Equal(t, []int{120, 120, 10}, batches(Options{BatchSize: 120}))
+	// the byte budget ends the batch first
+	assert.Equal(t, []int{100, 100, 50}, batches(Options{BatchSize: 1000, BatchBytes: 100 * len(doc)}))
+	assert.Equal(t, []int{3, 3}, batches(Options{BatchSize: 1000, BatchBytes: 3*len(doc) - 1})[:2])
+
+	var n int32
+	err := NewDecoderWithOptions(bytes.NewReader(stream), Options{BatchSize: 1, QueueDepth: 1}).Do(4, func(b BSONEX) error {
+		atomic.AddInt32(&n, 1)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(250), n)
+
+	// oversized length prefixes are rejected before allocating
+	for _, header := range [][]byte{{0, 0, 0, 2}, {0xff, 0xff, 0xff, 0x7f}} {
+		err = NewDecoder(bytes.NewReader(header)).ForEach(func(BSONEX) error { return nil })
+		assert.IsType(t, &LengthError{}, err)
+	}
+	err = NewDecoderWithOptions(bytes.NewReader(doc), Options{MaxDocumentSize: len(doc) - 1}).ForEach(func(BSONEX) error { return nil })
+	var le *LengthError
+	if assert.True(t, errors.As(err, &le)) {
+		assert.Equal(t, len(doc), le.Length)
+	}
+	err = NewDecoderWithOptions(bytes.NewReader(doc), Options{MaxDocumentSize: len(doc)}).ForEach(func(BSONEX) error { return nil })
+	assert.NoError(t, err)
+}
+
+func TestZeroCopy(t *testing.T) {
+	var buf bytes.Buffer
+	var docs [][]byte
+	for i := 0; i < 1000; i++ {
+		doc, _ := Marshal(M{"i": i, "s": strings.Repeat("x", i%150)})
+		docs = append(docs, doc)
+		buf.Write(doc)
+	}
+	stream := buf.Bytes()
+	offsets := map[int64]int{}
+	var off int64
+	for i, doc := range docs {
+		offsets[off] = i
+		off += int64(len(doc))
+	}
+	// a small read buffer and batches so documents also take the fallbacks
+	opts := Options{ZeroCopy: true, BufferSize: 128, BatchBytes: 1000}
+	check := func(b BSONEX) error {
+		i, ok := offsets[b.Offset()]
+		if !ok || !bytes.Equal(docs[i], b.BSON) {
+			return fmt.Errorf("bad document at %d", b.Offset())
+		}
+		return nil
+	}
+
+	var kept []BSONEX
+	err := NewDecoderWithOptions(bytes.NewReader(stream), opts).ForEach(func(b BSONEX) error {
+		kept = append(kept, b.Clone())
+		return check(b)
+	})
+	assert.NoError(t, err)
+	for i, b := range kept {
+		assert.Equal(t, BSON(docs[i]), b.BSON)
+	}
+	for _, parallel := range []int{1, 4} {
+		err = NewDecoderWithOptions(bytes.NewReader(stream), opts).Do(parallel, check)
+		assert.NoError(t, err, parallel)
+		var n int
+		err = NewDecoderWithOptions(bytes.NewReader(stream), opts).DoOrdered(parallel, func(b BSONEX) (interface{}, error) {
+			return b.Lookup("i").Int32(), check(b)
+		}, func(b BSONEX, v interface{}) error {
+			assert.Equal(t, int32(n), v)
+			n++
+			return check(b)
+		})
+		assert.NoError(t, err, parallel)
+		assert.Equal(t, 1000, n)
+	}
+
+	// appending to a document leaves the following ones intact
+	scribble := func(b BSONEX) error {
+		if err := check(b); err != nil {
+			return err
+		}
+		_ = append(b.BSON, bytes.Repeat([]byte{0xff}, 64)...)
+		return nil
+	}
+	err = NewDecoderWithOptions(bytes.NewReader(stream), opts).ForEach(scribble)
+	assert.NoError(t, err)
+	for _, parallel := range []int{1, 4} {
+		err = NewDecoderWithOptions(bytes.NewReader(stream), opts).Do(parallel, scribble)
+		assert.NoError(t, err, parallel)
+		err = NewDecoderWithOptions(bytes.NewReader(stream), opts).DoOrdered(parallel, func(b BSONEX) (interface{}, error) {
+			return nil, scribble(b)
+		}, func(b BSONEX, v interface{}) error {
+			return scribble(b)
+		})
+		assert.NoError(t, err, parallel)
+	}
+
+	// framing errors are the same as without zero copy
+	bad := append([]byte(nil), docs[0]...)
+	bad[len(bad)-1] = 1
+	for _, in := range [][]byte{docs[0][:10], docs[0][:2], bad, {0, 0, 0, 2}} {
+		want := NewDecoder(bytes.NewReader(in)).ForEach(func(BSONEX) error { return nil })
+		got := NewDecoderWithOptions(bytes.NewReader(in), opts).ForEach(func(BSONEX) error { return nil })
+		assert.Error(t, got)
+		assert.Equal(t, want, got)
+	}
+
+	allocs := testing.AllocsPerRun(10, func() {
+		d := NewDecoderWithOptions(bytes.NewReader(stream), Options{ZeroCopy: true})
+		assert.NoError(t, d.ForEach(func(b BSONEX) error { return nil }))
+	})
+	assert.True(t, allocs < 10, allocs)
+}
+
 func TestContains(t *testing.T) {
 	containsCases := map[interface{}]interface{}{
 		"abc": M{"abc": "def"},
@@ -245,6 +625,26 @@ func BenchmarkToMap(b *testing.B) {
 	}
 }
 
+func BenchmarkToJson(b *testing.B) {
+	bs, err := Marshal(doc)
+	assert.NoError(b, err)
+	bsb := BSON(bs)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = bsb.ToJson()
+	}
+}
+
+func BenchmarkToJsonMap(b *testing.B) {
+	bs, err := Marshal(doc)
+	assert.NoError(b, err)
+	bsb := BSON(bs)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = json.Marshal(bsb.Map())
+	}
+}
+
 func BenchmarkToValueMap(b *testing.B) {
 	bs, err := Marshal(doc)
 	assert.NoError(b, err)
@@ -263,3 +663,50 @@ func TestIsEmpty(t *testing.T) {
 	assert.False(t, bsb.Lookup("doc.int64").IsEmpty())
 	assert.True(t, bsb.Lookup("doc.x").IsEmpty())
 }
+
+func TestRecover(t *testing.T) {
+	var stream []byte
+	var want []int
+	type skip struct{ start, end int64 }
+	var wantSkips []skip
+	for i := 0; i < 10; i++ {
+		b, err := Marshal(gbson.D{{Name: "i", Value: i}, {Name: "s", Value: "some text"}})
+		assert.NoError(t, err)
+		start := int64(len(stream))
+		switch i {
+		case 2: // garbage between documents
+			stream = append(stream, 0xde, 0xad, 0xbe, 0xef, 0x00, 0x01)
+			wantSkips = append(wantSkips, skip{start, start + 6})
+		case 5: // bad length prefix
+			b[0], b[1] = 0xff, 0xff
+			wantSkips = append(wantSkips, skip{start, start + int64(len(b))})
+			stream = append(stream, b...)
+			continue
+		case 7: // bad content
+			b[4] = 0x42
+			wantSkips = append(wantSkips, skip{start, start + int64(len(b))})
+			stream = append(stream, b...)
+			continue
+		}
+		stream = append(stream, b...)
+		want = append(want, i)
+	}
+	stream = append(stream, 0x10, 0x00) // truncated tail
+	wantSkips = append(wantSkips, skip{int64(len(stream) - 2), int64(len(stream))})
+
+	var got []int
+	var skips []skip
+	d := NewDecoder(bytes.NewReader(stream))
+	d.SetRecover(func(start, end int64, err error) {
+		assert.Error(t, err)
+		skips = append(skips, skip{start, end})
+	})
+	err := d.ForEach(func(b BSONEX) error {
+		assert.Equal(t, b.BSON, BSON(stream[b.Offset():b.Offset()+int64(b.Size())]))
+		got = append(got, int(b.Lookup("i").Int32()))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+	assert.Equal(t, wantSkips, skips)
+}
@@ -0,0 +1,279 @@
+package bsonex
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBuilderUnbalanced = errors.New("bsonex: builder: unbalanced Start/End calls")
+	ErrBuilderKey        = errors.New("bsonex: builder: key contains 0x00")
+	ErrBuilderRegex      = errors.New("bsonex: builder: regular expression contains 0x00")
+)
+
+// Builder appends typed elements into a reusable buffer and produces a BSON
+// document without reflection. Length prefixes of nested documents and arrays
+// are fixed up when they are ended. Inside an array the key argument is
+// ignored and the element index is written instead.
+//
+// The methods return the Builder so calls can be chained, the first error is
+// kept and returned by Build. A Builder must not be used concurrently.
+type Builder struct {
+	buf   []byte
+	stack []builderLevel
+	err   error
+}
+
+type builderLevel struct {
+	start   int
+	isArray bool
+	n       int
+}
+
+func NewBuilder() *Builder {
+	b := &Builder{}
+	b.Reset()
+	return b
+}
+
+// Reset starts a new document, reusing the buffer. Documents returned by an
+// earlier Build are overwritten.
+func (b *Builder) Reset() {
+	b.buf, b.stack, b.err = b.buf[:0], b.stack[:0], nil
+	b.open(false)
+}
+
+// Build ends the top level document and returns it. The result points into
+// the builder buffer and is valid until the next call to Reset.
+func (b *Builder) Build() (BSON, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if len(b.stack) != 1 {
+		return nil, ErrBuilderUnbalanced
+	}
+	b.close(false)
+	return BSON(b.buf), nil
+}
+
+func (b *Builder) open(isArray bool) {
+	var start int
+	b.buf, start = startDocument(b.buf)
+	b.stack = append(b.stack, builderLevel{start: start, isArray: isArray})
+}
+
+func (b *Builder) close(isArray bool) *Builder {
+	if len(b.stack) == 0 || b.stack[len(b.stack)-1].isArray != isArray {
+		b.setErr(ErrBuilderUnbalanced)
+		return b
+	}
+	b.buf = endDocument(b.buf, b.stack[len(b.stack)-1].start)
+	b.stack = b.stack[:len(b.stack)-1]
+	return b
+}
+
+func (b *Builder) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// header appends the element type and key.
+func (b *Builder) header(t ValueType, key string) {
+	if len(b.stack) == 0 {
+		b.setErr(ErrBuilderUnbalanced)
+		b.open(false)
+	}
+	level := &b.stack[len(b.stack)-1]
+	b.buf = append(b.buf, t)
+	if level.isArray {
+		b.buf = strconv.AppendInt(b.buf, int64(level.n), 10)
+		b.buf = append(b.buf, 0x00)
+	} else {
+		if strings.IndexByte(key, 0x00) >= 0 {
+			b.setErr(ErrBuilderKey)
+		}
+		b.buf = appendCString(b.buf, key)
+	}
+	level.n++
+}
+
+func (b *Builder) StartDocument(key string) *Builder {
+	b.header(TypeDocument, key)
+	b.open(false)
+	return b
+}
+
+func (b *Builder) EndDocument() *Builder {
+	return b.close(false)
+}
+
+func (b *Builder) StartArray(key string) *Builder {
+	b.header(TypeArray, key)
+	b.open(true)
+	return b
+}
+
+func (b *Builder) EndArray() *Builder {
+	return b.close(true)
+}
+
+func (b *Builder) AppendDouble(key string, f float64) *Builder {
+	b.header(TypeDouble, key)
+	b.buf = appendDouble(b.buf, f)
+	return b
+}
+
+func (b *Builder) AppendString(key, s string) *Builder {
+	b.header(TypeString, key)
+	b.buf = appendStringValue(b.buf, s)
+	return b
+}
+
+// AppendDocument appends an already encoded document.
+func (b *Builder) AppendDocument(key string, doc BSON) *Builder {
+	b.header(TypeDocument, key)
+	b.buf = append(b.buf, doc...)
+	return b
+}
+
+// AppendArray appends an already encoded array.
+func (b *Builder) AppendArray(key string, arr BSON) *Builder {
+	b.header(TypeArray, key)
+	b.buf = append(b.buf, arr...)
+	return b
+}
+
+func (b *Builder) AppendBinary(key string, kind byte, data []byte) *Builder {
+	b.header(TypeBinary, key)
+	b.buf = append(appendInt32(b.buf, int32(len(data))), kind)
+	b.buf = append(b.buf, data...)
+	return b
+}
+
+func (b *Builder) AppendUndefined(key string) *Builder {
+	b.header(TypeUndefined, key)
+	return b
+}
+
+func (b *Builder) AppendObjectId(key string, id ObjectId) *Builder {
+	if len(id) != 12 {
+		b.setErr(&LengthError{Pos{Key: key}, len(id)})
+	}
+	b.header(TypeObjectId, key)
+	b.buf = append(b.buf, id...)
+	return b
+}
+
+func (b *Builder) AppendBool(key string, v bool) *Builder {
+	b.header(TypeBoolean, key)
+	if v {
+		b.buf = append(b.buf, 1)
+	} else {
+		b.buf = append(b.buf, 0)
+	}
+	return b
+}
+
+// AppendTime appends t as UTC datetime with millisecond precision.
+func (b *Builder) AppendTime(key string, t time.Time) *Builder {
+	return b.AppendDatetime(key, t.Unix()*1e3+int64(t.Nanosecond()/1e6))
+}
+
+// AppendDatetime appends a UTC datetime given in milliseconds since epoch.
+func (b *Builder) AppendDatetime(key string, ms int64) *Builder {
+	b.header(TypeDatetime, key)
+	b.buf = appendInt64(b.buf, ms)
+	return b
+}
+
+func (b *Builder) AppendNull(key string) *Builder {
+	b.header(TypeNull, key)
+	return b
+}
+
+func (b *Builder) AppendRegex(key, pattern, options string) *Builder {
+	if strings.IndexByte(pattern, 0x00) >= 0 || strings.IndexByte(options, 0x00) >= 0 {
+		b.setErr(ErrBuilderRegex)
+	}
+	b.header(TypeRegex, key)
+	b.buf = appendCString(appendCString(b.buf, pattern), options)
+	return b
+}
+
+func (b *Builder) AppendDBPointer(key, namespace string, id ObjectId) *Builder {
+	if len(id) != 12 {
+		b.setErr(&LengthError{Pos{Key: key}, len(id)})
+	}
+	b.header(TypeDBPointer, key)
+	b.buf = append(appendStringValue(b.buf, namespace), id...)
+	return b
+}
+
+func (b *Builder) AppendJSCode(key, code string) *Builder {
+	b.header(TypeJSCode, key)
+	b.buf = appendStringValue(b.buf, code)
+	return b
+}
+
+func (b *Builder) AppendSymbol(key, symbol string) *Builder {
+	b.header(TypeSymbol, key)
+	b.buf = appendStringValue(b.buf, symbol)
+	return b
+}
+
+func (b *Builder) AppendJSCodeWithScope(key, code string, scope BSON) *Builder {
+	b.header(TypeJSCodeScope, key)
+	var start int
+	b.buf, start = startDocument(b.buf)
+	b.buf = append(appendStringValue(b.buf, code), scope...)
+	b.buf = setLength(b.buf, start)
+	return b
+}
+
+func (b *Builder) AppendInt32(key string, i int32) *Builder {
+	b.header(TypeInt32, key)
+	b.buf = appendInt32(b.buf, i)
+	return b
+}
+
+func (b *Builder) AppendTimestamp(key string, ts MongoTimestamp) *Builder {
+	b.header(TypeTimestamp, key)
+	b.buf = appendInt64(b.buf, int64(ts))
+	return b
+}
+
+func (b *Builder) AppendInt64(key string, i int64) *Builder {
+	b.header(TypeInt64, key)
+	b.buf = appendInt64(b.buf, i)
+	return b
+}
+
+func (b *Builder) AppendDecimal128(key string, d Decimal128) *Builder {
+	b.header(TypeDecimal128, key)
+	b.buf = d.AppendBytes(b.buf)
+	return b
+}
+
+func (b *Builder) AppendMinKey(key string) *Builder {
+	b.header(TypeMinKey, key)
+	return b
+}
+
+func (b *Builder) AppendMaxKey(key string) *Builder {
+	b.header(TypeMaxKey, key)
+	return b
+}
+
+// AppendValue appends a value read from another document as is.
+func (b *Builder) AppendValue(key string, v Value) *Builder {
+	if v.IsEmpty() {
+		b.setErr(&InvalidTypeError{Pos{Key: key}, v.valueType})
+		return b
+	}
+	b.header(v.valueType, key)
+	b.buf = append(b.buf, v.valueData...)
+	return b
+}
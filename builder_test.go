@@ -0,0 +1,93 @@
+package bsonex
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	gbson "github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuilder(t *testing.T) {
+	oid := ObjectIdHex("5f1d2c3b4a5968778695a4b3")
+	tm := time.Date(2020, 1, 2, 3, 4, 5, 6e6, time.UTC)
+	want, err := Marshal(gbson.D{
+		{Name: "s", Value: "str"},
+		{Name: "i", Value: int32(1)},
+		{Name: "l", Value: int64(2)},
+		{Name: "f", Value: 1.5},
+		{Name: "b", Value: true},
+		{Name: "n", Value: nil},
+		{Name: "id", Value: oid},
+		{Name: "t", Value: tm},
+		{Name: "bin", Value: gbson.Binary{Kind: 0x80, Data: []byte("xy")}},
+		{Name: "re", Value: RegEx{Pattern: "a+", Options: "i"}},
+		{Name: "doc", Value: gbson.D{{Name: "x", Value: int32(1)}, {Name: "arr", Value: []interface{}{"a", int32(2)}}}},
+		{Name: "js", Value: JavaScript{Code: "f()", Scope: gbson.D{{Name: "y", Value: int32(3)}}}},
+		{Name: "ts", Value: MongoTimestamp(7)},
+		{Name: "min", Value: MinKey},
+	})
+	assert.NoError(t, err)
+
+	scope, err := NewBuilder().AppendInt32("y", 3).Build()
+	assert.NoError(t, err)
+	b := NewBuilder()
+	b.AppendString("s", "str").
+		AppendInt32("i", 1).
+		AppendInt64("l", 2).
+		AppendDouble("f", 1.5).
+		AppendBool("b", true).
+		AppendNull("n").
+		AppendObjectId("id", oid).
+		AppendTime("t", tm).
+		AppendBinary("bin", 0x80, []byte("xy")).
+		AppendRegex("re", "a+", "i").
+		StartDocument("doc").
+		AppendInt32("x", 1).
+		StartArray("arr").AppendString("", "a").AppendInt32("", 2).EndArray().
+		EndDocument().
+		AppendJSCodeWithScope("js", "f()", scope).
+		AppendTimestamp("ts", 7).
+		AppendMinKey("min")
+	got, err := b.Build()
+	assert.NoError(t, err)
+	assert.Equal(t, BSON(want), got)
+
+	// copy values from another document, got is only valid until b.Reset
+	b2 := NewBuilder()
+	it := got.Elements()
+	for it.Next() {
+		b2.AppendValue(string(it.Key()), it.Value())
+	}
+	copied, err := b2.Build()
+	assert.NoError(t, err)
+	assert.Equal(t, BSON(want), copied)
+
+	b.Reset()
+	_, err = b.StartArray("a").EndDocument().Build()
+	assert.Equal(t, ErrBuilderUnbalanced, err)
+	b.Reset()
+	_, err = b.StartArray("a").Build()
+	assert.Equal(t, ErrBuilderUnbalanced, err)
+	b.Reset()
+	_, err = b.AppendInt32("a\x00", 1).Build()
+	assert.Equal(t, ErrBuilderKey, err)
+	for _, re := range [][2]string{{"a\x00", ""}, {"a", "i\x00"}} {
+		b.Reset()
+		_, err = b.AppendRegex("r", re[0], re[1]).Build()
+		assert.Equal(t, ErrBuilderRegex, err)
+	}
+	for _, id := range []ObjectId{"short", ObjectId(strings.Repeat("x", 13))} {
+		b.Reset()
+		_, err = b.AppendDBPointer("p", "db.c", id).Build()
+		assert.Equal(t, &LengthError{Pos{Key: "p"}, len(id)}, err)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		b.Reset()
+		b.AppendString("s", "str").StartArray("a").AppendInt64("", 1).EndArray()
+		_, _ = b.Build()
+	})
+	assert.Equal(t, 0.0, allocs)
+}
@@ -0,0 +1,319 @@
+package bsonex
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+)
+
+// canonicalType returns the rank of t in the MongoDB sort order. Values of
+// different rank never compare equal, numbers share one rank and so do
+// strings and symbols.
+func canonicalType(t ValueType) int {
+	switch t {
+	case TypeMinKey:
+		return 1
+	case TypeNull, TypeUndefined:
+		return 2
+	case TypeDouble, TypeInt32, TypeInt64, TypeDecimal128:
+		return 3
+	case TypeString, TypeSymbol:
+		return 4
+	case TypeDocument:
+		return 5
+	case TypeArray:
+		return 6
+	case TypeBinary:
+		return 7
+	case TypeObjectId:
+		return 8
+	case TypeBoolean:
+		return 9
+	case TypeDatetime:
+		return 10
+	case TypeTimestamp:
+		return 11
+	case TypeRegex:
+		return 12
+	case TypeDBPointer:
+		return 13
+	case TypeJSCode:
+		return 14
+	case TypeJSCodeScope:
+		return 15
+	case TypeMaxKey:
+		return 16
+	}
+	return 0
+}
+
+// compareValues compares a and b in MongoDB order. Values are first ordered
+// by canonicalType, then by content. Malformed values compare by their raw
+// bytes.
+func compareValues(a, b Value) int {
+	ca, cb := canonicalType(a.valueType), canonicalType(b.valueType)
+	if ca != cb {
+		return compareInt(int64(ca), int64(cb))
+	}
+	switch a.valueType {
+	case TypeMinKey, TypeMaxKey, TypeNull, TypeUndefined:
+		return 0
+	case TypeDouble, TypeInt32, TypeInt64, TypeDecimal128:
+		return compareNumbers(a, b)
+	case TypeString, TypeSymbol, TypeJSCode:
+		return bytes.Compare(stringData(a), stringData(b))
+	case TypeDocument, TypeArray:
+		return compareDocuments(a.valueData, b.valueData)
+	case TypeBinary:
+		x, errA := a.BinaryErr()
+		y, errB := b.BinaryErr()
+		if errA != nil || errB != nil {
+			break
+		}
+		if len(x.Data) != len(y.Data) {
+			return compareInt(int64(len(x.Data)), int64(len(y.Data)))
+		}
+		if x.Kind != y.Kind {
+			return compareInt(int64(x.Kind), int64(y.Kind))
+		}
+		return bytes.Compare(x.Data, y.Data)
+	case TypeBoolean, TypeObjectId:
+	case TypeDatetime:
+		x, errA := a.Int64Err()
+		y, errB := b.Int64Err()
+		if errA != nil || errB != nil {
+			break
+		}
+		return compareInt(x, y)
+	case TypeTimestamp:
+		x, errA := a.Uint64Err()
+		y, errB := b.Uint64Err()
+		if errA != nil || errB != nil {
+			break
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	}
+	return bytes.Compare(a.valueData, b.valueData)
+}
+
+// compareDocuments compares two documents or arrays element by element, by
+// value type rank, key and value.
+func compareDocuments(a, b BSON) int {
+	ia, ib := a.Elements(), b.Elements()
+	for {
+		na, nb := ia.Next(), ib.Next()
+		switch {
+		case !na && !nb:
+			return 0
+		case !na:
+			return -1
+		case !nb:
+			return 1
+		}
+		if ca, cb := canonicalType(ia.val.valueType), canonicalType(ib.val.valueType); ca != cb {
+			return compareInt(int64(ca), int64(cb))
+		}
+		if c := bytes.Compare(ia.key, ib.key); c != 0 {
+			return c
+		}
+		if c := compareValues(ia.val, ib.val); c != 0 {
+			return c
+		}
+	}
+}
+
+// compareNumbers compares numeric values. Integers, doubles and decimals are
+// compared exactly with each other, except doubles with decimals which are
+// compared as float64. NaN sorts before every other number.
+func compareNumbers(a, b Value) int {
+	if isInteger(a.valueType) && isInteger(b.valueType) {
+		x, _ := numberInt64(a)
+		y, _ := numberInt64(b)
+		return compareInt(x, y)
+	}
+	if a.valueType == TypeDouble && isInteger(b.valueType) {
+		x, _ := numberFloat64(a)
+		y, _ := numberInt64(b)
+		return compareFloatInt(x, y)
+	}
+	if isInteger(a.valueType) && b.valueType == TypeDouble {
+		x, _ := numberInt64(a)
+		y, _ := numberFloat64(b)
+		return -compareFloatInt(y, x)
+	}
+	if a.valueType != TypeDouble && b.valueType != TypeDouble {
+		if c, ok := compareExact(a, b); ok {
+			return c
+		}
+	}
+	x, _ := numberFloat64(a)
+	y, _ := numberFloat64(b)
+	switch {
+	case math.IsNaN(x) && math.IsNaN(y):
+		return 0
+	case math.IsNaN(x):
+		return -1
+	case math.IsNaN(y):
+		return 1
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// compareExact compares integers and decimals as coefficient * 10^exponent
+// without rounding. Infinities and NaN are ranked around the finite numbers.
+func compareExact(a, b Value) (int, bool) {
+	ca, ea, ra, okA := numberParts(a)
+	cb, eb, rb, okB := numberParts(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	if ra != 0 || rb != 0 {
+		return compareInt(int64(ra), int64(rb)), true
+	}
+	if sa, sb := ca.Sign(), cb.Sign(); sa != sb || sa == 0 {
+		return compareInt(int64(sa), int64(sb)), true
+	}
+	// bring both to the smaller exponent, the coefficients stay exact
+	if ea > eb {
+		ca = new(big.Int).Mul(ca, pow10(ea-eb))
+	} else if eb > ea {
+		cb = new(big.Int).Mul(cb, pow10(eb-ea))
+	}
+	return ca.Cmp(cb), true
+}
+
+// numberParts returns an integer or decimal v as coefficient * 10^exponent.
+// rank is -2 for NaN, -1 and 1 for the infinities and 0 for finite numbers.
+func numberParts(v Value) (coefficient *big.Int, exponent, rank int, ok bool) {
+	if isInteger(v.valueType) {
+		i, ok := numberInt64(v)
+		return big.NewInt(i), 0, 0, ok
+	}
+	d, err := v.Decimal128Err()
+	if err != nil {
+		return nil, 0, 0, false
+	}
+	switch {
+	case d.IsNaN():
+		return nil, 0, -2, true
+	case d.IsInf() && d.IsNegative():
+		return nil, 0, -1, true
+	case d.IsInf():
+		return nil, 0, 1, true
+	}
+	coefficient, exponent, err = d.BigInt()
+	return coefficient, exponent, 0, err == nil
+}
+
+// compareFloatInt compares f and i without rounding i to a float64.
+func compareFloatInt(f float64, i int64) int {
+	switch {
+	case math.IsNaN(f), f < math.MinInt64:
+		return -1
+	case f >= math.MaxInt64:
+		// float64(math.MaxInt64) is 2^63, above every int64
+		return 1
+	}
+	// f is in the int64 range, so its integer part converts exactly
+	t := math.Trunc(f)
+	if c := compareInt(int64(t), i); c != 0 {
+		return c
+	}
+	switch {
+	case f > t:
+		return 1
+	case f < t:
+		return -1
+	}
+	return 0
+}
+
+func compareInt(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func isInteger(t ValueType) bool {
+	return t == TypeInt32 || t == TypeInt64
+}
+
+func isNumber(t ValueType) bool {
+	return canonicalType(t) == 3
+}
+
+// numberInt64 returns v as int64, truncating doubles and decimals.
+func numberInt64(v Value) (int64, bool) {
+	switch v.valueType {
+	case TypeInt32:
+		i, err := v.Int32Err()
+		return int64(i), err == nil
+	case TypeInt64:
+		i, err := v.Int64Err()
+		return i, err == nil
+	}
+	f, ok := numberFloat64(v)
+	if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// numberFloat64 returns v as float64, which may round large integers and
+// decimals.
+func numberFloat64(v Value) (float64, bool) {
+	switch v.valueType {
+	case TypeDouble:
+		f, err := v.Float64Err()
+		return f, err == nil
+	case TypeInt32:
+		i, err := v.Int32Err()
+		return float64(i), err == nil
+	case TypeInt64:
+		i, err := v.Int64Err()
+		return float64(i), err == nil
+	case TypeDecimal128:
+		d, err := v.Decimal128Err()
+		if err != nil {
+			return 0, false
+		}
+		switch {
+		case d.IsNaN():
+			return math.NaN(), true
+		case d.IsInf() && d.IsNegative():
+			return math.Inf(-1), true
+		case d.IsInf():
+			return math.Inf(1), true
+		}
+		bf, err := d.BigFloat()
+		if err != nil {
+			return 0, false
+		}
+		f, _ := bf.Float64()
+		return f, true
+	}
+	return 0, false
+}
+
+// stringData returns the bytes of a string, symbol or code value without the
+// length prefix and terminator.
+func stringData(v Value) []byte {
+	if validateString(v.valueData) != nil {
+		return v.valueData
+	}
+	return v.valueData[4 : len(v.valueData)-1]
+}
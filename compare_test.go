@@ -0,0 +1,60 @@
+package bsonex
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareNumbers(t *testing.T) {
+	dec := func(s string) Value {
+		d, err := ParseDecimal128(s)
+		assert.NoError(t, err, s)
+		return Value{TypeDecimal128, d.AppendBytes(nil)}
+	}
+	i64 := func(i int64) Value { return Value{TypeInt64, appendInt64(nil, i)} }
+	f64 := func(f float64) Value { return Value{TypeDouble, appendDouble(nil, f)} }
+
+	for _, c := range []struct {
+		a, b Value
+		want int
+	}{
+		// equal as float64, different as decimals
+		{dec("19.990000000000000001"), dec("19.99"), 1},
+		{dec("19.99"), dec("19.990000000000000001"), -1},
+		{dec("1.0"), dec("1.00"), 0},
+		{dec("-0"), dec("0E+10"), 0},
+		{dec("-1E-6176"), dec("0"), -1},
+		{dec("9.999999999999999999999999999999999E+6144"), dec("1E+6144"), 1},
+		{dec("1E-6176"), dec("1E+6144"), -1},
+		{dec("-5"), dec("-4.99"), -1},
+		// decimals against integers, beyond float64 precision
+		{dec("9007199254740993"), i64(9007199254740992), 1},
+		{i64(math.MaxInt64), dec("9223372036854775807"), 0},
+		{i64(math.MaxInt64), dec("9223372036854775806.5"), 1},
+		{dec("-9223372036854775808.1"), i64(math.MinInt64), -1},
+		{dec("NaN"), dec("-Infinity"), -1},
+		{dec("NaN"), dec("NaN"), 0},
+		{dec("Infinity"), dec("9.999999999999999999999999999999999E+6144"), 1},
+		{i64(0), dec("-Infinity"), 1},
+		// doubles against integers, beyond float64 precision
+		{f64(1 << 53), i64(1<<53 + 1), -1},
+		{i64(1<<53 + 1), f64(1 << 53), 1},
+		{f64(1 << 53), i64(1 << 53), 0},
+		{f64(1 << 53), i64(1<<53 - 1), 1},
+		{f64(-(1 << 53)), i64(-(1 << 53) - 1), 1},
+		{i64(math.MaxInt64), f64(math.MaxInt64), -1},
+		{i64(math.MinInt64), f64(math.MinInt64), 0},
+		{f64(2.5), i64(2), 1},
+		{f64(-2.5), i64(-2), -1},
+		{f64(math.Inf(-1)), i64(math.MinInt64), -1},
+		{i64(0), f64(math.NaN()), 1},
+		// doubles against decimals are compared as float64
+		{dec("2.5"), f64(2.5), 0},
+		{f64(2.4), dec("2.5"), -1},
+		{f64(math.NaN()), dec("1"), -1},
+	} {
+		assert.Equal(t, c.want, compareValues(c.a, c.b), "%v %v", c.a, c.b)
+	}
+}
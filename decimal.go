@@ -0,0 +1,264 @@
+package bsonex
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Decimal128 is a 128-bit IEEE 754-2008 decimal floating point number as
+// stored by BSON, kept in its binary integer decimal (BID) encoding.
+type Decimal128 struct {
+	h, l uint64
+}
+
+const (
+	decimalExpBias = 6176
+	decimalExpMin  = -6176
+	decimalExpMax  = 6111
+	decimalDigits  = 34
+)
+
+var (
+	decimalMaxCoefficient = new(big.Int).Sub(new(big.Int).Exp(big.NewInt(10), big.NewInt(decimalDigits), nil), big.NewInt(1))
+	bigTen                = big.NewInt(10)
+
+	ErrDecimalNaN   = errors.New("bsonex: decimal128 is NaN")
+	ErrDecimalInf   = errors.New("bsonex: decimal128 is infinite")
+	ErrDecimalRange = errors.New("bsonex: decimal128 out of range")
+)
+
+// NewDecimal128 returns the Decimal128 with the given high and low 64 bits.
+func NewDecimal128(h, l uint64) Decimal128 {
+	return Decimal128{h, l}
+}
+
+func decimal128FromBytes(b []byte) Decimal128 {
+	return Decimal128{
+		l: binary.LittleEndian.Uint64(b[:8]),
+		h: binary.LittleEndian.Uint64(b[8:16]),
+	}
+}
+
+// GetBytes returns the high and low 64 bits of d.
+func (d Decimal128) GetBytes() (h, l uint64) {
+	return d.h, d.l
+}
+
+// AppendBytes appends the 16 byte BSON encoding of d to b.
+func (d Decimal128) AppendBytes(b []byte) []byte {
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:8], d.l)
+	binary.LittleEndian.PutUint64(buf[8:], d.h)
+	return append(b, buf[:]...)
+}
+
+func (d Decimal128) IsNaN() bool {
+	return d.h>>58&0x1f == 0x1f
+}
+
+func (d Decimal128) IsInf() bool {
+	return d.h>>58&0x1f == 0x1e
+}
+
+func (d Decimal128) IsNegative() bool {
+	return d.h>>63 == 1
+}
+
+// BigInt returns d as coefficient * 10^exponent. It fails for NaN and
+// infinity.
+func (d Decimal128) BigInt() (coefficient *big.Int, exponent int, err error) {
+	if d.IsNaN() {
+		return nil, 0, ErrDecimalNaN
+	}
+	if d.IsInf() {
+		return nil, 0, ErrDecimalInf
+	}
+	var high uint64
+	if d.h>>61&3 == 3 {
+		// the coefficient is larger than the maximum, which is treated as 0
+		exponent = int(d.h>>47&0x3fff) - decimalExpBias
+	} else {
+		exponent = int(d.h>>49&0x3fff) - decimalExpBias
+		high = d.h & (1<<49 - 1)
+	}
+	coefficient = new(big.Int).SetUint64(high)
+	coefficient.Lsh(coefficient, 64).Or(coefficient, new(big.Int).SetUint64(d.l))
+	if coefficient.Cmp(decimalMaxCoefficient) > 0 {
+		coefficient.SetInt64(0)
+	}
+	if d.IsNegative() {
+		coefficient.Neg(coefficient)
+	}
+	return
+}
+
+// BigFloat returns d as a big.Float with 113 bits of precision, rounding to
+// nearest even if d can not be represented exactly. It fails for NaN.
+func (d Decimal128) BigFloat() (*big.Float, error) {
+	if d.IsNaN() {
+		return nil, ErrDecimalNaN
+	}
+	if d.IsInf() {
+		return new(big.Float).SetInf(d.IsNegative()), nil
+	}
+	coefficient, exponent, _ := d.BigInt()
+	f := new(big.Float).SetPrec(113).SetMode(big.ToNearestEven)
+	if exponent >= 0 {
+		return f.SetInt(coefficient.Mul(coefficient, pow10(exponent))), nil
+	}
+	// both operands are exact, so the quotient is rounded only once
+	return f.Quo(new(big.Float).SetInt(coefficient), new(big.Float).SetInt(pow10(-exponent))), nil
+}
+
+// pow10 returns 10^n for n >= 0.
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(bigTen, big.NewInt(int64(n)), nil)
+}
+
+// String formats d exactly, following the BSON Decimal128 specification.
+func (d Decimal128) String() string {
+	if d.IsNaN() {
+		return "NaN"
+	}
+	sign := ""
+	if d.IsNegative() {
+		sign = "-"
+	}
+	if d.IsInf() {
+		return sign + "Infinity"
+	}
+	coefficient, exponent, _ := d.BigInt()
+	digits := coefficient.Abs(coefficient).String()
+	adjusted := exponent + len(digits) - 1
+	if exponent > 0 || adjusted < -6 {
+		s := digits[:1]
+		if len(digits) > 1 {
+			s += "." + digits[1:]
+		}
+		return fmt.Sprintf("%s%sE%+d", sign, s, adjusted)
+	}
+	if exponent == 0 {
+		return sign + digits
+	}
+	if point := len(digits) + exponent; point > 0 {
+		return sign + digits[:point] + "." + digits[point:]
+	}
+	return sign + "0." + strings.Repeat("0", -exponent-len(digits)) + digits
+}
+
+// ParseDecimal128 parses a decimal string such as "1.23", "-4E+10", "NaN" or
+// "Infinity". It fails if the value can not be represented exactly.
+func ParseDecimal128(s string) (d Decimal128, err error) {
+	orig := s
+	var neg bool
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		neg = s[0] == '-'
+		s = s[1:]
+	}
+	switch strings.ToLower(s) {
+	case "nan":
+		return Decimal128{h: 0x1f << 58}, nil
+	case "inf", "infinity":
+		d = Decimal128{h: 0x1e << 58}
+		if neg {
+			d.h |= 1 << 63
+		}
+		return d, nil
+	}
+	// the exponent saturates on overflow, which is out of range either way
+	exponent := 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		exponent, err = strconv.Atoi(s[i+1:])
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return d, fmt.Errorf("bsonex: invalid decimal128 %q", orig)
+		}
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		exponent = addExponent(exponent, -(len(s) - i - 1))
+		s = s[:i] + s[i+1:]
+	}
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return d, fmt.Errorf("bsonex: invalid decimal128 %q", orig)
+	}
+	// trailing zeros past the digits that fit are exact, move them to the
+	// exponent before building a huge coefficient
+	digits := strings.TrimLeft(s, "0")
+	for len(digits) > decimalDigits && digits[len(digits)-1] == '0' {
+		digits = digits[:len(digits)-1]
+		exponent = addExponent(exponent, 1)
+	}
+	if len(digits) > decimalDigits {
+		return d, ErrDecimalRange
+	}
+	coefficient := new(big.Int)
+	if digits != "" {
+		coefficient.SetString(digits, 10)
+	}
+	return newDecimal128(neg, coefficient, exponent)
+}
+
+// addExponent returns e+n, saturated to the int range.
+func addExponent(e, n int) int {
+	if n > 0 && e > math.MaxInt-n {
+		return math.MaxInt
+	}
+	if n < 0 && e < math.MinInt-n {
+		return math.MinInt
+	}
+	return e + n
+}
+
+func newDecimal128(neg bool, coefficient *big.Int, exponent int) (d Decimal128, err error) {
+	if coefficient.Sign() == 0 {
+		// zero is exact at any exponent
+		if exponent < decimalExpMin {
+			exponent = decimalExpMin
+		} else if exponent > decimalExpMax {
+			exponent = decimalExpMax
+		}
+	} else if exponent < decimalExpMin-decimalDigits || exponent > decimalExpMax+decimalDigits {
+		// more than 34 zeros would have to be added or dropped
+		return d, ErrDecimalRange
+	}
+	var r big.Int
+	// drop trailing zeros that do not fit, they are exact
+	for coefficient.Cmp(decimalMaxCoefficient) > 0 || exponent < decimalExpMin {
+		q, _ := new(big.Int).QuoRem(coefficient, bigTen, &r)
+		if r.Sign() != 0 {
+			return d, ErrDecimalRange
+		}
+		coefficient, exponent = q, exponent+1
+	}
+	// clamp large exponents by adding zeros to the coefficient
+	for exponent > decimalExpMax {
+		coefficient = new(big.Int).Mul(coefficient, bigTen)
+		if coefficient.Cmp(decimalMaxCoefficient) > 0 {
+			return d, ErrDecimalRange
+		}
+		exponent--
+	}
+	var lo, hi big.Int
+	lo.And(coefficient, new(big.Int).SetUint64(^uint64(0)))
+	hi.Rsh(coefficient, 64)
+	d.l = lo.Uint64()
+	d.h = uint64(exponent+decimalExpBias)<<49 | hi.Uint64()
+	if neg {
+		d.h |= 1 << 63
+	}
+	return
+}
+
+func (d Decimal128) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d Decimal128) GetBSON() (interface{}, error) {
+	return d.ToMgo(), nil
+}
@@ -0,0 +1,104 @@
+package bsonex
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	gbson "github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecimal128String(t *testing.T) {
+	cases := []struct {
+		h, l uint64
+		s    string
+	}{
+		{0x3040000000000000, 0, "0"},
+		{0xb040000000000000, 0, "-0"},
+		{0x3040000000000000, 1, "1"},
+		{0x303e000000000000, 1, "0.1"},
+		{0x303e000000000000, 10, "1.0"},
+		{0x3034000000000000, 1234, "0.001234"},
+		{0x302c000000000000, 1234, "1.234E-7"},
+		{0x3046000000000000, 1, "1E+3"},
+		{0x3040000000000000, 12345, "12345"},
+		{0xb03e000000000000, 12345, "-1234.5"},
+		{0x5fffed09bead87c0, 0x378d8e63ffffffff, "9.999999999999999999999999999999999E+6144"},
+		{0x0000000000000000, 1, "1E-6176"},
+		{0x7c00000000000000, 0, "NaN"},
+		{0x7800000000000000, 0, "Infinity"},
+		{0xf800000000000000, 0, "-Infinity"},
+	}
+	for _, c := range cases {
+		d := NewDecimal128(c.h, c.l)
+		assert.Equal(t, c.s, d.String())
+		p, err := ParseDecimal128(c.s)
+		assert.NoError(t, err, c.s)
+		assert.Equal(t, d, p, c.s)
+	}
+	for _, s := range []string{"", ".", "1e", "abc", "1.2.3", "1e1x", "1 "} {
+		_, err := ParseDecimal128(s)
+		assert.Error(t, err, s)
+	}
+
+	// huge and overflowing exponents return at once: zero is clamped, other
+	// values are out of range
+	for s, want := range map[string]string{
+		"0E-10000000":               "0E-6176",
+		"-0E-9000000000000000000":   "-0E-6176",
+		"0E+99999999999999999999":   "0E+6111",
+		"0.00E-9223372036854775808": "0E-6176",
+	} {
+		d, err := ParseDecimal128(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, want, d.String(), s)
+	}
+	for _, s := range []string{
+		"1E-10000000", "1E-9000000000000000000", "1E+9223372036854775807",
+		"1.5E-9223372036854775808", "1E99999999999999999999", "1E-6211", "1E+6145",
+	} {
+		_, err := ParseDecimal128(s)
+		assert.Equal(t, ErrDecimalRange, err, s)
+	}
+	// exact values at the edges still fit
+	for s, want := range map[string]string{
+		"1E+6144":  "1.000000000000000000000000000000000E+6144",
+		"10E-6177": "1E-6176",
+		"1" + strings.Repeat("0", 100000) + "E-100000": "1.000000000000000000000000000000000",
+	} {
+		d, err := ParseDecimal128(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, want, d.String(), s)
+	}
+	_, err := ParseDecimal128("1234567890123456789012345678901234567")
+	assert.Equal(t, ErrDecimalRange, err)
+	d, err := ParseDecimal128("12345678901234567890123456789012340000")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.234567890123456789012345678901234E+37", d.String())
+}
+
+func TestDecimal128Value(t *testing.T) {
+	gd, err := gbson.ParseDecimal128("-12345.6789")
+	assert.NoError(t, err)
+	b, err := Marshal(M{"d": gd})
+	assert.NoError(t, err)
+	v := BSON(b).Lookup("d")
+	d := v.Decimal128()
+	assert.Equal(t, "-12345.6789", d.String())
+	assert.Equal(t, d, v.Value())
+	assert.Equal(t, `{"d":"-12345.6789"}`, BSON(b).String())
+
+	c, exp, err := d.BigInt()
+	assert.NoError(t, err)
+	assert.Equal(t, big.NewInt(-123456789), c)
+	assert.Equal(t, -4, exp)
+	f, err := d.BigFloat()
+	assert.NoError(t, err)
+	f64, _ := f.Float64()
+	assert.Equal(t, -12345.6789, f64)
+
+	b2, err := Marshal(BSON(b).ToValueMap())
+	assert.NoError(t, err)
+	assert.Equal(t, b, b2)
+}
@@ -0,0 +1,659 @@
+package bsonex
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Unmarshaler is implemented by types that decode themselves from a raw
+// value. v points into the decoded document, so it must be copied to be kept.
+type Unmarshaler interface {
+	UnmarshalBSONValue(v Value) error
+}
+
+// UnmarshalTypeError reports a value that can not be decoded into a Go type.
+type UnmarshalTypeError struct {
+	Type   ValueType
+	GoType reflect.Type
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bsonex: cannot unmarshal BSON type 0x%02x into Go value of type %s", e.Type, e.GoType)
+}
+
+// Unmarshal decodes the document in data into out, which must be a non-nil
+// pointer or map. It is a drop-in replacement for mgo's bson.Unmarshal and
+// honors the same `bson:"name,omitempty,inline"` struct tags, the gbson.Setter
+// interface and Unmarshaler.
+//
+// Fields with a type that can not hold the value are left zero, like mgo
+// does. Value and BSON fields get sub-slices of data without copying, so they
+// are only valid as long as data is.
+func Unmarshal(data []byte, out interface{}) error {
+	rv := reflect.ValueOf(out)
+	switch {
+	case rv.Kind() == reflect.Map && !rv.IsNil():
+	case rv.Kind() == reflect.Ptr && !rv.IsNil():
+		rv = rv.Elem()
+	default:
+		return errors.New("bsonex: Unmarshal needs a non-nil pointer or map")
+	}
+	if _, err := BSON(data).elements(); err != nil {
+		return err
+	}
+	return decodeInto(Value{TypeDocument, data}, rv)
+}
+
+// Unmarshal decodes v into out, which must be a non-nil pointer, see the
+// package level Unmarshal.
+func (v Value) Unmarshal(out interface{}) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("bsonex: Unmarshal needs a non-nil pointer")
+	}
+	return decodeInto(v, rv.Elem())
+}
+
+func decodeInto(v Value, out reflect.Value) error {
+	ok, err := decoderFor(out.Type())(v, out)
+	if err == nil && !ok {
+		err = &UnmarshalTypeError{v.valueType, out.Type()}
+	}
+	return err
+}
+
+// decodeFunc decodes v into out. It returns false if the Go type can not
+// hold the value and an error if v is malformed.
+type decodeFunc func(v Value, out reflect.Value) (bool, error)
+
+var decoders sync.Map // map[reflect.Type]decodeFunc
+
+// decoderFor returns the cached decoder of t, building it on first use.
+// Recursive types get a placeholder that waits for the real decoder, like
+// encoding/json does.
+func decoderFor(t reflect.Type) decodeFunc {
+	if f, ok := decoders.Load(t); ok {
+		return f.(decodeFunc)
+	}
+	var (
+		wg sync.WaitGroup
+		f  decodeFunc
+	)
+	wg.Add(1)
+	fi, loaded := decoders.LoadOrStore(t, decodeFunc(func(v Value, out reflect.Value) (bool, error) {
+		wg.Wait()
+		return f(v, out)
+	}))
+	if loaded {
+		return fi.(decodeFunc)
+	}
+	f = newDecoder(t)
+	wg.Done()
+	decoders.Store(t, f)
+	return f
+}
+
+var (
+	typeOfValue       = reflect.TypeOf(Value{})
+	typeOfBSON        = reflect.TypeOf(BSON(nil))
+	typeOfTime        = reflect.TypeOf(time.Time{})
+	typeOfDuration    = reflect.TypeOf(time.Duration(0))
+	typeOfDecimal128  = reflect.TypeOf(Decimal128{})
+	typeOfBinary      = reflect.TypeOf(Binary{})
+	typeOfRegEx       = reflect.TypeOf(RegEx{})
+	typeOfDBPointer   = reflect.TypeOf(DBPointer{})
+	typeOfJavaScript  = reflect.TypeOf(JavaScript{})
+	typeOfObjectId    = reflect.TypeOf(ObjectId(""))
+	typeOfM           = reflect.TypeOf(M{})
+	typeOfD           = reflect.TypeOf(D{})
+	typeOfArray       = reflect.TypeOf([]interface{}{})
+	typeOfInterface   = reflect.TypeOf((*interface{})(nil)).Elem()
+	typeOfUnmarshaler = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+)
+
+func newDecoder(t reflect.Type) decodeFunc {
+	switch t {
+	case typeOfValue:
+		return func(v Value, out reflect.Value) (bool, error) {
+			out.Set(reflect.ValueOf(v))
+			return true, nil
+		}
+	}
+	// the bsonex types implement gbson.Setter for mgo, decode them directly
+	if dec := newTypeDecoder(t); dec != nil {
+		return zeroOnNull(dec)
+	}
+	if dec := newMgoDecoder(t); dec != nil {
+		return dec
+	}
+	if own, ok := primitiveTypes[t]; ok {
+		return zeroOnNull(newConvertDecoder(own, toPrimitiveValue))
+	}
+	if t.Kind() != reflect.Ptr && t.Kind() != reflect.Interface {
+		pt := reflect.PtrTo(t)
+		if pt.Implements(typeOfUnmarshaler) {
+			return decodeUnmarshaler
+		}
+		if pt.Implements(typeOfSetter) {
+			return decodeSetter
+		}
+	}
+	return zeroOnNull(newKindDecoder(t))
+}
+
+// newConvertDecoder decodes into the bsonex type own and sets the result of
+// conv, for the mgo and primitive types.
+func newConvertDecoder(own reflect.Type, conv func(interface{}) interface{}) decodeFunc {
+	dec := decoderFor(own)
+	return func(v Value, out reflect.Value) (bool, error) {
+		tmp := reflect.New(own).Elem()
+		if ok, err := dec(v, tmp); !ok || err != nil {
+			return ok, err
+		}
+		cv := reflect.ValueOf(conv(tmp.Interface()))
+		if !cv.IsValid() || cv.Type() != out.Type() {
+			return false, nil
+		}
+		out.Set(cv)
+		return true, nil
+	}
+}
+
+func zeroOnNull(dec decodeFunc) decodeFunc {
+	return func(v Value, out reflect.Value) (bool, error) {
+		if v.valueType == TypeNull {
+			out.Set(reflect.Zero(out.Type()))
+			return true, nil
+		}
+		return dec(v, out)
+	}
+}
+
+func decodeUnmarshaler(v Value, out reflect.Value) (bool, error) {
+	if !out.CanAddr() {
+		return false, nil
+	}
+	return true, out.Addr().Interface().(Unmarshaler).UnmarshalBSONValue(v)
+}
+
+// newTypeDecoder returns the decoder of the BSON specific types, or nil.
+func newTypeDecoder(t reflect.Type) decodeFunc {
+	switch t {
+	case typeOfBSON:
+		return func(v Value, out reflect.Value) (bool, error) {
+			if v.valueType != TypeDocument && v.valueType != TypeArray {
+				return false, nil
+			}
+			out.SetBytes(v.valueData)
+			return true, nil
+		}
+	case typeOfTime:
+		return func(v Value, out reflect.Value) (bool, error) {
+			if v.valueType != TypeDatetime {
+				return false, nil
+			}
+			ms, err := v.Int64Err()
+			if ms == -62135596800000 {
+				out.Set(reflect.ValueOf(time.Time{}))
+			} else {
+				out.Set(reflect.ValueOf(time.Unix(ms/1e3, ms%1e3*1e6).UTC()))
+			}
+			return true, err
+		}
+	case typeOfDuration:
+		return func(v Value, out reflect.Value) (bool, error) {
+			if v.valueType != TypeInt64 {
+				return decodeInt(v, out)
+			}
+			ms, err := v.Int64Err()
+			out.SetInt(ms * int64(time.Millisecond))
+			return true, err
+		}
+	case typeOfDecimal128:
+		return func(v Value, out reflect.Value) (bool, error) {
+			if v.valueType != TypeDecimal128 {
+				return false, nil
+			}
+			d, err := v.Decimal128Err()
+			out.Set(reflect.ValueOf(d))
+			return true, err
+		}
+	case typeOfBinary:
+		return func(v Value, out reflect.Value) (bool, error) {
+			if v.valueType != TypeBinary {
+				return false, nil
+			}
+			bin, err := binaryCopy(v)
+			if err != nil {
+				return false, err
+			}
+			out.Set(reflect.ValueOf(bin))
+			return true, nil
+		}
+	case typeOfRegEx:
+		return func(v Value, out reflect.Value) (bool, error) {
+			if v.valueType != TypeRegex {
+				return false, nil
+			}
+			r, err := v.RegexpErr()
+			out.Set(reflect.ValueOf(r))
+			return true, err
+		}
+	case typeOfDBPointer:
+		return func(v Value, out reflect.Value) (bool, error) {
+			if v.valueType != TypeDBPointer {
+				return false, nil
+			}
+			p, err := v.DBPointerErr()
+			out.Set(reflect.ValueOf(p))
+			return true, err
+		}
+	case typeOfJavaScript:
+		return func(v Value, out reflect.Value) (bool, error) {
+			if v.valueType != TypeJSCode && v.valueType != TypeJSCodeScope {
+				return false, nil
+			}
+			js, err := v.ValueErr()
+			if err == nil {
+				out.Set(reflect.ValueOf(js))
+			}
+			return true, err
+		}
+	case typeOfObjectId:
+		return func(v Value, out reflect.Value) (bool, error) {
+			if v.valueType != TypeObjectId {
+				return false, nil
+			}
+			id, err := v.ObjidErr()
+			out.SetString(string(id))
+			return true, err
+		}
+	case typeOfD:
+		return func(v Value, out reflect.Value) (bool, error) {
+			if v.valueType != TypeDocument {
+				return false, nil
+			}
+			d, err := v.DErr()
+			if err != nil {
+				return false, err
+			}
+			out.Set(reflect.ValueOf(d))
+			return true, nil
+		}
+	case typeOfTimestamp, typeOfSymbol:
+		return newKindDecoder(t)
+	case typeOfOrderKey:
+		return func(v Value, out reflect.Value) (bool, error) {
+			switch v.valueType {
+			case TypeMinKey:
+				out.Set(reflect.ValueOf(MinKey))
+			case TypeMaxKey:
+				out.Set(reflect.ValueOf(MaxKey))
+			default:
+				return false, nil
+			}
+			return true, nil
+		}
+	case typeOfUndefined:
+		return func(v Value, out reflect.Value) (bool, error) {
+			return v.valueType == TypeUndefined, nil
+		}
+	}
+	return nil
+}
+
+func newKindDecoder(t reflect.Type) decodeFunc {
+	switch t.Kind() {
+	case reflect.Interface:
+		if t.NumMethod() != 0 {
+			return func(Value, reflect.Value) (bool, error) { return false, nil }
+		}
+		return func(v Value, out reflect.Value) (bool, error) {
+			val, err := v.ValueErr()
+			if err != nil {
+				return false, err
+			}
+			if val == nil {
+				out.Set(reflect.Zero(out.Type()))
+			} else {
+				out.Set(reflect.ValueOf(val))
+			}
+			return true, nil
+		}
+	case reflect.Ptr:
+		return newPtrDecoder(t)
+	case reflect.Struct:
+		return newStructDecoder(t)
+	case reflect.Map:
+		return newMapDecoder(t)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return decodeBytes
+		}
+		return newSliceDecoder(t)
+	case reflect.Array:
+		return newArrayDecoder(t)
+	case reflect.String:
+		return decodeString
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return decodeInt
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return decodeUint
+	case reflect.Float32, reflect.Float64:
+		return decodeFloat
+	case reflect.Bool:
+		return decodeBool
+	}
+	return func(Value, reflect.Value) (bool, error) { return false, nil }
+}
+
+func newPtrDecoder(t reflect.Type) decodeFunc {
+	elemDec := decoderFor(t.Elem())
+	return func(v Value, out reflect.Value) (bool, error) {
+		if !out.IsNil() {
+			return elemDec(v, out.Elem())
+		}
+		e := reflect.New(t.Elem())
+		ok, err := elemDec(v, e.Elem())
+		if ok && err == nil {
+			out.Set(e)
+		}
+		return ok, err
+	}
+}
+
+func newStructDecoder(t reflect.Type) decodeFunc {
+	sf, err := cachedStructFields(t)
+	if err != nil {
+		return func(Value, reflect.Value) (bool, error) { return false, err }
+	}
+	decs := make([]decodeFunc, len(sf.list))
+	for i, f := range sf.list {
+		decs[i] = decoderFor(f.typ)
+	}
+	var inlineDec decodeFunc
+	if sf.inlineMap != nil {
+		inlineDec = decoderFor(t.FieldByIndex(sf.inlineMap).Type.Elem())
+	}
+	zero := reflect.Zero(t)
+	return func(v Value, out reflect.Value) (bool, error) {
+		if v.valueType != TypeDocument {
+			return false, nil
+		}
+		out.Set(zero)
+		var inline, inlineElem reflect.Value
+		next := 0
+		it := BSON(v.valueData).Elements()
+		for it.Next() {
+			// fields usually come in declaration order, try the next one
+			// before the map
+			i := -1
+			if next < len(sf.list) && string(it.key) == sf.list[next].name {
+				i = next
+			} else if j, ok := sf.byName[string(it.key)]; ok {
+				i = j
+			}
+			var err error
+			switch {
+			case i >= 0:
+				next = i + 1
+				_, err = decs[i](it.val, out.FieldByIndex(sf.list[i].index))
+			case inlineDec != nil:
+				if !inline.IsValid() {
+					inline = out.FieldByIndex(sf.inlineMap)
+					if inline.IsNil() {
+						inline.Set(reflect.MakeMap(inline.Type()))
+					}
+					inlineElem = reflect.New(inline.Type().Elem()).Elem()
+				}
+				var ok bool
+				inlineElem.Set(reflect.Zero(inlineElem.Type()))
+				if ok, err = inlineDec(it.val, inlineElem); ok && err == nil {
+					key := reflect.ValueOf(string(it.key)).Convert(inline.Type().Key())
+					inline.SetMapIndex(key, inlineElem)
+				}
+			}
+			if err != nil {
+				return false, withOffset(withKey(err, it.key), it.valueOffset())
+			}
+		}
+		return true, it.err
+	}
+}
+
+func newMapDecoder(t reflect.Type) decodeFunc {
+	var parseKey func(key string) (reflect.Value, bool)
+	switch t.Key().Kind() {
+	case reflect.String:
+		parseKey = func(key string) (reflect.Value, bool) {
+			return reflect.ValueOf(key).Convert(t.Key()), true
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parseKey = func(key string) (reflect.Value, bool) {
+			i, err := strconv.ParseInt(key, 10, t.Key().Bits())
+			return reflect.ValueOf(i).Convert(t.Key()), err == nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		parseKey = func(key string) (reflect.Value, bool) {
+			i, err := strconv.ParseUint(key, 10, t.Key().Bits())
+			return reflect.ValueOf(i).Convert(t.Key()), err == nil
+		}
+	default:
+		return func(Value, reflect.Value) (bool, error) { return false, nil }
+	}
+	elemDec := decoderFor(t.Elem())
+	return func(v Value, out reflect.Value) (bool, error) {
+		if v.valueType != TypeDocument {
+			return false, nil
+		}
+		if out.IsNil() {
+			out.Set(reflect.MakeMap(t))
+		} else {
+			for _, k := range out.MapKeys() {
+				out.SetMapIndex(k, reflect.Value{})
+			}
+		}
+		elem := reflect.New(t.Elem()).Elem()
+		zero := reflect.Zero(t.Elem())
+		it := BSON(v.valueData).Elements()
+		for it.Next() {
+			elem.Set(zero)
+			ok, err := elemDec(it.val, elem)
+			if err != nil {
+				return false, withOffset(withKey(err, it.key), it.valueOffset())
+			}
+			if !ok {
+				continue
+			}
+			if key, ok := parseKey(string(it.key)); ok {
+				out.SetMapIndex(key, elem)
+			}
+		}
+		return true, it.err
+	}
+}
+
+func newSliceDecoder(t reflect.Type) decodeFunc {
+	elemDec := decoderFor(t.Elem())
+	return func(v Value, out reflect.Value) (bool, error) {
+		if v.valueType != TypeArray {
+			return false, nil
+		}
+		n := 0
+		it := BSON(v.valueData).Elements()
+		for it.Next() {
+			n++
+		}
+		if it.err != nil {
+			return false, it.err
+		}
+		s := reflect.MakeSlice(t, n, n)
+		i := 0
+		it = BSON(v.valueData).Elements()
+		for it.Next() {
+			ok, err := elemDec(it.val, s.Index(i))
+			if err != nil {
+				return false, withOffset(withKey(err, it.key), it.valueOffset())
+			}
+			if ok {
+				i++
+			} else {
+				s.Index(i).Set(reflect.Zero(t.Elem()))
+			}
+		}
+		out.Set(s.Slice(0, i))
+		return true, nil
+	}
+}
+
+func newArrayDecoder(t reflect.Type) decodeFunc {
+	elemDec := decoderFor(t.Elem())
+	isBytes := t.Elem().Kind() == reflect.Uint8
+	return func(v Value, out reflect.Value) (bool, error) {
+		if isBytes && v.valueType == TypeBinary {
+			bin, err := binaryCopy(v)
+			if err != nil || len(bin.Data) != t.Len() {
+				return false, err
+			}
+			reflect.Copy(out, reflect.ValueOf(bin.Data))
+			return true, nil
+		}
+		if v.valueType != TypeArray {
+			return false, nil
+		}
+		out.Set(reflect.Zero(t))
+		i := 0
+		it := BSON(v.valueData).Elements()
+		for i < t.Len() && it.Next() {
+			if _, err := elemDec(it.val, out.Index(i)); err != nil {
+				return false, withOffset(withKey(err, it.key), it.valueOffset())
+			}
+			i++
+		}
+		return true, it.err
+	}
+}
+
+// binaryCopy returns a copy of the binary value v, with the redundant length
+// of the old binary subtype removed.
+func binaryCopy(v Value) (Binary, error) {
+	bin, err := v.BinaryErr()
+	if err != nil {
+		return Binary{}, err
+	}
+	data := bin.Data
+	if bin.Kind == 0x02 && len(data) >= 4 && getint(data) == len(data)-4 {
+		data = data[4:]
+	}
+	return Binary{Kind: bin.Kind, Data: append([]byte(nil), data...)}, nil
+}
+
+func decodeBytes(v Value, out reflect.Value) (bool, error) {
+	switch v.valueType {
+	case TypeBinary:
+		bin, err := binaryCopy(v)
+		if err != nil || (bin.Kind != 0x00 && bin.Kind != 0x02) {
+			return false, err
+		}
+		out.SetBytes(bin.Data)
+	case TypeString, TypeSymbol:
+		if err := validateString(v.valueData); err != nil {
+			return false, err
+		}
+		out.SetBytes(append([]byte(nil), stringData(v)...))
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+func decodeString(v Value, out reflect.Value) (bool, error) {
+	switch v.valueType {
+	case TypeString, TypeSymbol:
+		if err := validateString(v.valueData); err != nil {
+			return false, err
+		}
+		out.SetString(string(stringData(v)))
+	case TypeBinary:
+		bin, err := binaryCopy(v)
+		if err != nil || (bin.Kind != 0x00 && bin.Kind != 0x02) {
+			return false, err
+		}
+		out.SetString(string(bin.Data))
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// intValue converts numbers and booleans like mgo does, doubles are
+// truncated.
+func intValue(v Value) (i int64, ok bool, err error) {
+	switch v.valueType {
+	case TypeInt32, TypeInt64, TypeTimestamp:
+		i, err = v.Int64Err()
+	case TypeDouble:
+		var f float64
+		f, err = v.Float64Err()
+		i = int64(f)
+	case TypeBoolean:
+		var b bool
+		if b, err = v.BoolErr(); b {
+			i = 1
+		}
+	default:
+		return 0, false, nil
+	}
+	return i, true, err
+}
+
+func decodeInt(v Value, out reflect.Value) (bool, error) {
+	i, ok, err := intValue(v)
+	if ok {
+		out.SetInt(i)
+	}
+	return ok, err
+}
+
+func decodeUint(v Value, out reflect.Value) (bool, error) {
+	if v.valueType == TypeDouble {
+		f, err := v.Float64Err()
+		out.SetUint(uint64(f))
+		return true, err
+	}
+	i, ok, err := intValue(v)
+	if ok {
+		out.SetUint(uint64(i))
+	}
+	return ok, err
+}
+
+func decodeFloat(v Value, out reflect.Value) (bool, error) {
+	if v.valueType == TypeDouble {
+		f, err := v.Float64Err()
+		out.SetFloat(f)
+		return true, err
+	}
+	i, ok, err := intValue(v)
+	if ok {
+		out.SetFloat(float64(i))
+	}
+	return ok, err
+}
+
+func decodeBool(v Value, out reflect.Value) (bool, error) {
+	if v.valueType == TypeDouble {
+		f, err := v.Float64Err()
+		out.SetBool(f != 0)
+		return true, err
+	}
+	i, ok, err := intValue(v)
+	if ok {
+		out.SetBool(i != 0)
+	}
+	return ok, err
+}
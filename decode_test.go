@@ -0,0 +1,238 @@
+package bsonex
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	gbson "github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+type decodeInner struct {
+	X int `bson:"x"`
+}
+
+type decodeEmbedded struct {
+	E1 string
+	E2 int `bson:"e2"`
+}
+
+type decodeStruct struct {
+	Float64        float64
+	String         string `bson:"string"`
+	Renamed        int64  `bson:"int64,omitempty"`
+	Int32          int
+	Uint           uint
+	Skip           string `bson:"-"`
+	Doc            decodeInner
+	DocPtr         *decodeInner `bson:"doc2"`
+	Array          []int64
+	Binary         []byte
+	ObjId          ObjectId `bson:"objid"`
+	True           bool
+	Time           time.Time
+	Null           *int
+	Regex          RegEx
+	DBPointer      DBPointer `bson:"DBPointer"`
+	JS             JavaScript
+	Symbol         Symbol
+	JSScope        JavaScript
+	Timestamp      MongoTimestamp
+	Dec            Decimal128
+	Min            interface{}
+	Iface          interface{}
+	Value          Value
+	Raw            BSON
+	Mismatch       int
+	decodeEmbedded `bson:",inline"`
+	Rest           map[string]interface{} `bson:",inline"`
+	unexported     int
+}
+
+func TestUnmarshal(t *testing.T) {
+	dec, _ := ParseDecimal128("1.5")
+	in := gbson.D{
+		{Name: "float64", Value: -7.8},
+		{Name: "string", Value: "value of str"},
+		{Name: "int64", Value: int64(-123)},
+		{Name: "int32", Value: int32(456)},
+		{Name: "doc", Value: M{"x": 1}},
+		{Name: "doc2", Value: M{"x": 2}},
+		{Name: "array", Value: []int64{22, 33}},
+		{Name: "binary", Value: []byte("binary val")},
+		{Name: "objid", Value: id},
+		{Name: "true", Value: true},
+		{Name: "time", Value: now},
+		{Name: "null", Value: nil},
+		{Name: "regex", Value: RegEx{Pattern: "a+", Options: "i"}},
+		{Name: "DBPointer", Value: DBPointer{Namespace: "test.rs", Id: id}},
+		{Name: "js", Value: JavaScript{Code: "f()"}},
+		{Name: "symbol", Value: Symbol("sym")},
+		{Name: "jsscope", Value: JavaScript{Code: "g(a)", Scope: M{"a": int32(1)}}},
+		{Name: "timestamp", Value: ts},
+		{Name: "dec", Value: dec},
+		{Name: "min", Value: MinKey},
+		{Name: "uint", Value: int32(456)},
+		{Name: "iface", Value: M{"x": 1}},
+		{Name: "value", Value: []int64{22, 33}},
+		{Name: "raw", Value: M{"x": 1}},
+		{Name: "mismatch", Value: "value of str"},
+		{Name: "e1", Value: "embedded"},
+		{Name: "e2", Value: 3},
+		{Name: "extra", Value: "rest"},
+		{Name: "skip", Value: "rest too"},
+	}
+	data, err := Marshal(in)
+	assert.NoError(t, err)
+
+	out := decodeStruct{unexported: 1, Float64: 100}
+	assert.NoError(t, Unmarshal(data, &out))
+	assert.Equal(t, -7.8, out.Float64)
+	assert.Equal(t, "value of str", out.String)
+	assert.Equal(t, int64(-123), out.Renamed)
+	assert.Equal(t, 456, out.Int32)
+	assert.Equal(t, uint(456), out.Uint)
+	assert.Equal(t, decodeInner{1}, out.Doc)
+	assert.Equal(t, &decodeInner{2}, out.DocPtr)
+	assert.Equal(t, []int64{22, 33}, out.Array)
+	assert.Equal(t, []byte("binary val"), out.Binary)
+	assert.Equal(t, id, out.ObjId)
+	assert.True(t, out.True)
+	assert.Equal(t, now.UTC(), out.Time)
+	assert.Nil(t, out.Null)
+	assert.Equal(t, RegEx{Pattern: "a+", Options: "i"}, out.Regex)
+	assert.Equal(t, DBPointer{Namespace: "test.rs", Id: id}, out.DBPointer)
+	assert.Equal(t, JavaScript{Code: "f()"}, out.JS)
+	assert.Equal(t, Symbol("sym"), out.Symbol)
+	assert.Equal(t, JavaScript{Code: "g(a)", Scope: M{"a": int32(1)}}, out.JSScope)
+	assert.Equal(t, ts, out.Timestamp)
+	assert.Equal(t, dec, out.Dec)
+	assert.Equal(t, MinKey, out.Min)
+	assert.Equal(t, M{"x": int32(1)}, out.Iface)
+	assert.Equal(t, BSON(data).Lookup("value"), out.Value)
+	assert.Equal(t, BSON(data).Lookup("raw").Document(), out.Raw)
+	assert.Equal(t, 0, out.Mismatch)
+	assert.Equal(t, decodeEmbedded{"embedded", 3}, out.decodeEmbedded)
+	assert.Equal(t, map[string]interface{}{"extra": "rest", "skip": "rest too"}, out.Rest)
+	assert.Equal(t, 0, out.unexported) // reset like mgo does
+	assert.Equal(t, "", out.Skip)
+
+	// zero-copy fields point into data
+	assert.True(t, &out.Raw[0] == &BSON(data).Lookup("raw").valueData[0])
+	assert.True(t, &out.Value.valueData[0] == &BSON(data).Lookup("value").valueData[0])
+}
+
+func TestUnmarshalMapAndCompat(t *testing.T) {
+	data, err := Marshal(doc)
+	assert.NoError(t, err)
+
+	var mine, theirs M
+	assert.NoError(t, Unmarshal(data, &mine))
+	assert.NoError(t, gbson.Unmarshal(data, &theirs))
+	assert.Equal(t, len(theirs), len(mine))
+	assert.Equal(t, BSON(data).Map(), mine)
+
+	m := map[string]int64{"old": 1}
+	assert.NoError(t, Unmarshal(data, m))
+	assert.Equal(t, map[string]int64{"float64": -7, "int32": -456, "int64": -123, "true": 1, "false": 0, "null": 0, "timestamp": int64(ts)}, m)
+
+	ints, err := Marshal(D{{Key: "1", Value: "a"}, {Key: "x", Value: "b"}})
+	assert.NoError(t, err)
+	var byInt map[int]string
+	assert.NoError(t, Unmarshal(ints, &byInt))
+	assert.Equal(t, map[int]string{1: "a"}, byInt)
+
+	var d gbson.D
+	assert.NoError(t, Unmarshal(ints, &d))
+	assert.Equal(t, gbson.D{{Name: "1", Value: "a"}, {Name: "x", Value: "b"}}, d)
+
+	var i int
+	assert.IsType(t, &UnmarshalTypeError{}, Unmarshal(data, &i))
+	assert.Error(t, Unmarshal(data, nil))
+	assert.Error(t, Unmarshal(data, decodeStruct{}))
+	assert.Error(t, Unmarshal(data[:len(data)-1], &mine))
+
+	var s string
+	assert.NoError(t, BSON(data).Lookup("string").Unmarshal(&s))
+	assert.Equal(t, "value of str", s)
+	var arr [3]int
+	assert.NoError(t, BSON(data).Lookup("array").Unmarshal(&arr))
+	assert.Equal(t, [3]int{22, 33, 0}, arr)
+}
+
+type decodeSetterType struct {
+	raw gbson.Raw
+}
+
+func (s *decodeSetterType) SetBSON(raw gbson.Raw) error {
+	if raw.Kind == TypeInt32 {
+		return &gbson.TypeError{}
+	}
+	s.raw = raw
+	return nil
+}
+
+type decodeUnmarshalerType string
+
+func (u *decodeUnmarshalerType) UnmarshalBSONValue(v Value) error {
+	if v.Type() != TypeString {
+		return errors.New("want a string")
+	}
+	*u = decodeUnmarshalerType("got " + v.Str())
+	return nil
+}
+
+type decodeRecursive struct {
+	Name     string
+	Children []*decodeRecursive
+}
+
+func TestUnmarshalInterfaces(t *testing.T) {
+	data, err := Marshal(M{"a": "x", "b": int32(1), "c": "x"})
+	assert.NoError(t, err)
+
+	var out struct {
+		A decodeSetterType
+		B decodeSetterType
+		U decodeUnmarshalerType `bson:"c"`
+	}
+	assert.NoError(t, Unmarshal(data, &out))
+	assert.Equal(t, TypeString, out.A.raw.Kind)
+	assert.Equal(t, gbson.Raw{}, out.B.raw)
+	assert.Equal(t, decodeUnmarshalerType("got x"), out.U)
+
+	var bad struct {
+		U decodeUnmarshalerType `bson:"b"`
+	}
+	assert.EqualError(t, Unmarshal(data, &bad), "want a string")
+
+	tree := decodeRecursive{Name: "root", Children: []*decodeRecursive{{Name: "a"}, {Name: "b", Children: []*decodeRecursive{{Name: "c"}}}}}
+	data, err = Marshal(tree)
+	assert.NoError(t, err)
+	var got, want decodeRecursive
+	assert.NoError(t, Unmarshal(data, &got))
+	assert.NoError(t, gbson.Unmarshal(data, &want))
+	assert.Equal(t, want, got)
+	assert.Equal(t, "c", got.Children[1].Children[0].Name)
+
+	var dup struct {
+		A string
+		B string `bson:"a"`
+	}
+	assert.Error(t, Unmarshal(data, &dup))
+}
+
+func BenchmarkUnmarshalStructMgo(b *testing.B) {
+	bs, err := Marshal(doc)
+	assert.NoError(b, err)
+	type Doc struct {
+		Float64 float64 `bson:"float64"`
+		Int64   int64   `bson:"int64"`
+		String  string  `bson:"string"`
+	}
+	var doc Doc
+	for i := 0; i < b.N; i++ {
+		_ = gbson.Unmarshal(bs, &doc)
+	}
+}
@@ -0,0 +1,559 @@
+package bsonex
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Marshaler is implemented by types that encode themselves as a single value.
+// data is the raw value of type t, without type byte and key.
+type Marshaler interface {
+	MarshalBSONValue() (t ValueType, data []byte, err error)
+}
+
+// MarshalTypeError reports a Go value that can not be encoded.
+type MarshalTypeError struct {
+	GoType reflect.Type
+	Msg    string
+}
+
+func (e *MarshalTypeError) Error() string {
+	if e.Msg != "" {
+		return fmt.Sprintf("bsonex: cannot marshal Go value of type %s: %s", e.GoType, e.Msg)
+	}
+	return fmt.Sprintf("bsonex: cannot marshal Go value of type %s", e.GoType)
+}
+
+// Marshal encodes in as a BSON document. It is a drop-in replacement for
+// mgo's bson.Marshal: in is a struct, a map, a slice of gbson.DocElem or a
+// pointer to one of those, struct fields honor the same
+// `bson:"name,omitempty,minsize,inline"` tags as Unmarshal, and values
+// implementing Marshaler or gbson.Getter encode themselves.
+func Marshal(in interface{}) ([]byte, error) {
+	return MarshalAppend(nil, in)
+}
+
+// MarshalAppend is like Marshal but appends the document to dst, so a buffer
+// can be reused across documents. dst is returned unchanged on error.
+func MarshalAppend(dst []byte, in interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(in)
+	if !rv.IsValid() {
+		return dst, errors.New("bsonex: Marshal needs a document, got nil")
+	}
+	out, t, err := encoderFor(rv.Type())(dst, rv, false)
+	if err != nil {
+		return dst, err
+	}
+	if t != TypeDocument && t != TypeArray {
+		return dst, &MarshalTypeError{GoType: rv.Type(), Msg: "not a document"}
+	}
+	return out, nil
+}
+
+// Encoder writes documents to a stream, reusing its buffer.
+type Encoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the document encoded by Marshal(v).
+func (e *Encoder) Encode(v interface{}) (err error) {
+	if e.buf, err = MarshalAppend(e.buf[:0], v); err != nil {
+		return err
+	}
+	_, err = e.w.Write(e.buf)
+	return err
+}
+
+// encodeFunc appends the raw value of v to dst and returns its type. minSize
+// encodes integers that fit as int32, see the ,minsize tag.
+type encodeFunc func(dst []byte, v reflect.Value, minSize bool) ([]byte, ValueType, error)
+
+var encoders sync.Map // map[reflect.Type]encodeFunc
+
+// encoderFor returns the cached encoder of t, see decoderFor.
+func encoderFor(t reflect.Type) encodeFunc {
+	if f, ok := encoders.Load(t); ok {
+		return f.(encodeFunc)
+	}
+	var (
+		wg sync.WaitGroup
+		f  encodeFunc
+	)
+	wg.Add(1)
+	fi, loaded := encoders.LoadOrStore(t, encodeFunc(func(dst []byte, v reflect.Value, minSize bool) ([]byte, ValueType, error) {
+		wg.Wait()
+		return f(dst, v, minSize)
+	}))
+	if loaded {
+		return fi.(encodeFunc)
+	}
+	f = newEncoder(t)
+	wg.Done()
+	encoders.Store(t, f)
+	return f
+}
+
+// appendValueElement appends the element key: v.
+func appendValueElement(dst []byte, key string, v reflect.Value, minSize bool) ([]byte, error) {
+	if strings.IndexByte(key, 0x00) >= 0 {
+		return dst, fmt.Errorf("bsonex: key %q contains 0x00", key)
+	}
+	pos := len(dst)
+	dst = appendElementHeader(dst, TypeNull, key)
+	if !v.IsValid() {
+		return dst, nil
+	}
+	dst, t, err := encoderFor(v.Type())(dst, v, minSize)
+	if err != nil {
+		return dst, withKey(err, []byte(key))
+	}
+	dst[pos] = t
+	return dst, nil
+}
+
+var (
+	typeOfSymbol     = reflect.TypeOf(Symbol(""))
+	typeOfTimestamp  = reflect.TypeOf(MongoTimestamp(0))
+	typeOfOrderKey   = reflect.TypeOf(MinKey)
+	typeOfUndefined  = reflect.TypeOf(Undefined)
+	typeOfJSONNumber = reflect.TypeOf(json.Number(""))
+	typeOfURL        = reflect.TypeOf(url.URL{})
+	typeOfMarshaler  = reflect.TypeOf((*Marshaler)(nil)).Elem()
+)
+
+func newEncoder(t reflect.Type) encodeFunc {
+	if enc := newTypeEncoder(t); enc != nil {
+		return enc
+	}
+	if enc := newMgoEncoder(t); enc != nil {
+		return enc
+	}
+	if own, ok := primitiveTypes[t]; ok && isLeafType(own) {
+		return newConvertEncoder(fromPrimitiveValue)
+	}
+	if t.Implements(typeOfMarshaler) {
+		return encodeMarshaler
+	}
+	if t.Implements(typeOfGetter) {
+		return encodeGetter
+	}
+	if t.Kind() != reflect.Ptr {
+		pt := reflect.PtrTo(t)
+		if pt.Implements(typeOfMarshaler) {
+			return encodeAddr(encodeMarshaler, newKindEncoder(t))
+		}
+		if pt.Implements(typeOfGetter) {
+			return encodeAddr(encodeGetter, newKindEncoder(t))
+		}
+	}
+	return newKindEncoder(t)
+}
+
+// isLeafType reports whether the mgo and primitive types converted to t are
+// encoded through the conversion, documents and arrays are encoded natively.
+func isLeafType(t reflect.Type) bool {
+	return t != typeOfM && t != typeOfArray
+}
+
+// newConvertEncoder encodes the bsonex value returned by conv.
+func newConvertEncoder(conv func(interface{}) interface{}) encodeFunc {
+	return func(dst []byte, v reflect.Value, minSize bool) ([]byte, ValueType, error) {
+		cv := reflect.ValueOf(conv(v.Interface()))
+		if !cv.IsValid() {
+			return dst, TypeNull, nil
+		}
+		return encoderFor(cv.Type())(dst, cv, minSize)
+	}
+}
+
+// encodeAddr uses enc on the address of addressable values, which have
+// pointer receiver methods, and fallback on the others.
+func encodeAddr(enc, fallback encodeFunc) encodeFunc {
+	return func(dst []byte, v reflect.Value, minSize bool) ([]byte, ValueType, error) {
+		if v.CanAddr() {
+			return enc(dst, v.Addr(), minSize)
+		}
+		return fallback(dst, v, minSize)
+	}
+}
+
+func encodeMarshaler(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return dst, TypeNull, nil
+	}
+	t, data, err := v.Interface().(Marshaler).MarshalBSONValue()
+	if err != nil {
+		return dst, 0, err
+	}
+	return append(dst, data...), t, nil
+}
+
+// newTypeEncoder returns the encoder of the BSON specific types, or nil.
+func newTypeEncoder(t reflect.Type) encodeFunc {
+	switch t {
+	case typeOfValue:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			// read the fields directly, v.Interface() would allocate
+			val := Value{ValueType(v.Field(0).Uint()), v.Field(1).Bytes()}
+			if val.valueType == TypeEmpty {
+				return dst, 0, &MarshalTypeError{GoType: t, Msg: "empty Value"}
+			}
+			return append(dst, val.valueData...), val.valueType, nil
+		}
+	case typeOfBSON:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			if v.IsNil() {
+				return dst, TypeNull, nil
+			}
+			return append(dst, v.Bytes()...), TypeDocument, nil
+		}
+	case typeOfTime:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			tm := v.Interface().(time.Time)
+			return appendInt64(dst, tm.Unix()*1e3+int64(tm.Nanosecond()/1e6)), TypeDatetime, nil
+		}
+	case typeOfDuration:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			return appendInt64(dst, v.Int()/1e6), TypeInt64, nil
+		}
+	case typeOfTimestamp:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			return appendInt64(dst, v.Int()), TypeTimestamp, nil
+		}
+	case typeOfOrderKey:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			if v.Int() == int64(MaxKey) {
+				return dst, TypeMaxKey, nil
+			}
+			return dst, TypeMinKey, nil
+		}
+	case typeOfUndefined:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			return dst, TypeUndefined, nil
+		}
+	case typeOfObjectId:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			return appendObjectId(dst, v.String())
+		}
+	case typeOfSymbol:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			return appendStringValue(dst, v.String()), TypeSymbol, nil
+		}
+	case typeOfJSONNumber:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			n := json.Number(v.String())
+			if i, err := n.Int64(); err == nil {
+				return appendInt64(dst, i), TypeInt64, nil
+			}
+			f, err := n.Float64()
+			if err != nil {
+				return dst, 0, &MarshalTypeError{GoType: t, Msg: "invalid number " + strconv.Quote(string(n))}
+			}
+			return appendDouble(dst, f), TypeDouble, nil
+		}
+	case typeOfURL:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			u := v.Interface().(url.URL)
+			return appendStringValue(dst, u.String()), TypeString, nil
+		}
+	case typeOfDecimal128:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			return v.Interface().(Decimal128).AppendBytes(dst), TypeDecimal128, nil
+		}
+	case typeOfBinary:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			return appendBinary(dst, v.Interface().(Binary)), TypeBinary, nil
+		}
+	case typeOfRegEx:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			r := v.Interface().(RegEx)
+			options := []byte(r.Options)
+			sort.Slice(options, func(i, j int) bool { return options[i] < options[j] })
+			return appendCString(appendCString(dst, r.Pattern), string(options)), TypeRegex, nil
+		}
+	case typeOfDBPointer:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			p := v.Interface().(DBPointer)
+			dst, _, err := appendObjectId(appendStringValue(dst, p.Namespace), string(p.Id))
+			return dst, TypeDBPointer, err
+		}
+	case typeOfJavaScript:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			js := v.Interface().(JavaScript)
+			if js.Scope == nil {
+				return appendStringValue(dst, js.Code), TypeJSCode, nil
+			}
+			dst, start := startDocument(dst)
+			dst, err := MarshalAppend(appendStringValue(dst, js.Code), js.Scope)
+			return setLength(dst, start), TypeJSCodeScope, err
+		}
+	case typeOfD:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			dst, start := startDocument(dst)
+			var err error
+			for _, e := range v.Interface().(D) {
+				if dst, err = appendValueElement(dst, e.Key, reflect.ValueOf(e.Value), false); err != nil {
+					return dst, 0, err
+				}
+			}
+			return endDocument(dst, start), TypeDocument, nil
+		}
+	}
+	return nil
+}
+
+func appendObjectId(dst []byte, id string) ([]byte, ValueType, error) {
+	if len(id) != 12 {
+		return dst, 0, &MarshalTypeError{GoType: typeOfObjectId, Msg: fmt.Sprintf("ObjectId must be 12 bytes long, got %d", len(id))}
+	}
+	return append(dst, id...), TypeObjectId, nil
+}
+
+func appendBinary(dst []byte, b Binary) []byte {
+	if b.Kind == 0x02 {
+		dst = appendInt32(dst, int32(len(b.Data)+4))
+		dst = append(dst, b.Kind)
+		return append(appendInt32(dst, int32(len(b.Data))), b.Data...)
+	}
+	dst = appendInt32(dst, int32(len(b.Data)))
+	return append(append(dst, b.Kind), b.Data...)
+}
+
+func newKindEncoder(t reflect.Type) encodeFunc {
+	switch t.Kind() {
+	case reflect.Interface:
+		return func(dst []byte, v reflect.Value, minSize bool) ([]byte, ValueType, error) {
+			if v.IsNil() {
+				return dst, TypeNull, nil
+			}
+			e := v.Elem()
+			return encoderFor(e.Type())(dst, e, minSize)
+		}
+	case reflect.Ptr:
+		elemEnc := encoderFor(t.Elem())
+		return func(dst []byte, v reflect.Value, minSize bool) ([]byte, ValueType, error) {
+			if v.IsNil() {
+				return dst, TypeNull, nil
+			}
+			return elemEnc(dst, v.Elem(), minSize)
+		}
+	case reflect.Struct:
+		return newStructEncoder(t)
+	case reflect.Map:
+		return newMapEncoder(t)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+				return appendBinary(dst, Binary{Data: v.Bytes()}), TypeBinary, nil
+			}
+		}
+		return newArrayEncoder(t)
+	case reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+				dst = append(appendInt32(dst, int32(v.Len())), 0x00)
+				for i := 0; i < v.Len(); i++ {
+					dst = append(dst, byte(v.Index(i).Uint()))
+				}
+				return dst, TypeBinary, nil
+			}
+		}
+		return newArrayEncoder(t)
+	case reflect.String:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			return appendStringValue(dst, v.String()), TypeString, nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		is64 := t.Kind() == reflect.Int64
+		return func(dst []byte, v reflect.Value, minSize bool) ([]byte, ValueType, error) {
+			i := v.Int()
+			if (minSize || !is64) && i >= math.MinInt32 && i <= math.MaxInt32 {
+				return appendInt32(dst, int32(i)), TypeInt32, nil
+			}
+			return appendInt64(dst, i), TypeInt64, nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		small := t.Kind() <= reflect.Uint32
+		return func(dst []byte, v reflect.Value, minSize bool) ([]byte, ValueType, error) {
+			u := v.Uint()
+			if u > math.MaxInt64 {
+				return dst, 0, &MarshalTypeError{GoType: t, Msg: "value overflows int64"}
+			}
+			if (minSize || small) && u <= math.MaxInt32 {
+				return appendInt32(dst, int32(u)), TypeInt32, nil
+			}
+			return appendInt64(dst, int64(u)), TypeInt64, nil
+		}
+	case reflect.Float32, reflect.Float64:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			return appendDouble(dst, v.Float()), TypeDouble, nil
+		}
+	case reflect.Bool:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			if v.Bool() {
+				return append(dst, 1), TypeBoolean, nil
+			}
+			return append(dst, 0), TypeBoolean, nil
+		}
+	}
+	return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+		return dst, 0, &MarshalTypeError{GoType: t}
+	}
+}
+
+func newStructEncoder(t reflect.Type) encodeFunc {
+	sf, err := cachedStructFields(t)
+	if err != nil {
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			return dst, 0, err
+		}
+	}
+	encs := make([]encodeFunc, len(sf.list))
+	for i, f := range sf.list {
+		encs[i] = encoderFor(f.typ)
+	}
+	return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+		dst, start := startDocument(dst)
+		var err error
+		if sf.inlineMap != nil {
+			iter := v.FieldByIndex(sf.inlineMap).MapRange()
+			for iter.Next() {
+				key := iter.Key().String()
+				if _, ok := sf.byName[key]; ok {
+					return dst, 0, &MarshalTypeError{GoType: t, Msg: fmt.Sprintf("inline map key %q conflicts with a field", key)}
+				}
+				if dst, err = appendValueElement(dst, key, iter.Value(), false); err != nil {
+					return dst, 0, err
+				}
+			}
+		}
+		for i, f := range sf.list {
+			fv := v.FieldByIndex(f.index)
+			if f.omitEmpty && isZero(fv) {
+				continue
+			}
+			if strings.IndexByte(f.name, 0x00) >= 0 {
+				return dst, 0, fmt.Errorf("bsonex: key %q contains 0x00", f.name)
+			}
+			pos := len(dst)
+			dst = appendElementHeader(dst, 0, f.name)
+			var vt ValueType
+			if dst, vt, err = encs[i](dst, fv, f.minSize); err != nil {
+				return dst, 0, withKey(err, []byte(f.name))
+			}
+			dst[pos] = vt
+		}
+		return endDocument(dst, start), TypeDocument, nil
+	}
+}
+
+func newMapEncoder(t reflect.Type) encodeFunc {
+	var formatKey func(k reflect.Value) string
+	switch t.Key().Kind() {
+	case reflect.String:
+		formatKey = reflect.Value.String
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		formatKey = func(k reflect.Value) string { return strconv.FormatInt(k.Int(), 10) }
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		formatKey = func(k reflect.Value) string { return strconv.FormatUint(k.Uint(), 10) }
+	default:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			return dst, 0, &MarshalTypeError{GoType: t, Msg: "unsupported map key type"}
+		}
+	}
+	return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+		dst, start := startDocument(dst)
+		var err error
+		iter := v.MapRange()
+		for iter.Next() {
+			if dst, err = appendValueElement(dst, formatKey(iter.Key()), iter.Value(), false); err != nil {
+				return dst, 0, err
+			}
+		}
+		return endDocument(dst, start), TypeDocument, nil
+	}
+}
+
+func newArrayEncoder(t reflect.Type) encodeFunc {
+	elemEnc := encoderFor(t.Elem())
+	return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+		dst, start := startDocument(dst)
+		var key [20]byte
+		for i := 0; i < v.Len(); i++ {
+			pos := len(dst)
+			dst = append(append(dst, 0), strconv.AppendInt(key[:0], int64(i), 10)...)
+			dst = append(dst, 0x00)
+			var (
+				vt  ValueType
+				err error
+			)
+			if dst, vt, err = elemEnc(dst, v.Index(i), false); err != nil {
+				return dst, 0, withKey(err, strconv.AppendInt(key[:0], int64(i), 10))
+			}
+			dst[pos] = vt
+		}
+		return endDocument(dst, start), TypeArray, nil
+	}
+}
+
+// isZero reports whether v is empty for the ,omitempty flag, with the same
+// rules as mgo.
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Struct:
+		vt := v.Type()
+		// the package types with unexported fields decide for themselves,
+		// BSON and ObjectId are covered by their length above
+		switch vt {
+		case typeOfTime:
+			return v.Interface().(time.Time).IsZero()
+		case typeOfDecimal128:
+			h, l := v.Interface().(Decimal128).GetBytes()
+			return h == 0 && l == 0
+		case typeOfValue:
+			return v.Field(0).Uint() == uint64(TypeEmpty)
+		case typeOfBinary:
+			b := v.Interface().(Binary)
+			return b.Kind == 0 && len(b.Data) == 0
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if vt.Field(i).PkgPath != "" && !vt.Field(i).Anonymous {
+				continue
+			}
+			if !isZero(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
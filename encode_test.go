@@ -0,0 +1,234 @@
+package bsonex
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	gbson "github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+type encodeStruct struct {
+	Int            int
+	Int64          int64 `bson:"i64,minsize"`
+	Big            int64 `bson:"big,minsize"`
+	Uint32         uint32
+	Uint64         uint64
+	Str            string `bson:"s,omitempty"`
+	Empty          string `bson:"e,omitempty"`
+	Skip           string `bson:"-"`
+	Ptr            *decodeInner
+	NilPtr         *decodeInner
+	Zero           time.Time   `bson:",omitempty"`
+	ZeroInner      decodeInner `bson:",omitempty"`
+	Slice          []string
+	NilSlice       []string
+	Bytes          []byte
+	Array          [2]byte
+	Map            map[string]int
+	Iface          interface{}
+	decodeEmbedded `bson:",inline"`
+	Rest           map[string]interface{} `bson:",inline"`
+}
+
+func TestMarshalCompat(t *testing.T) {
+	dec, _ := ParseDecimal128("-1.5E-3")
+	gdec, _ := gbson.ParseDecimal128("2.5")
+	in := gbson.D{
+		{Name: "float64", Value: -7.8},
+		{Name: "float32", Value: float32(1.5)},
+		{Name: "string", Value: "value of str"},
+		{Name: "int", Value: 1},
+		{Name: "bigint", Value: math.MaxInt32 + 1},
+		{Name: "int8", Value: int8(-3)},
+		{Name: "int64", Value: int64(7)},
+		{Name: "uint", Value: uint(8)},
+		{Name: "uint64", Value: uint64(9)},
+		{Name: "bool", Value: true},
+		{Name: "nil", Value: nil},
+		{Name: "nilmap", Value: M(nil)},
+		{Name: "doc", Value: gbson.D{{Name: "x", Value: 1}}},
+		{Name: "rawd", Value: gbson.RawD{{Name: "y", Value: gbson.Raw{Kind: TypeInt32, Data: []byte{1, 0, 0, 0}}}}},
+		{Name: "array", Value: []interface{}{1, "a", nil, []int{}}},
+		{Name: "binary", Value: []byte("binary val")},
+		{Name: "bytes", Value: [3]byte{1, 2, 3}},
+		{Name: "gbinary", Value: gbson.Binary{Kind: 0x80, Data: []byte{1}}},
+		{Name: "old", Value: gbson.Binary{Kind: 0x02, Data: []byte{1, 2}}},
+		{Name: "objid", Value: id},
+		{Name: "time", Value: now},
+		{Name: "duration", Value: 3 * time.Second},
+		{Name: "regex", Value: RegEx{Pattern: "a+", Options: "si"}},
+		{Name: "DBPointer", Value: DBPointer{Namespace: "test.rs", Id: id}},
+		{Name: "js", Value: JavaScript{Code: "f()"}},
+		{Name: "jsscope", Value: JavaScript{Code: "g(a)", Scope: gbson.D{{Name: "a", Value: 1}}}},
+		{Name: "symbol", Value: Symbol("sym")},
+		{Name: "timestamp", Value: ts},
+		{Name: "gdec", Value: gdec},
+		{Name: "min", Value: MinKey},
+		{Name: "max", Value: MaxKey},
+		{Name: "undefined", Value: Undefined},
+		{Name: "number", Value: json.Number("12")},
+		{Name: "fnumber", Value: json.Number("1.5")},
+		{Name: "ptr", Value: &decodeInner{3}},
+		{Name: "struct", Value: encodeStruct{
+			Int: 1, Int64: 2, Big: math.MaxInt64, Uint32: 3, Uint64: 4, Str: "s", Skip: "skip",
+			Ptr: &decodeInner{5}, Slice: []string{"a"}, Bytes: []byte{6}, Array: [2]byte{7, 8},
+			Map: map[string]int{"m": 9}, Iface: 10, decodeEmbedded: decodeEmbedded{"e", 11},
+		}},
+	}
+	want, err := gbson.Marshal(in)
+	assert.NoError(t, err)
+	got, err := Marshal(in)
+	assert.NoError(t, err)
+	assert.Equal(t, BSON(want).String(), BSON(got).String())
+	assert.Equal(t, want, got)
+
+	// Decimal128 used to go through GetBSON
+	got, err = Marshal(M{"d": dec, "v": BSON(got).Lookup("int64"), "b": BSON(want).Lookup("doc").Document()})
+	assert.NoError(t, err)
+	assert.Equal(t, dec, BSON(got).Lookup("d").Decimal128())
+	assert.Equal(t, int64(7), BSON(got).Lookup("v").Int64())
+	assert.Equal(t, int32(1), BSON(got).Lookup("b.x").Int32())
+
+	// a Binary keeps its subtype
+	got, err = Marshal(M{"b": Binary{Kind: 0x04, Data: []byte{1}}})
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0x04), BSON(got).Lookup("b").Binary().Kind)
+
+	// a top level slice is encoded like an array
+	want, err = gbson.Marshal([]string{"a", "b"})
+	assert.NoError(t, err)
+	got, err = Marshal([]string{"a", "b"})
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	s := encodeStruct{Rest: map[string]interface{}{"extra": 1}}
+	got, err = Marshal(&s)
+	assert.NoError(t, err)
+	var back encodeStruct
+	assert.NoError(t, Unmarshal(got, &back))
+	assert.Equal(t, map[string]interface{}{"extra": int32(1)}, back.Rest)
+	assert.Equal(t, []string{}, back.Slice)
+}
+
+type encodeMarshalerType struct {
+	n int32
+}
+
+func (m *encodeMarshalerType) MarshalBSONValue() (ValueType, []byte, error) {
+	return TypeInt32, appendInt32(nil, m.n*2), nil
+}
+
+type encodeGetterType string
+
+func (g encodeGetterType) GetBSON() (interface{}, error) {
+	return M{"g": string(g)}, nil
+}
+
+func TestMarshalInterfaces(t *testing.T) {
+	v := struct {
+		M  encodeMarshalerType
+		P  *encodeMarshalerType
+		G  encodeGetterType
+		NP *encodeMarshalerType
+	}{M: encodeMarshalerType{1}, P: &encodeMarshalerType{2}, G: "x"}
+	bs, err := Marshal(&v)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"m":2,"p":4,"g":{"g":"x"},"np":null}`, BSON(bs).String())
+
+	// dst is reused and left alone on error
+	dst := []byte("prefix")
+	dst, err = MarshalAppend(dst, M{"a": 1})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":1}`, BSON(dst[6:]).String())
+	for _, in := range []interface{}{
+		nil,
+		1,
+		"str",
+		M{"a": uint64(math.MaxUint64)},
+		M{"a": ObjectId("short")},
+		M{"a\x00": 1},
+		M{"a": Value{}},
+		M{"a": make(chan int)},
+		map[float64]int{1: 1},
+		struct {
+			A int
+			M map[string]int `bson:",inline"`
+		}{M: map[string]int{"a": 1}},
+	} {
+		out, err := MarshalAppend(dst, in)
+		assert.Error(t, err, "%#v", in)
+		assert.Equal(t, dst, out)
+	}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	assert.NoError(t, e.Encode(M{"a": 1}))
+	assert.NoError(t, e.Encode(M{"b": 2}))
+	assert.Error(t, e.Encode(1))
+	r := NewDecoder(&buf)
+	var docs []string
+	assert.NoError(t, r.Do(1, func(b BSONEX) error {
+		docs = append(docs, b.String())
+		return nil
+	}))
+	assert.Equal(t, []string{`{"a":1}`, `{"b":2}`}, docs)
+}
+
+func BenchmarkMarshalStruct(b *testing.B) {
+	type Doc struct {
+		Float64 float64 `bson:"float64"`
+		Int64   int64   `bson:"int64"`
+		String  string  `bson:"string"`
+	}
+	doc := Doc{1.5, 2, "some text"}
+	var buf []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf, _ = MarshalAppend(buf[:0], &doc)
+	}
+}
+
+func BenchmarkMarshalStructMgo(b *testing.B) {
+	type Doc struct {
+		Float64 float64 `bson:"float64"`
+		Int64   int64   `bson:"int64"`
+		String  string  `bson:"string"`
+	}
+	doc := Doc{1.5, 2, "some text"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = gbson.Marshal(&doc)
+	}
+}
+
+func TestMarshalOmitEmptyTypes(t *testing.T) {
+	type omit struct {
+		P Decimal128 `bson:"p,omitempty"`
+		V Value      `bson:"v,omitempty"`
+		B BSON       `bson:"b,omitempty"`
+		O ObjectId   `bson:"o,omitempty"`
+		N Binary     `bson:"n,omitempty"`
+	}
+	bs, err := Marshal(omit{})
+	assert.NoError(t, err)
+	assert.Equal(t, `{}`, BSON(bs).String())
+
+	dec, _ := ParseDecimal128("1.5")
+	doc, _ := Marshal(M{"a": int32(1)})
+	in := omit{
+		P: dec, V: BSON(doc).Lookup("a"), B: doc, O: ObjectIdHex("5f1d2c3b4a5968778695a4b3"),
+		N: Binary{Kind: 0x80},
+	}
+	bs, err = Marshal(in)
+	assert.NoError(t, err)
+	b := BSON(bs)
+	assert.Equal(t, dec, b.Lookup("p").Decimal128())
+	assert.Equal(t, int32(1), b.Lookup("v").Int32())
+	assert.Equal(t, int32(1), b.Lookup("b.a").Int32())
+	assert.Equal(t, in.O, b.Lookup("o").Objid())
+	assert.Equal(t, TypeBinary, b.Lookup("n").Type())
+}
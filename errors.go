@@ -0,0 +1,158 @@
+package bsonex
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Pos locates malformed data. DocOffset is the stream offset of the document
+// as tracked by Decoder (0 when parsing a standalone BSON), Offset is the byte
+// offset relative to the start of that document. Path holds the keys of the
+// enclosing documents and Key the key of the element being parsed when the
+// error occurred, if any.
+type Pos struct {
+	DocOffset int64
+	Offset    int64
+	Path      []string
+	Key       string
+}
+
+func (p *Pos) pos() *Pos {
+	return p
+}
+
+// StreamOffset returns the absolute offset of the error in the stream.
+func (p Pos) StreamOffset() int64 {
+	return p.DocOffset + p.Offset
+}
+
+// FullKey returns the dotted path of the element, e.g. "a.b.c".
+func (p Pos) FullKey() string {
+	if len(p.Path) == 0 {
+		return p.Key
+	}
+	return strings.Join(p.Path, ".") + "." + p.Key
+}
+
+func (p Pos) String() string {
+	s := fmt.Sprintf("offset %d", p.StreamOffset())
+	if p.DocOffset != 0 {
+		s += fmt.Sprintf(" (document at %d)", p.DocOffset)
+	}
+	if p.Key != "" || len(p.Path) != 0 {
+		s += fmt.Sprintf(", key %q", p.FullKey())
+	}
+	return s
+}
+
+// TruncatedError reports data that ends before a value is complete.
+type TruncatedError struct {
+	Pos
+	Need int
+	Have int
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("bsonex: truncated data at %v: need %d bytes, have %d",
+		e.Pos, e.Need, e.Have)
+}
+
+// LengthError reports a length prefix that is inconsistent with the data.
+type LengthError struct {
+	Pos
+	Length int
+}
+
+func (e *LengthError) Error() string {
+	return fmt.Sprintf("bsonex: invalid length %d at %v", e.Length, e.Pos)
+}
+
+// InvalidTypeError reports an unknown element type byte.
+type InvalidTypeError struct {
+	Pos
+	Type ValueType
+}
+
+func (e *InvalidTypeError) Error() string {
+	return fmt.Sprintf("bsonex: invalid bson type %#x at %v", e.Type, e.Pos)
+}
+
+// TerminatorError reports a missing 0x00 where a document, string or key
+// should end.
+type TerminatorError struct {
+	Pos
+}
+
+func (e *TerminatorError) Error() string {
+	return fmt.Sprintf("bsonex: missing terminator at %v", e.Pos)
+}
+
+// InvalidKeyError reports an element key that is not valid UTF-8.
+type InvalidKeyError struct {
+	Pos
+}
+
+func (e *InvalidKeyError) Error() string {
+	return fmt.Sprintf("bsonex: invalid utf-8 key at %v", e.Pos)
+}
+
+// TypeError is returned by Value accessors called on a value of another type.
+type TypeError struct {
+	Expect []ValueType
+	Actual ValueType
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("bsonex: invalid type, expect: %v, real: %v",
+		e.Expect, e.Actual)
+}
+
+// CallbackError wraps the error returned by the callback of Do and DoOrdered
+// with the document it failed on. ForEach returns the error unchanged.
+type CallbackError struct {
+	DocOffset int64
+	RunnerID  int
+	Err       error
+}
+
+func (e *CallbackError) Error() string {
+	return fmt.Sprintf("bsonex: document at %d (runner %d): %v", e.DocOffset, e.RunnerID, e.Err)
+}
+
+func (e *CallbackError) Unwrap() error {
+	return e.Err
+}
+
+func callbackError(b *BSONEX, err error) error {
+	return &CallbackError{DocOffset: b.offset, RunnerID: b.runnerID, Err: err}
+}
+
+// withOffset moves the position of err by n bytes, used when an error found
+// in a nested value is reported relative to its parent.
+func withOffset(err error, n int) error {
+	if p, ok := err.(interface{ pos() *Pos }); ok {
+		p.pos().Offset += int64(n)
+	}
+	return err
+}
+
+// withKey sets the element key of err if it is not set yet, otherwise key is
+// an enclosing document and is prepended to the path.
+func withKey(err error, key []byte) error {
+	if p, ok := err.(interface{ pos() *Pos }); ok {
+		if pos := p.pos(); pos.Key == "" {
+			pos.Key = string(key)
+		} else {
+			pos.Path = append([]string{string(key)}, pos.Path...)
+		}
+	}
+	return err
+}
+
+// withDocOffset records the stream offset of the document err was found in.
+func withDocOffset(err error, offset int64) error {
+	if p, ok := err.(interface{ pos() *Pos }); ok {
+		p.pos().DocOffset = offset
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package bsonex
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecoderErrors(t *testing.T) {
+	b, err := Marshal(M{"a": 1})
+	assert.NoError(t, err)
+	{
+		stream := append(append(append([]byte{}, b...), b...), b[:len(b)-2]...)
+		err = NewDecoder(bytes.NewReader(stream)).ForEach(func(BSONEX) error { return nil })
+		var te *TruncatedError
+		assert.True(t, errors.As(err, &te), err)
+		assert.Equal(t, int64(2*len(b)), te.DocOffset)
+	}
+	{
+		stream := append(append([]byte{}, b...), 0xff, 0xff, 0xff, 0x7f)
+		err = NewDecoder(bytes.NewReader(stream)).Do(4, func(BSONEX) error { return nil })
+		var le *LengthError
+		assert.True(t, errors.As(err, &le), err)
+		assert.Equal(t, int64(len(b)), le.StreamOffset())
+	}
+	{
+		stream := append(append([]byte{}, b...), b...)
+		stream[len(stream)-1] = 1
+		err = NewDecoder(bytes.NewReader(stream)).ForEach(func(BSONEX) error { return nil })
+		var te *TerminatorError
+		assert.True(t, errors.As(err, &te), err)
+		assert.Equal(t, int64(2*len(b)-1), te.StreamOffset())
+	}
+}
+
+func TestErrorPath(t *testing.T) {
+	b, err := Marshal(M{"a": M{"b": M{"c\xff": 1}}})
+	assert.NoError(t, err)
+	stream := append(append([]byte{}, b...), b...)
+	var n int
+	err = NewDecoder(bytes.NewReader(stream)).ForEach(func(b BSONEX) error {
+		n++
+		if n == 2 {
+			return b.Validate()
+		}
+		return nil
+	})
+	var ke *InvalidKeyError
+	assert.True(t, errors.As(err, &ke), err)
+	assert.Equal(t, []string{"a", "b"}, ke.Path)
+	assert.Equal(t, "c\xff", ke.Key)
+	assert.Equal(t, int64(len(b)), ke.DocOffset)
+	assert.Equal(t, byte(TypeInt32), stream[ke.StreamOffset()-1])
+	assert.Contains(t, err.Error(), "a.b.c")
+}
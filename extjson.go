@@ -0,0 +1,196 @@
+package bsonex
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExtJSONMode selects the flavour of MongoDB Extended JSON v2.
+type ExtJSONMode int
+
+const (
+	// ExtJSONCanonical preserves type information for every value.
+	ExtJSONCanonical ExtJSONMode = iota
+	// ExtJSONRelaxed writes numbers and dates in their natural JSON form where
+	// that is not ambiguous.
+	ExtJSONRelaxed
+)
+
+func (m ExtJSONMode) String() string {
+	if m == ExtJSONRelaxed {
+		return "relaxed"
+	}
+	return "canonical"
+}
+
+// ToExtJSON converts b to MongoDB Extended JSON v2 in the given mode.
+func (b BSON) ToExtJSON(mode ExtJSONMode) ([]byte, error) {
+	return b.AppendExtJSON(nil, mode)
+}
+
+// AppendExtJSON appends the Extended JSON v2 form of b to dst.
+func (b BSON) AppendExtJSON(dst []byte, mode ExtJSONMode) ([]byte, error) {
+	return appendExtJSONDocument(dst, b, mode, false)
+}
+
+// ToExtJSON converts v to MongoDB Extended JSON v2 in the given mode.
+func (v Value) ToExtJSON(mode ExtJSONMode) ([]byte, error) {
+	return v.AppendExtJSON(nil, mode)
+}
+
+// AppendExtJSON appends the Extended JSON v2 form of v to dst.
+func (v Value) AppendExtJSON(dst []byte, mode ExtJSONMode) ([]byte, error) {
+	d := v.valueData
+	switch v.valueType {
+	case TypeDouble:
+		f, err := v.Float64Err()
+		if err != nil {
+			return dst, err
+		}
+		if mode == ExtJSONRelaxed && !math.IsInf(f, 0) && !math.IsNaN(f) {
+			return append(dst, formatDouble(f)...), nil
+		}
+		dst = append(dst, `{"$numberDouble":"`...)
+		return append(append(dst, formatDouble(f)...), `"}`...), nil
+	case TypeString:
+		s, err := v.StrErr()
+		return appendJSONString(dst, s), err
+	case TypeDocument:
+		return appendExtJSONDocument(dst, d, mode, false)
+	case TypeArray:
+		return appendExtJSONDocument(dst, d, mode, true)
+	case TypeBinary:
+		bin, err := v.BinaryErr()
+		if err != nil {
+			return dst, err
+		}
+		data := bin.Data
+		if bin.Kind == 0x02 && len(data) >= 4 && getint(data) == len(data)-4 {
+			data = data[4:] // old binary subtype repeats the length
+		}
+		dst = appendBase64(append(dst, `{"$binary":{"base64":"`...), data)
+		dst = appendHex(append(dst, `","subType":"`...), []byte{bin.Kind})
+		return append(dst, `"}}`...), nil
+	case TypeUndefined:
+		return append(dst, `{"$undefined":true}`...), nil
+	case TypeObjectId:
+		id, err := v.ObjidErr()
+		if err != nil {
+			return dst, err
+		}
+		dst = append(dst, `{"$oid":"`...)
+		return append(append(dst, id.Hex()...), `"}`...), nil
+	case TypeBoolean:
+		b, err := v.BoolErr()
+		return strconv.AppendBool(dst, b), err
+	case TypeDatetime:
+		ms, err := v.Int64Err()
+		if err != nil {
+			return dst, err
+		}
+		if t := time.UnixMilli(ms).UTC(); mode == ExtJSONRelaxed && t.Year() >= 1970 && t.Year() <= 9999 {
+			dst = append(dst, `{"$date":"`...)
+			return append(t.AppendFormat(dst, "2006-01-02T15:04:05.999Z07:00"), `"}`...), nil
+		}
+		dst = append(dst, `{"$date":{"$numberLong":"`...)
+		return append(strconv.AppendInt(dst, ms, 10), `"}}`...), nil
+	case TypeNull:
+		return append(dst, "null"...), nil
+	case TypeRegex:
+		r, err := v.RegexpErr()
+		if err != nil {
+			return dst, err
+		}
+		options := []byte(r.Options)
+		sort.Slice(options, func(i, j int) bool { return options[i] < options[j] })
+		dst = append(dst, `{"$regularExpression":{"pattern":`...)
+		dst = appendJSONString(dst, r.Pattern)
+		dst = append(dst, `,"options":`...)
+		dst = appendJSONString(dst, string(options))
+		return append(dst, "}}"...), nil
+	case TypeDBPointer:
+		p, err := v.DBPointerErr()
+		if err != nil {
+			return dst, err
+		}
+		dst = append(dst, `{"$dbPointer":{"$ref":`...)
+		dst = appendJSONString(dst, p.Namespace)
+		dst = append(dst, `,"$id":{"$oid":"`...)
+		return append(append(dst, p.Id.Hex()...), `"}}}`...), nil
+	case TypeJSCode:
+		code, err := v.JSCodeErr()
+		dst = append(dst, `{"$code":`...)
+		return append(appendJSONString(dst, code), '}'), err
+	case TypeSymbol:
+		sym, err := v.SymbolErr()
+		dst = append(dst, `{"$symbol":`...)
+		return append(appendJSONString(dst, string(sym)), '}'), err
+	case TypeJSCodeScope:
+		code, scope, err := v.JSCodeWithScopeErr()
+		if err != nil {
+			return dst, err
+		}
+		dst = append(dst, `{"$code":`...)
+		dst = appendJSONString(dst, code)
+		dst = append(dst, `,"$scope":`...)
+		dst, err = appendExtJSONDocument(dst, scope, mode, false)
+		return append(dst, '}'), withOffset(err, 8+len(code)+1)
+	case TypeInt32:
+		i, err := v.Int32Err()
+		if mode == ExtJSONRelaxed {
+			return strconv.AppendInt(dst, int64(i), 10), err
+		}
+		dst = append(dst, `{"$numberInt":"`...)
+		return append(strconv.AppendInt(dst, int64(i), 10), `"}`...), err
+	case TypeTimestamp:
+		ts, err := v.Uint64Err()
+		dst = append(dst, `{"$timestamp":{"t":`...)
+		dst = strconv.AppendUint(dst, ts>>32, 10)
+		dst = append(dst, `,"i":`...)
+		return append(strconv.AppendUint(dst, ts&0xffffffff, 10), "}}"...), err
+	case TypeInt64:
+		i, err := v.Int64Err()
+		if mode == ExtJSONRelaxed {
+			return strconv.AppendInt(dst, i, 10), err
+		}
+		dst = append(dst, `{"$numberLong":"`...)
+		return append(strconv.AppendInt(dst, i, 10), `"}`...), err
+	case TypeDecimal128:
+		dec, err := v.Decimal128Err()
+		dst = append(dst, `{"$numberDecimal":"`...)
+		return append(append(dst, dec.String()...), `"}`...), err
+	case TypeMinKey:
+		return append(dst, `{"$minKey":1}`...), nil
+	case TypeMaxKey:
+		return append(dst, `{"$maxKey":1}`...), nil
+	default:
+		return dst, &InvalidTypeError{Type: v.valueType}
+	}
+}
+
+func appendExtJSONDocument(dst []byte, b BSON, mode ExtJSONMode, isArray bool) ([]byte, error) {
+	return appendJSONDocument(dst, b, isArray, func(v Value, dst []byte) ([]byte, error) {
+		return v.AppendExtJSON(dst, mode)
+	})
+}
+
+// formatDouble formats f the way Extended JSON expects: the shortest
+// representation that round trips, with ".0" added to integral values.
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	s := strconv.FormatFloat(f, 'G', -1, 64)
+	if !strings.ContainsAny(s, ".E") {
+		s += ".0"
+	}
+	return s
+}
@@ -0,0 +1,500 @@
+package bsonex
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExtJSONError reports invalid Extended JSON input. Path holds the keys
+// leading to the offending value.
+type ExtJSONError struct {
+	Path []string
+	Msg  string
+}
+
+func (e *ExtJSONError) Error() string {
+	if len(e.Path) == 0 {
+		return "bsonex: extjson: " + e.Msg
+	}
+	return "bsonex: extjson: " + e.Msg + " at key " + strconv.Quote(strings.Join(e.Path, "."))
+}
+
+func extJSONErrorf(format string, a ...interface{}) error {
+	return &ExtJSONError{Msg: fmt.Sprintf(format, a...)}
+}
+
+// ParseExtJSON parses one canonical or relaxed Extended JSON v2 document, as
+// written by ToExtJSON or mongoexport, into raw BSON. Legacy forms such as
+// {"$date": <millis>} and {"$regex": .., "$options": ..} are accepted too.
+func ParseExtJSON(data []byte) (BSON, error) {
+	r := NewExtJSONReader(bytes.NewReader(data))
+	b, err := r.ReadOne()
+	if err != nil {
+		if err == io.EOF {
+			err = extJSONErrorf("empty input")
+		}
+		return nil, err
+	}
+	if _, err = r.dec.Token(); err != io.EOF {
+		return nil, extJSONErrorf("unexpected data after document")
+	}
+	return b, nil
+}
+
+// ExtJSONReader reads a stream of Extended JSON documents separated by white
+// space, e.g. newline delimited mongoexport output.
+type ExtJSONReader struct {
+	dec *json.Decoder
+}
+
+func NewExtJSONReader(r io.Reader) *ExtJSONReader {
+	dec := json.NewDecoder(r)
+	// keep number literals to choose between int32, int64 and double
+	dec.UseNumber()
+	return &ExtJSONReader{dec}
+}
+
+// ReadOne reads the next document, it returns io.EOF at the end of input.
+func (r *ExtJSONReader) ReadOne() (BSON, error) {
+	v, err := readExtJSONValue(r.dec)
+	if err != nil {
+		return nil, err
+	}
+	if v.kind != '{' {
+		return nil, extJSONErrorf("top level value must be a document")
+	}
+	b, _, err := appendExtJSONValue(nil, &v)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// extJSONValue is a parsed JSON value. Objects are kept as members in input
+// order so type wrappers can be recognized by their keys, array elements are
+// members keyed by their index.
+type extJSONValue struct {
+	kind    byte // '{', '[', '"', 't', 'f', 'n' or '0' for numbers
+	s       string
+	members []extJSONMember
+}
+
+type extJSONMember struct {
+	key   string
+	value extJSONValue
+}
+
+// readExtJSONValue reads the next value from the token stream of dec, every
+// token is read exactly once however deep the value is nested.
+func readExtJSONValue(dec *json.Decoder) (v extJSONValue, err error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return
+	}
+	switch tok := tok.(type) {
+	case json.Delim:
+		v.kind = byte(tok)
+		for i := 0; dec.More(); i++ {
+			var m extJSONMember
+			if tok == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return v, err
+				}
+				m.key = key.(string)
+			} else {
+				m.key = strconv.Itoa(i)
+			}
+			if m.value, err = readExtJSONValue(dec); err != nil {
+				return
+			}
+			v.members = append(v.members, m)
+		}
+		// the closing delimiter
+		_, err = dec.Token()
+	case string:
+		v.kind, v.s = '"', tok
+	case json.Number:
+		v.kind, v.s = '0', string(tok)
+	case bool:
+		v.kind = 'f'
+		if tok {
+			v.kind = 't'
+		}
+	case nil:
+		v.kind = 'n'
+	}
+	return
+}
+
+// member returns the value of key if v is an object containing it.
+func (v *extJSONValue) member(key string) *extJSONValue {
+	if v.kind != '{' {
+		return nil
+	}
+	for i := range v.members {
+		if v.members[i].key == key {
+			return &v.members[i].value
+		}
+	}
+	return nil
+}
+
+// stringMember returns the string value of key if v is an object containing
+// it.
+func (v *extJSONValue) stringMember(key string) (string, bool) {
+	if m := v.member(key); m != nil && m.kind == '"' {
+		return m.s, true
+	}
+	return "", false
+}
+
+// String formats v as compact JSON for error messages.
+func (v *extJSONValue) String() string {
+	switch v.kind {
+	case '"':
+		bs, _ := json.Marshal(v.s)
+		return string(bs)
+	case 't':
+		return "true"
+	case 'f':
+		return "false"
+	case 'n':
+		return "null"
+	case '0':
+		return v.s
+	}
+	var sb strings.Builder
+	sb.WriteByte(v.kind)
+	for i, m := range v.members {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		if v.kind == '{' {
+			bs, _ := json.Marshal(m.key)
+			sb.Write(bs)
+			sb.WriteByte(':')
+		}
+		sb.WriteString(m.value.String())
+	}
+	if v.kind == '{' {
+		sb.WriteByte('}')
+	} else {
+		sb.WriteByte(']')
+	}
+	return sb.String()
+}
+
+// appendExtJSONValue appends the BSON encoding of v to dst and returns its
+// type.
+func appendExtJSONValue(dst []byte, v *extJSONValue) ([]byte, ValueType, error) {
+	switch v.kind {
+	case '{':
+		return appendExtJSONObject(dst, v.members)
+	case '[':
+		dst, err := appendExtJSONMembers(dst, v.members)
+		return dst, TypeArray, err
+	case '"':
+		return appendStringValue(dst, v.s), TypeString, nil
+	case 't':
+		return append(dst, 1), TypeBoolean, nil
+	case 'f':
+		return append(dst, 0), TypeBoolean, nil
+	case 'n':
+		return dst, TypeNull, nil
+	}
+	s := v.s
+	if !strings.ContainsAny(s, ".eE") {
+		if i, err := strconv.ParseInt(s, 10, 32); err == nil {
+			return appendInt32(dst, int32(i)), TypeInt32, nil
+		}
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return appendInt64(dst, i), TypeInt64, nil
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return dst, 0, extJSONErrorf("invalid number %s", s)
+	}
+	return appendDouble(dst, f), TypeDouble, nil
+}
+
+func appendExtJSONMembers(dst []byte, members []extJSONMember) ([]byte, error) {
+	dst, start := startDocument(dst)
+	for i := range members {
+		m := &members[i]
+		if strings.IndexByte(m.key, 0x00) >= 0 {
+			return dst, &ExtJSONError{Path: []string{m.key}, Msg: "key contains 0x00"}
+		}
+		typePos := len(dst)
+		dst = appendElementHeader(dst, 0, m.key)
+		var t ValueType
+		var err error
+		dst, t, err = appendExtJSONValue(dst, &m.value)
+		if err != nil {
+			if e, ok := err.(*ExtJSONError); ok {
+				e.Path = append([]string{m.key}, e.Path...)
+			}
+			return dst, err
+		}
+		dst[typePos] = t
+	}
+	return endDocument(dst, start), nil
+}
+
+// extJSONWrappers are the keys starting a type wrapper object.
+var extJSONWrappers = map[string]bool{
+	"$oid": true, "$symbol": true, "$numberInt": true, "$numberLong": true,
+	"$numberDouble": true, "$numberDecimal": true, "$binary": true, "$uuid": true,
+	"$code": true, "$scope": true, "$timestamp": true, "$regularExpression": true,
+	"$dbPointer": true, "$date": true, "$minKey": true, "$maxKey": true,
+	"$undefined": true,
+}
+
+func appendExtJSONObject(dst []byte, members []extJSONMember) ([]byte, ValueType, error) {
+	if len(members) == 0 || !strings.HasPrefix(members[0].key, "$") {
+		dst, err := appendExtJSONMembers(dst, members)
+		return dst, TypeDocument, err
+	}
+	keys := make([]string, len(members))
+	values := make(map[string]*extJSONValue, len(members))
+	for i := range members {
+		keys[i] = members[i].key
+		values[members[i].key] = &members[i].value
+	}
+	sort.Strings(keys)
+	str := func(key string) (string, error) {
+		if v := values[key]; v.kind == '"' {
+			return v.s, nil
+		}
+		return "", extJSONErrorf("invalid %s value %s", key, values[key])
+	}
+	var err error
+	var s string
+	switch strings.Join(keys, ",") {
+	case "$oid":
+		if s, err = str("$oid"); err != nil {
+			return dst, 0, err
+		}
+		id, err := hex.DecodeString(s)
+		if err != nil || len(id) != 12 {
+			return dst, 0, extJSONErrorf("invalid $oid %q", s)
+		}
+		return append(dst, id...), TypeObjectId, nil
+	case "$symbol":
+		if s, err = str("$symbol"); err != nil {
+			return dst, 0, err
+		}
+		return appendStringValue(dst, s), TypeSymbol, nil
+	case "$numberInt":
+		if s, err = str("$numberInt"); err != nil {
+			return dst, 0, err
+		}
+		i, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return dst, 0, extJSONErrorf("invalid $numberInt %q", s)
+		}
+		return appendInt32(dst, int32(i)), TypeInt32, nil
+	case "$numberLong":
+		if s, err = str("$numberLong"); err != nil {
+			return dst, 0, err
+		}
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return dst, 0, extJSONErrorf("invalid $numberLong %q", s)
+		}
+		return appendInt64(dst, i), TypeInt64, nil
+	case "$numberDouble":
+		if s, err = str("$numberDouble"); err != nil {
+			return dst, 0, err
+		}
+		f, err := parseExtJSONDouble(s)
+		return appendDouble(dst, f), TypeDouble, err
+	case "$numberDecimal":
+		if s, err = str("$numberDecimal"); err != nil {
+			return dst, 0, err
+		}
+		d, err := ParseDecimal128(s)
+		if err != nil {
+			return dst, 0, extJSONErrorf("invalid $numberDecimal %q", s)
+		}
+		return d.AppendBytes(dst), TypeDecimal128, nil
+	case "$binary":
+		data, ok := values["$binary"].stringMember("base64")
+		kind, ok2 := values["$binary"].stringMember("subType")
+		if !ok || !ok2 {
+			return dst, 0, extJSONErrorf("invalid $binary %s", values["$binary"])
+		}
+		return appendExtJSONBinary(dst, data, kind)
+	case "$binary,$type":
+		var data, kind string
+		if data, err = str("$binary"); err != nil {
+			return dst, 0, err
+		}
+		if kind, err = str("$type"); err != nil {
+			return dst, 0, err
+		}
+		return appendExtJSONBinary(dst, data, kind)
+	case "$uuid":
+		if s, err = str("$uuid"); err != nil {
+			return dst, 0, err
+		}
+		uuid, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+		if err != nil || len(uuid) != 16 || len(s) != 36 {
+			return dst, 0, extJSONErrorf("invalid $uuid %q", s)
+		}
+		dst = appendInt32(dst, 16)
+		return append(append(dst, 0x04), uuid...), TypeBinary, nil
+	case "$code":
+		if s, err = str("$code"); err != nil {
+			return dst, 0, err
+		}
+		return appendStringValue(dst, s), TypeJSCode, nil
+	case "$code,$scope":
+		if s, err = str("$code"); err != nil {
+			return dst, 0, err
+		}
+		dst, start := startDocument(dst)
+		dst = appendStringValue(dst, s)
+		var t ValueType
+		dst, t, err = appendExtJSONValue(dst, values["$scope"])
+		if err == nil && t != TypeDocument {
+			err = extJSONErrorf("invalid $scope %s", values["$scope"])
+		}
+		return setLength(dst, start), TypeJSCodeScope, err
+	case "$timestamp":
+		v := values["$timestamp"]
+		t, i := v.member("t"), v.member("i")
+		if t == nil || i == nil || t.kind != '0' || i.kind != '0' {
+			return dst, 0, extJSONErrorf("invalid $timestamp %s", v)
+		}
+		tv, err := strconv.ParseUint(t.s, 10, 32)
+		iv, err2 := strconv.ParseUint(i.s, 10, 32)
+		if err != nil || err2 != nil {
+			return dst, 0, extJSONErrorf("invalid $timestamp %s", v)
+		}
+		return appendInt64(dst, int64(tv<<32|iv)), TypeTimestamp, nil
+	case "$regularExpression":
+		pattern, ok := values["$regularExpression"].stringMember("pattern")
+		options, ok2 := values["$regularExpression"].stringMember("options")
+		if !ok || !ok2 {
+			return dst, 0, extJSONErrorf("invalid $regularExpression %s", values["$regularExpression"])
+		}
+		return appendExtJSONRegex(dst, pattern, options)
+	case "$options,$regex":
+		if values["$regex"].kind != '"' || values["$options"].kind != '"' {
+			// a $regex query operator, not a legacy regular expression
+			break
+		}
+		return appendExtJSONRegex(dst, values["$regex"].s, values["$options"].s)
+	case "$dbPointer":
+		ref, ok := values["$dbPointer"].stringMember("$ref")
+		id := values["$dbPointer"].member("$id")
+		if !ok || id == nil {
+			return dst, 0, extJSONErrorf("invalid $dbPointer %s", values["$dbPointer"])
+		}
+		dst = appendStringValue(dst, ref)
+		dst, t, err := appendExtJSONValue(dst, id)
+		if err == nil && t != TypeObjectId {
+			err = extJSONErrorf("invalid $dbPointer %s", values["$dbPointer"])
+		}
+		return dst, TypeDBPointer, err
+	case "$date":
+		ms, err := parseExtJSONDate(values["$date"])
+		return appendInt64(dst, ms), TypeDatetime, err
+	case "$minKey", "$maxKey", "$undefined":
+		t := map[string]ValueType{"$minKey": TypeMinKey, "$maxKey": TypeMaxKey, "$undefined": TypeUndefined}[keys[0]]
+		// the kind of the expected value followed by its literal
+		want := "01"
+		if t == TypeUndefined {
+			want = "t"
+		}
+		if v := values[keys[0]]; v.kind != want[0] || v.s != want[1:] {
+			return dst, 0, extJSONErrorf("invalid %s value %s", keys[0], values[keys[0]])
+		}
+		return dst, t, nil
+	default:
+		if extJSONWrappers[members[0].key] {
+			return dst, 0, extJSONErrorf("invalid %s wrapper with keys %v", members[0].key, keys)
+		}
+	}
+	dst, err = appendExtJSONMembers(dst, members)
+	return dst, TypeDocument, err
+}
+
+func parseExtJSONDouble(s string) (float64, error) {
+	switch s {
+	case "Infinity":
+		return math.Inf(1), nil
+	case "-Infinity":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.NaN(), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, extJSONErrorf("invalid $numberDouble %q", s)
+	}
+	return f, nil
+}
+
+func appendExtJSONBinary(dst []byte, data, kind string) ([]byte, ValueType, error) {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return dst, 0, extJSONErrorf("invalid $binary base64 %q", data)
+	}
+	k, err := strconv.ParseUint(kind, 16, 8)
+	if err != nil || len(kind) > 2 {
+		return dst, 0, extJSONErrorf("invalid $binary subType %q", kind)
+	}
+	if k == 0x02 {
+		dst = appendInt32(dst, int32(len(b)+4))
+		dst = appendInt32(append(dst, byte(k)), int32(len(b)))
+	} else {
+		dst = append(appendInt32(dst, int32(len(b))), byte(k))
+	}
+	return append(dst, b...), TypeBinary, nil
+}
+
+func appendExtJSONRegex(dst []byte, pattern, options string) ([]byte, ValueType, error) {
+	if strings.IndexByte(pattern, 0x00) >= 0 || strings.IndexByte(options, 0x00) >= 0 {
+		return dst, 0, extJSONErrorf("regular expression contains 0x00")
+	}
+	opts := []byte(options)
+	sort.Slice(opts, func(i, j int) bool { return opts[i] < opts[j] })
+	return appendCString(appendCString(dst, pattern), string(opts)), TypeRegex, nil
+}
+
+func parseExtJSONDate(v *extJSONValue) (ms int64, err error) {
+	switch v.kind {
+	case '{':
+		s, ok := v.stringMember("$numberLong")
+		if !ok {
+			return 0, extJSONErrorf("invalid $date %s", v)
+		}
+		if ms, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return 0, extJSONErrorf("invalid $date %s", v)
+		}
+		return
+	case '"':
+		t, err := time.Parse(time.RFC3339Nano, v.s)
+		if err != nil {
+			return 0, extJSONErrorf("invalid $date %q", v.s)
+		}
+		return t.Unix()*1e3 + int64(t.Nanosecond()/1e6), nil
+	case '0':
+		if ms, err = strconv.ParseInt(v.s, 10, 64); err == nil {
+			return
+		}
+	}
+	return 0, extJSONErrorf("invalid $date %s", v)
+}
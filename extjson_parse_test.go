@@ -0,0 +1,91 @@
+package bsonex
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExtJSON(t *testing.T) {
+	b := extJSONTestDoc(t)
+	for _, mode := range []ExtJSONMode{ExtJSONCanonical, ExtJSONRelaxed} {
+		j, err := b.ToExtJSON(mode)
+		assert.NoError(t, err)
+		b2, err := ParseExtJSON(j)
+		assert.NoError(t, err, mode)
+		assert.NoError(t, b2.Validate())
+		j2, err := b2.ToExtJSON(mode)
+		assert.NoError(t, err)
+		assert.Equal(t, string(j), string(j2), mode)
+		if mode == ExtJSONCanonical {
+			assert.Equal(t, b, b2)
+		}
+	}
+}
+
+func TestParseExtJSONLegacy(t *testing.T) {
+	cases := map[string]string{
+		`{"a":{"$date":1356351330501}}`:                                        `{"a":{"$date":{"$numberLong":"1356351330501"}}}`,
+		`{"a":{"$date":"1969-12-31T23:59:59.999Z"}}`:                           `{"a":{"$date":{"$numberLong":"-1"}}}`,
+		`{"a":{"$regex":"^x","$options":"mi"}}`:                                `{"a":{"$regularExpression":{"pattern":"^x","options":"im"}}}`,
+		`{"a":{"$regex":{"$regularExpression":{"pattern":"x","options":""}}}}`: `{"a":{"$regex":{"$regularExpression":{"pattern":"x","options":""}}}}`,
+		`{"a":{"$binary":"AQI=","$type":"5"}}`:                                 `{"a":{"$binary":{"base64":"AQI=","subType":"05"}}}`,
+		`{"a":{"$uuid":"73ffd264-44b3-4c69-90e8-e7d1dfc035d4"}}`:               `{"a":{"$binary":{"base64":"c//SZESzTGmQ6OfR38A11A==","subType":"04"}}}`,
+		`{"a":[1,2147483648,1.5,-0.0]}`:                                        `{"a":[{"$numberInt":"1"},{"$numberLong":"2147483648"},{"$numberDouble":"1.5"},{"$numberDouble":"-0.0"}]}`,
+		`{"$gt":{"x":1}}`:                                                      `{"$gt":{"x":{"$numberInt":"1"}}}`,
+	}
+	for in, want := range cases {
+		b, err := ParseExtJSON([]byte(in))
+		assert.NoError(t, err, in)
+		j, err := b.ToExtJSON(ExtJSONCanonical)
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(j), in)
+	}
+}
+
+func TestParseExtJSONErrors(t *testing.T) {
+	for _, in := range []string{
+		``, `[]`, `1`, `{"a":1} x`, `{"a":{"$oid":"xx"}}`, `{"a":{"$numberInt":"1.5"}}`,
+		`{"a":{"$oid":"5f1d2c3b4a5968778695a4b3","b":1}}`, `{"a":{"b":{"$date":{}}}}`,
+		`{"a\u0000":1}`, `{"a":{"$binary":{"base64":"AQI="}}}`, `{"a":{"$minKey":2}}`,
+	} {
+		_, err := ParseExtJSON([]byte(in))
+		assert.Error(t, err, in)
+	}
+	_, err := ParseExtJSON([]byte(`{"a":{"b":{"$date":{}}}}`))
+	var e *ExtJSONError
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, []string{"a", "b"}, e.Path)
+}
+
+func TestExtJSONReader(t *testing.T) {
+	r := NewExtJSONReader(strings.NewReader("{\"i\":1}\n{\"i\":{\"$numberLong\":\"2\"}}\n\n{\"i\":3}\n"))
+	var sum int64
+	for {
+		b, err := r.ReadOne()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		sum += b.Lookup("i").Int64()
+	}
+	assert.Equal(t, int64(6), sum)
+}
+
+func TestParseExtJSONDeep(t *testing.T) {
+	const depth = 1000
+	in := strings.Repeat(`{"a":[`, depth) + `{"$numberLong":"1"}` + strings.Repeat(`]}`, depth)
+	b, err := ParseExtJSON([]byte(in))
+	assert.NoError(t, err)
+	assert.NoError(t, b.Validate())
+	assert.Equal(t, int64(1), b.Lookup(strings.Repeat("a.0.", depth-1)+"a.0").Int64())
+
+	_, err = ParseExtJSON([]byte(`{"a":[{"$timestamp":{"t":1,"i":-1}}]}`))
+	var e *ExtJSONError
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, []string{"a", "0"}, e.Path)
+	assert.Contains(t, e.Error(), `{"t":1,"i":-1}`)
+}
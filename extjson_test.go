@@ -0,0 +1,83 @@
+package bsonex
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	gbson "github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func extJSONTestDoc(t *testing.T) BSON {
+	oid := ObjectIdHex("5f1d2c3b4a5968778695a4b3")
+	dec, _ := gbson.ParseDecimal128("1.5E+10")
+	b, err := Marshal(gbson.D{
+		{Name: "double", Value: 1.0},
+		{Name: "inf", Value: math.Inf(-1)},
+		{Name: "str", Value: "a\"b\n<"},
+		{Name: "doc", Value: gbson.D{{Name: "x", Value: int32(1)}}},
+		{Name: "arr", Value: []interface{}{int64(2), "c"}},
+		{Name: "bin", Value: gbson.Binary{Kind: 0x80, Data: []byte{1, 2, 3}}},
+		{Name: "old", Value: gbson.Binary{Kind: 0x02, Data: []byte{0xff, 0xff}}},
+		{Name: "undef", Value: Undefined},
+		{Name: "oid", Value: oid},
+		{Name: "bool", Value: true},
+		{Name: "date", Value: time.Date(2012, 12, 24, 12, 15, 30, 501e6, time.UTC)},
+		{Name: "olddate", Value: time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Name: "null", Value: nil},
+		{Name: "regex", Value: RegEx{Pattern: "^a/", Options: "si"}},
+		{Name: "ptr", Value: DBPointer{Namespace: "db.c", Id: oid}},
+		{Name: "code", Value: JavaScript{Code: "f()"}},
+		{Name: "sym", Value: Symbol("s")},
+		{Name: "scope", Value: JavaScript{Code: "g()", Scope: gbson.D{{Name: "y", Value: int32(2)}}}},
+		{Name: "ts", Value: MongoTimestamp(5<<32 | 6)},
+		{Name: "dec", Value: dec},
+		{Name: "min", Value: MinKey},
+		{Name: "max", Value: MaxKey},
+	})
+	assert.NoError(t, err)
+	return b
+}
+
+func TestExtJSON(t *testing.T) {
+	b := extJSONTestDoc(t)
+	canonical := `{"double":{"$numberDouble":"1.0"},"inf":{"$numberDouble":"-Infinity"},` +
+		`"str":"a\"b\n<","doc":{"x":{"$numberInt":"1"}},"arr":[{"$numberLong":"2"},"c"],` +
+		`"bin":{"$binary":{"base64":"AQID","subType":"80"}},"old":{"$binary":{"base64":"//8=","subType":"02"}},` +
+		`"undef":{"$undefined":true},"oid":{"$oid":"5f1d2c3b4a5968778695a4b3"},"bool":true,` +
+		`"date":{"$date":{"$numberLong":"1356351330501"}},"olddate":{"$date":{"$numberLong":"-315619200000"}},` +
+		`"null":null,"regex":{"$regularExpression":{"pattern":"^a/","options":"is"}},` +
+		`"ptr":{"$dbPointer":{"$ref":"db.c","$id":{"$oid":"5f1d2c3b4a5968778695a4b3"}}},` +
+		`"code":{"$code":"f()"},"sym":{"$symbol":"s"},"scope":{"$code":"g()","$scope":{"y":{"$numberInt":"2"}}},` +
+		`"ts":{"$timestamp":{"t":5,"i":6}},"dec":{"$numberDecimal":"1.5E+10"},"min":{"$minKey":1},"max":{"$maxKey":1}}`
+	j, err := BSON(b).ToExtJSON(ExtJSONCanonical)
+	assert.NoError(t, err)
+	assert.Equal(t, canonical, string(j))
+
+	relaxed := `{"double":1.0,"inf":{"$numberDouble":"-Infinity"},` +
+		`"str":"a\"b\n<","doc":{"x":1},"arr":[2,"c"],` +
+		`"bin":{"$binary":{"base64":"AQID","subType":"80"}},"old":{"$binary":{"base64":"//8=","subType":"02"}},` +
+		`"undef":{"$undefined":true},"oid":{"$oid":"5f1d2c3b4a5968778695a4b3"},"bool":true,` +
+		`"date":{"$date":"2012-12-24T12:15:30.501Z"},"olddate":{"$date":{"$numberLong":"-315619200000"}},` +
+		`"null":null,"regex":{"$regularExpression":{"pattern":"^a/","options":"is"}},` +
+		`"ptr":{"$dbPointer":{"$ref":"db.c","$id":{"$oid":"5f1d2c3b4a5968778695a4b3"}}},` +
+		`"code":{"$code":"f()"},"sym":{"$symbol":"s"},"scope":{"$code":"g()","$scope":{"y":2}},` +
+		`"ts":{"$timestamp":{"t":5,"i":6}},"dec":{"$numberDecimal":"1.5E+10"},"min":{"$minKey":1},"max":{"$maxKey":1}}`
+	j, err = BSON(b).ToExtJSON(ExtJSONRelaxed)
+	assert.NoError(t, err)
+	assert.Equal(t, relaxed, string(j))
+
+	j, err = BSON(b).Lookup("doc").ToExtJSON(ExtJSONCanonical)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"x":{"$numberInt":"1"}}`, string(j))
+}
+
+func TestFormatDouble(t *testing.T) {
+	for f, s := range map[float64]string{
+		0: "0.0", -1: "-1.0", 1.5: "1.5", 1e21: "1E+21", 1.0001220703125: "1.0001220703125",
+		math.MaxFloat64: "1.7976931348623157E+308", math.NaN(): "NaN",
+	} {
+		assert.Equal(t, s, formatDouble(f))
+	}
+}
@@ -0,0 +1,122 @@
+package bsonex
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// structField describes how a struct field maps to a document key, following
+// the `bson:"name,omitempty,minsize,inline"` tag conventions of mgo.
+type structField struct {
+	name      string
+	index     []int
+	typ       reflect.Type
+	omitEmpty bool
+	minSize   bool
+}
+
+type structFields struct {
+	list      []structField
+	byName    map[string]int
+	inlineMap []int // index of the ,inline map field, nil if there is none
+}
+
+var structFieldsCache sync.Map // map[reflect.Type]*structFields
+
+// cachedStructFields returns the field plan of the struct type t.
+func cachedStructFields(t reflect.Type) (*structFields, error) {
+	if f, ok := structFieldsCache.Load(t); ok {
+		return f.(*structFields), nil
+	}
+	f, err := typeStructFields(t)
+	if err != nil {
+		return nil, err
+	}
+	structFieldsCache.Store(t, f)
+	return f, nil
+}
+
+func typeStructFields(t reflect.Type) (*structFields, error) {
+	sf := &structFields{byName: map[string]int{}}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("bson")
+		if tag == "" && !strings.Contains(string(field.Tag), ":") {
+			tag = string(field.Tag)
+		}
+		if tag == "-" {
+			continue
+		}
+		f := structField{index: []int{i}, typ: field.Type}
+		inline := false
+		if parts := strings.Split(tag, ","); len(parts) > 1 {
+			for _, flag := range parts[1:] {
+				switch flag {
+				case "omitempty":
+					f.omitEmpty = true
+				case "minsize":
+					f.minSize = true
+				case "inline":
+					inline = true
+				default:
+					return nil, fmt.Errorf("bsonex: unsupported flag %q in tag %q of type %s", flag, tag, t)
+				}
+			}
+			tag = parts[0]
+		}
+		if field.PkgPath != "" && !(inline && field.Anonymous) {
+			continue // unexported
+		}
+		if inline {
+			switch field.Type.Kind() {
+			case reflect.Map:
+				if sf.inlineMap != nil {
+					return nil, errors.New("bsonex: multiple ,inline maps in struct " + t.String())
+				}
+				if field.Type.Key().Kind() != reflect.String {
+					return nil, errors.New("bsonex: ,inline map must have string keys in struct " + t.String())
+				}
+				sf.inlineMap = f.index
+			case reflect.Struct:
+				inner, err := cachedStructFields(field.Type)
+				if err != nil {
+					return nil, err
+				}
+				for _, in := range inner.list {
+					in.index = append([]int{i}, in.index...)
+					if err := sf.add(t, in); err != nil {
+						return nil, err
+					}
+				}
+				if inner.inlineMap != nil {
+					if sf.inlineMap != nil {
+						return nil, errors.New("bsonex: multiple ,inline maps in struct " + t.String())
+					}
+					sf.inlineMap = append([]int{i}, inner.inlineMap...)
+				}
+			default:
+				return nil, errors.New("bsonex: ,inline needs a struct value or map field in struct " + t.String())
+			}
+			continue
+		}
+		if f.name = tag; tag == "" {
+			f.name = strings.ToLower(field.Name)
+		}
+		if err := sf.add(t, f); err != nil {
+			return nil, err
+		}
+	}
+	return sf, nil
+}
+
+func (sf *structFields) add(t reflect.Type, f structField) error {
+	if _, ok := sf.byName[f.name]; ok {
+		return fmt.Errorf("bsonex: duplicated key %q in struct %s", f.name, t)
+	}
+	sf.byName[f.name] = len(sf.list)
+	sf.list = append(sf.list, f)
+	return nil
+}
@@ -0,0 +1,790 @@
+package bsonex
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FilterError reports an invalid query document. Path holds the keys leading
+// to the offending operator.
+type FilterError struct {
+	Path []string
+	Msg  string
+}
+
+func (e *FilterError) Error() string {
+	if len(e.Path) == 0 {
+		return "bsonex: filter: " + e.Msg
+	}
+	return "bsonex: filter: " + e.Msg + " at key " + strconv.Quote(strings.Join(e.Path, "."))
+}
+
+func filterErrorf(format string, a ...interface{}) error {
+	return &FilterError{Msg: fmt.Sprintf(format, a...)}
+}
+
+// withFilterKey prepends key to the path of a FilterError.
+func withFilterKey(err error, key string) error {
+	if e, ok := err.(*FilterError); ok {
+		e.Path = append([]string{key}, e.Path...)
+	}
+	return err
+}
+
+// Filter is a compiled MongoDB query document. It is evaluated directly on
+// raw documents without unmarshalling them. A Filter is safe for concurrent
+// use.
+//
+// Supported operators are $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin,
+// $exists, $type, $regex with $options, $not, $elemMatch, $size, $all and
+// $mod on fields, and $and, $or and $nor on documents. Paths are dotted and
+// descend into arrays like in MongoDB.
+type Filter struct {
+	query        BSON
+	root         docMatcher
+	searchValues []toSearchValue
+}
+
+// NewFilter compiles query. The query is copied, so it may be reused after
+// NewFilter returns.
+func NewFilter(query BSON) (*Filter, error) {
+	query = append(BSON(nil), query...)
+	if _, err := query.elements(); err != nil {
+		return nil, err
+	}
+	root, err := compileQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{query: query, root: root, searchValues: appendSearchValues(nil, query)}, nil
+}
+
+// Query returns the query document the filter was compiled from.
+func (f *Filter) Query() BSON {
+	return f.query
+}
+
+// SearchValues returns values that every matching document contains. They
+// can be checked with FastContains to skip documents before calling Match.
+func (f *Filter) SearchValues() []toSearchValue {
+	return f.searchValues
+}
+
+// Match reports whether b matches the filter. Malformed parts of b are
+// treated as missing.
+func (f *Filter) Match(b BSON) bool {
+	return f.root.matchDocument(b)
+}
+
+// appendSearchValues collects the equality literals of q that must appear
+// byte for byte in a matching document. Numbers are left out because they
+// match across numeric types, documents and arrays because they may contain
+// numbers.
+func appendSearchValues(dst []toSearchValue, q BSON) []toSearchValue {
+	it := q.Elements()
+	for it.Next() {
+		key := string(it.key)
+		switch {
+		case key == "$and" && it.val.valueType == TypeArray:
+			sub := BSON(it.val.valueData).Elements()
+			for sub.Next() {
+				if sub.val.valueType == TypeDocument {
+					dst = appendSearchValues(dst, sub.val.valueData)
+				}
+			}
+		case strings.HasPrefix(key, "$"):
+		case isOperatorDocument(it.val):
+			ops := BSON(it.val.valueData).Elements()
+			for ops.Next() {
+				switch string(ops.key) {
+				case "$eq":
+					dst = appendSearchValue(dst, ops.val)
+				case "$all":
+					if ops.val.valueType != TypeArray {
+						break
+					}
+					all := BSON(ops.val.valueData).Elements()
+					for all.Next() {
+						dst = appendSearchValue(dst, all.val)
+					}
+				}
+			}
+		default:
+			dst = appendSearchValue(dst, it.val)
+		}
+	}
+	return dst
+}
+
+func appendSearchValue(dst []toSearchValue, v Value) []toSearchValue {
+	switch v.valueType {
+	case TypeString, TypeSymbol:
+		if s := stringData(v); validateString(v.valueData) == nil && len(s) > 0 {
+			return append(dst, toSearchValue{s})
+		}
+	case TypeObjectId, TypeDatetime:
+		return append(dst, toSearchValue{v.valueData})
+	case TypeBinary:
+		if bin, err := v.BinaryErr(); err == nil && len(bin.Data) > 0 {
+			return append(dst, toSearchValue{bin.Data})
+		}
+	}
+	return dst
+}
+
+// docMatcher matches a whole document.
+type docMatcher interface {
+	matchDocument(doc BSON) bool
+}
+
+// valuesMatcher matches the values found at a field path, see lookupAll.
+type valuesMatcher interface {
+	matchValues(vals []Value) bool
+}
+
+type andMatcher []docMatcher
+
+func (m andMatcher) matchDocument(doc BSON) bool {
+	for _, sub := range m {
+		if !sub.matchDocument(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+type orMatcher []docMatcher
+
+func (m orMatcher) matchDocument(doc BSON) bool {
+	for _, sub := range m {
+		if sub.matchDocument(doc) {
+			return true
+		}
+	}
+	return false
+}
+
+type norMatcher []docMatcher
+
+func (m norMatcher) matchDocument(doc BSON) bool {
+	return !orMatcher(m).matchDocument(doc)
+}
+
+type fieldMatcher struct {
+	path []string
+	m    valuesMatcher
+}
+
+func (m *fieldMatcher) matchDocument(doc BSON) bool {
+	var buf [4]Value
+	vals, _ := lookupAll(buf[:0], Value{TypeDocument, doc}, m.path, true)
+	return m.m.matchValues(vals)
+}
+
+// matchAny reports whether pred holds for one of vals or, if it is an array,
+// for one of its elements.
+func matchAny(vals []Value, pred func(v Value) bool) bool {
+	for _, v := range vals {
+		if v.IsEmpty() {
+			continue
+		}
+		if pred(v) {
+			return true
+		}
+		if v.valueType == TypeArray {
+			it := BSON(v.valueData).Elements()
+			for it.Next() {
+				if pred(it.val) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func hasMissing(vals []Value) bool {
+	for _, v := range vals {
+		if v.IsEmpty() {
+			return true
+		}
+	}
+	return false
+}
+
+func compileQuery(q BSON) (andMatcher, error) {
+	var ms andMatcher
+	it := q.Elements()
+	for it.Next() {
+		key := string(it.key)
+		var m docMatcher
+		var err error
+		if strings.HasPrefix(key, "$") {
+			m, err = compileLogical(key, it.val)
+		} else {
+			m, err = compileField(key, it.val)
+		}
+		if err != nil {
+			return nil, withFilterKey(err, key)
+		}
+		if m != nil {
+			ms = append(ms, m)
+		}
+	}
+	return ms, it.err
+}
+
+func compileLogical(op string, v Value) (docMatcher, error) {
+	if op == "$comment" {
+		return nil, nil
+	}
+	if op != "$and" && op != "$or" && op != "$nor" {
+		return nil, filterErrorf("unknown top level operator %s", op)
+	}
+	if v.valueType != TypeArray {
+		return nil, filterErrorf("%s needs an array", op)
+	}
+	var subs []docMatcher
+	it := BSON(v.valueData).Elements()
+	for it.Next() {
+		if it.val.valueType != TypeDocument {
+			return nil, filterErrorf("%s entries must be documents", op)
+		}
+		m, err := compileQuery(it.val.valueData)
+		if err != nil {
+			return nil, withFilterKey(err, string(it.key))
+		}
+		subs = append(subs, m)
+	}
+	if it.err != nil {
+		return nil, it.err
+	}
+	if len(subs) == 0 {
+		return nil, filterErrorf("%s needs a non-empty array", op)
+	}
+	switch op {
+	case "$and":
+		return andMatcher(subs), nil
+	case "$or":
+		return orMatcher(subs), nil
+	}
+	return norMatcher(subs), nil
+}
+
+func compileField(path string, v Value) (docMatcher, error) {
+	var m valuesMatcher
+	var err error
+	switch {
+	case isOperatorDocument(v):
+		m, err = compileOperators(v.valueData)
+	case v.valueType == TypeRegex:
+		m, err = newRegexMatcher(v, "")
+	default:
+		m = &eqMatcher{v}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fieldMatcher{path: strings.Split(path, "."), m: m}, nil
+}
+
+// isOperatorDocument reports whether v is a document whose first key is an
+// operator.
+func isOperatorDocument(v Value) bool {
+	if v.valueType != TypeDocument {
+		return false
+	}
+	it := BSON(v.valueData).Elements()
+	return it.Next() && len(it.key) > 0 && it.key[0] == '$'
+}
+
+// opsMatcher matches if all its operators match.
+type opsMatcher []valuesMatcher
+
+func (m opsMatcher) matchValues(vals []Value) bool {
+	for _, sub := range m {
+		if !sub.matchValues(vals) {
+			return false
+		}
+	}
+	return true
+}
+
+func compileOperators(ops BSON) (opsMatcher, error) {
+	options, err := ops.lookupOne("$options")
+	if err != nil {
+		return nil, err
+	}
+	if !options.IsEmpty() {
+		regex, err := ops.lookupOne("$regex")
+		if err != nil {
+			return nil, err
+		}
+		if regex.IsEmpty() {
+			return nil, withFilterKey(filterErrorf("$options needs $regex"), "$options")
+		}
+	}
+	var ms opsMatcher
+	it := ops.Elements()
+	for it.Next() {
+		op := string(it.key)
+		m, err := compileOperator(op, it.val, options)
+		if err != nil {
+			return nil, withFilterKey(err, op)
+		}
+		if m != nil {
+			ms = append(ms, m)
+		}
+	}
+	return ms, it.err
+}
+
+func compileOperator(op string, v Value, options Value) (valuesMatcher, error) {
+	switch op {
+	case "$eq":
+		return &eqMatcher{v}, nil
+	case "$ne":
+		return &notMatcher{&eqMatcher{v}}, nil
+	case "$gt", "$gte", "$lt", "$lte":
+		return &cmpMatcher{op: op, val: v}, nil
+	case "$in", "$nin":
+		m, err := newInMatcher(v)
+		if err != nil || op == "$in" {
+			return m, err
+		}
+		return &notMatcher{m}, nil
+	case "$exists":
+		return &existsMatcher{truthy(v)}, nil
+	case "$type":
+		return newTypeMatcher(v)
+	case "$regex":
+		if options.IsEmpty() {
+			return newRegexMatcher(v, "")
+		}
+		opts, err := options.StrErr()
+		if err != nil {
+			return nil, filterErrorf("$options needs a string")
+		}
+		return newRegexMatcher(v, opts)
+	case "$options":
+		return nil, nil
+	case "$not":
+		switch {
+		case v.valueType == TypeRegex:
+			m, err := newRegexMatcher(v, "")
+			return &notMatcher{m}, err
+		case isOperatorDocument(v):
+			m, err := compileOperators(v.valueData)
+			return &notMatcher{m}, err
+		}
+		return nil, filterErrorf("$not needs a regex or a document of operators")
+	case "$elemMatch":
+		if v.valueType != TypeDocument {
+			return nil, filterErrorf("$elemMatch needs a document")
+		}
+		if isOperatorDocument(v) && !isLogicalOperatorDocument(v) {
+			m, err := compileOperators(v.valueData)
+			return &elemMatchMatcher{ops: m}, err
+		}
+		q, err := compileQuery(v.valueData)
+		return &elemMatchMatcher{query: q}, err
+	case "$size":
+		n, ok := numberInt64(v)
+		if !ok || n < 0 || compareValues(v, Value{TypeInt64, appendInt64(nil, n)}) != 0 {
+			return nil, filterErrorf("$size needs a non-negative integer")
+		}
+		return &sizeMatcher{int(n)}, nil
+	case "$all":
+		return newAllMatcher(v)
+	case "$mod":
+		return newModMatcher(v)
+	}
+	return nil, filterErrorf("unknown operator %s", op)
+}
+
+// isLogicalOperatorDocument reports whether v starts with $and, $or or $nor.
+func isLogicalOperatorDocument(v Value) bool {
+	it := BSON(v.valueData).Elements()
+	if !it.Next() {
+		return false
+	}
+	k := string(it.key)
+	return k == "$and" || k == "$or" || k == "$nor"
+}
+
+// truthy interprets v as a boolean the way MongoDB does for $exists.
+func truthy(v Value) bool {
+	switch {
+	case v.valueType == TypeBoolean:
+		b, _ := v.BoolErr()
+		return b
+	case isNumber(v.valueType):
+		f, _ := numberFloat64(v)
+		return f != 0
+	case v.valueType == TypeNull, v.valueType == TypeUndefined:
+		return false
+	}
+	return true
+}
+
+type eqMatcher struct {
+	val Value
+}
+
+func (m *eqMatcher) matchValues(vals []Value) bool {
+	if m.val.valueType == TypeNull && hasMissing(vals) {
+		return true
+	}
+	return matchAny(vals, m.equal)
+}
+
+func (m *eqMatcher) equal(v Value) bool {
+	return canonicalType(v.valueType) == canonicalType(m.val.valueType) && compareValues(v, m.val) == 0
+}
+
+type notMatcher struct {
+	m valuesMatcher
+}
+
+func (m *notMatcher) matchValues(vals []Value) bool {
+	return !m.m.matchValues(vals)
+}
+
+type cmpMatcher struct {
+	op  string
+	val Value
+}
+
+func (m *cmpMatcher) matchValues(vals []Value) bool {
+	if m.val.valueType == TypeNull && (m.op == "$gte" || m.op == "$lte") && hasMissing(vals) {
+		return true
+	}
+	return matchAny(vals, func(v Value) bool {
+		if canonicalType(v.valueType) != canonicalType(m.val.valueType) {
+			return false
+		}
+		c := compareValues(v, m.val)
+		switch m.op {
+		case "$gt":
+			return c > 0
+		case "$gte":
+			return c >= 0
+		case "$lt":
+			return c < 0
+		}
+		return c <= 0
+	})
+}
+
+type inMatcher struct {
+	eqs     []eqMatcher
+	regexes []*regexMatcher
+}
+
+func newInMatcher(v Value) (*inMatcher, error) {
+	if v.valueType != TypeArray {
+		return nil, filterErrorf("needs an array")
+	}
+	m := &inMatcher{}
+	it := BSON(v.valueData).Elements()
+	for it.Next() {
+		if it.val.valueType == TypeRegex {
+			re, err := newRegexMatcher(it.val, "")
+			if err != nil {
+				return nil, err
+			}
+			m.regexes = append(m.regexes, re)
+			continue
+		}
+		m.eqs = append(m.eqs, eqMatcher{it.val})
+	}
+	return m, it.err
+}
+
+func (m *inMatcher) matchValues(vals []Value) bool {
+	for i := range m.eqs {
+		if m.eqs[i].matchValues(vals) {
+			return true
+		}
+	}
+	for _, re := range m.regexes {
+		if re.matchValues(vals) {
+			return true
+		}
+	}
+	return false
+}
+
+type existsMatcher struct {
+	want bool
+}
+
+func (m *existsMatcher) matchValues(vals []Value) bool {
+	for _, v := range vals {
+		if !v.IsEmpty() {
+			return m.want
+		}
+	}
+	return !m.want
+}
+
+// typeAliases maps the $type string aliases to BSON types.
+var typeAliases = map[string]ValueType{
+	"double":              TypeDouble,
+	"string":              TypeString,
+	"object":              TypeDocument,
+	"array":               TypeArray,
+	"binData":             TypeBinary,
+	"undefined":           TypeUndefined,
+	"objectId":            TypeObjectId,
+	"bool":                TypeBoolean,
+	"date":                TypeDatetime,
+	"null":                TypeNull,
+	"regex":               TypeRegex,
+	"dbPointer":           TypeDBPointer,
+	"javascript":          TypeJSCode,
+	"symbol":              TypeSymbol,
+	"javascriptWithScope": TypeJSCodeScope,
+	"int":                 TypeInt32,
+	"timestamp":           TypeTimestamp,
+	"long":                TypeInt64,
+	"decimal":             TypeDecimal128,
+	"minKey":              TypeMinKey,
+	"maxKey":              TypeMaxKey,
+}
+
+type typeMatcher struct {
+	types  []ValueType
+	number bool
+}
+
+func newTypeMatcher(v Value) (*typeMatcher, error) {
+	m := &typeMatcher{}
+	add := func(v Value) error {
+		if v.valueType == TypeString {
+			s, err := v.StrErr()
+			if err != nil {
+				return err
+			}
+			if s == "number" {
+				m.number = true
+				return nil
+			}
+			t, ok := typeAliases[s]
+			if !ok {
+				return filterErrorf("unknown type %q", s)
+			}
+			m.types = append(m.types, t)
+			return nil
+		}
+		n, ok := numberInt64(v)
+		if !ok || (n != -1 && !isValidType(ValueType(n))) {
+			return filterErrorf("invalid type %s", v)
+		}
+		m.types = append(m.types, ValueType(n))
+		return nil
+	}
+	if v.valueType != TypeArray {
+		return m, add(v)
+	}
+	it := BSON(v.valueData).Elements()
+	for it.Next() {
+		if err := add(it.val); err != nil {
+			return nil, err
+		}
+	}
+	return m, it.err
+}
+
+func (m *typeMatcher) matchValues(vals []Value) bool {
+	return matchAny(vals, func(v Value) bool {
+		if m.number && isNumber(v.valueType) {
+			return true
+		}
+		for _, t := range m.types {
+			if v.valueType == t {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+type regexMatcher struct {
+	lit Value // the regex value given in the query, if any
+	re  *regexp.Regexp
+}
+
+// newRegexMatcher compiles a string or regex value. options overrides the
+// options of a regex value when set.
+func newRegexMatcher(v Value, options string) (*regexMatcher, error) {
+	m := &regexMatcher{}
+	var pattern string
+	switch v.valueType {
+	case TypeString:
+		pattern, _ = v.StrErr()
+	case TypeRegex:
+		r, err := v.RegexpErr()
+		if err != nil {
+			return nil, err
+		}
+		m.lit = v
+		pattern = r.Pattern
+		if options == "" {
+			options = r.Options
+		}
+	default:
+		return nil, filterErrorf("$regex needs a string or a regex")
+	}
+	flags := ""
+	for _, o := range options {
+		switch o {
+		case 'i', 'm', 's':
+			flags += string(o)
+		case 'u':
+		default:
+			return nil, filterErrorf("unsupported regex option %q", o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, filterErrorf("%v", err)
+	}
+	m.re = re
+	return m, nil
+}
+
+func (m *regexMatcher) matchValues(vals []Value) bool {
+	return matchAny(vals, func(v Value) bool {
+		switch v.valueType {
+		case TypeString, TypeSymbol:
+			return validateString(v.valueData) == nil && m.re.Match(stringData(v))
+		case TypeRegex:
+			return !m.lit.IsEmpty() && compareValues(v, m.lit) == 0
+		}
+		return false
+	})
+}
+
+type elemMatchMatcher struct {
+	ops   opsMatcher // set if the $elemMatch document holds operators
+	query andMatcher // set otherwise
+}
+
+func (m *elemMatchMatcher) matchValues(vals []Value) bool {
+	for _, v := range vals {
+		if v.valueType != TypeArray {
+			continue
+		}
+		it := BSON(v.valueData).Elements()
+		for it.Next() {
+			if m.matchElement(it.val) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchElement reports whether a single array element matches.
+func (m *elemMatchMatcher) matchElement(e Value) bool {
+	if m.ops != nil {
+		return m.ops.matchValues([]Value{e})
+	}
+	return e.valueType == TypeDocument && m.query.matchDocument(e.valueData)
+}
+
+type sizeMatcher struct {
+	n int
+}
+
+func (m *sizeMatcher) matchValues(vals []Value) bool {
+	for _, v := range vals {
+		if v.valueType != TypeArray {
+			continue
+		}
+		n := 0
+		it := BSON(v.valueData).Elements()
+		for it.Next() {
+			n++
+		}
+		if it.err == nil && n == m.n {
+			return true
+		}
+	}
+	return false
+}
+
+type allMatcher []valuesMatcher
+
+func newAllMatcher(v Value) (allMatcher, error) {
+	if v.valueType != TypeArray {
+		return nil, filterErrorf("$all needs an array")
+	}
+	var m allMatcher
+	it := BSON(v.valueData).Elements()
+	for it.Next() {
+		switch {
+		case it.val.valueType == TypeRegex:
+			re, err := newRegexMatcher(it.val, "")
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, re)
+		case isOperatorDocument(it.val):
+			ops, err := compileOperators(it.val.valueData)
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, ops)
+		default:
+			m = append(m, &eqMatcher{it.val})
+		}
+	}
+	return m, it.err
+}
+
+func (m allMatcher) matchValues(vals []Value) bool {
+	return len(m) > 0 && opsMatcher(m).matchValues(vals)
+}
+
+type modMatcher struct {
+	divisor, remainder int64
+}
+
+func newModMatcher(v Value) (*modMatcher, error) {
+	if v.valueType != TypeArray {
+		return nil, filterErrorf("$mod needs an array [divisor, remainder]")
+	}
+	arr, err := BSON(v.valueData).ToValueArrayErr()
+	if err != nil {
+		return nil, err
+	}
+	if len(arr) != 2 {
+		return nil, filterErrorf("$mod needs an array [divisor, remainder]")
+	}
+	d, okD := numberInt64(arr[0])
+	r, okR := numberInt64(arr[1])
+	if !okD || !okR || !isNumber(arr[0].valueType) || !isNumber(arr[1].valueType) {
+		return nil, filterErrorf("$mod needs numbers")
+	}
+	if d == 0 {
+		return nil, filterErrorf("$mod divisor is 0")
+	}
+	return &modMatcher{d, r}, nil
+}
+
+func (m *modMatcher) matchValues(vals []Value) bool {
+	return matchAny(vals, func(v Value) bool {
+		if !isNumber(v.valueType) {
+			return false
+		}
+		i, ok := numberInt64(v)
+		return ok && i%m.divisor == m.remainder
+	})
+}
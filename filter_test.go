@@ -0,0 +1,175 @@
+package bsonex
+
+import (
+	"testing"
+
+	gbson "github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter(t *testing.T) {
+	doc, err := ParseExtJSON([]byte(`{
+		"name": "alice",
+		"age": 31,
+		"score": 4.5,
+		"big": {"$numberLong": "10000000000"},
+		"huge": {"$numberLong": "9007199254740993"},
+		"dec": {"$numberDecimal": "2.5"},
+		"tags": ["x", "y", "z"],
+		"nested": {"a": {"b": 1}, "arr": [1, 5, 9]},
+		"items": [{"sku": "a1", "qty": 2}, {"sku": "b2", "qty": 10}],
+		"matrix": [[1, 2], [3, 4]],
+		"nil": null,
+		"ok": true,
+		"id": {"$oid": "5f1d2c3b4a5968778695a4b3"},
+		"t": {"$date": "2020-01-02T03:04:05Z"}
+	}`))
+	assert.NoError(t, err)
+
+	for _, c := range []struct {
+		query string
+		match bool
+	}{
+		{`{}`, true},
+		{`{"name": "alice"}`, true},
+		{`{"name": "bob"}`, false},
+		{`{"age": 31.0}`, true},
+		{`{"age": {"$numberLong": "31"}}`, true},
+		{`{"age": {"$eq": 31}}`, true},
+		{`{"age": {"$ne": 31}}`, false},
+		{`{"age": {"$ne": "31"}}`, true},
+		{`{"age": {"$gt": 30, "$lt": 32}}`, true},
+		{`{"age": {"$gte": 31.5}}`, false},
+		{`{"age": {"$lte": 31}}`, true},
+		{`{"age": {"$gt": "30"}}`, false},
+		{`{"big": {"$gt": 9999999999}}`, true},
+		{`{"huge": {"$gt": 9007199254740992.0}}`, true},
+		{`{"huge": 9007199254740992.0}`, false},
+		{`{"tags": {"$size": 3.0}}`, true},
+		{`{"dec": {"$gt": 2, "$lt": 3}}`, true},
+		{`{"score": {"$in": [1, 4.5]}}`, true},
+		{`{"score": {"$nin": [1, 4.5]}}`, false},
+		{`{"name": {"$in": [{"$regularExpression": {"pattern": "^al", "options": ""}}]}}`, true},
+		{`{"missing": {"$exists": false}}`, true},
+		{`{"nil": {"$exists": true}}`, true},
+		{`{"missing": null}`, true},
+		{`{"nil": null}`, true},
+		{`{"name": null}`, false},
+		{`{"missing": {"$ne": null}}`, false},
+		{`{"age": {"$type": "int"}}`, true},
+		{`{"age": {"$type": "number"}}`, true},
+		{`{"age": {"$type": ["string", 1]}}`, false},
+		{`{"tags": {"$type": "array"}}`, true},
+		{`{"name": {"$regex": "^ALI", "$options": "i"}}`, true},
+		{`{"name": {"$regex": "^ALI"}}`, false},
+		{`{"name": {"$regularExpression": {"pattern": "ice$", "options": ""}}}`, true},
+		{`{"name": {"$not": {"$regularExpression": {"pattern": "ice$", "options": ""}}}}`, false},
+		{`{"age": {"$not": {"$gt": 40}}}`, true},
+		{`{"tags": "y"}`, true},
+		{`{"tags": ["x", "y", "z"]}`, true},
+		{`{"tags": ["x", "y"]}`, false},
+		{`{"tags.1": "y"}`, true},
+		{`{"tags": {"$all": ["z", "x"]}}`, true},
+		{`{"tags": {"$all": ["z", "w"]}}`, false},
+		{`{"tags": {"$size": 3}}`, true},
+		{`{"tags": {"$size": 2}}`, false},
+		{`{"nested.a.b": 1}`, true},
+		{`{"nested.arr": {"$gt": 8}}`, true},
+		{`{"nested.arr": {"$gt": 5, "$lt": 9}}`, true},
+		{`{"nested.arr": {"$elemMatch": {"$gt": 5, "$lt": 9}}}`, false},
+		{`{"nested.arr": {"$elemMatch": {"$gt": 4, "$lt": 6}}}`, true},
+		{`{"nested": {"a": {"b": 1}}}`, false},
+		{`{"items.sku": "b2"}`, true},
+		{`{"items.qty": {"$gt": 5}}`, true},
+		{`{"items.0.sku": "a1"}`, true},
+		{`{"items": {"$elemMatch": {"sku": "a1", "qty": {"$gt": 5}}}}`, false},
+		{`{"items": {"$elemMatch": {"sku": "b2", "qty": {"$gt": 5}}}}`, true},
+		{`{"items": {"$elemMatch": {"$or": [{"sku": "x"}, {"qty": 2}]}}}`, true},
+		{`{"matrix": [1, 2]}`, true},
+		{`{"matrix.1": [3, 4]}`, true},
+		{`{"age": {"$mod": [10, 1]}}`, true},
+		{`{"age": {"$mod": [10, 2]}}`, false},
+		{`{"ok": true, "id": {"$oid": "5f1d2c3b4a5968778695a4b3"}}`, true},
+		{`{"t": {"$gt": {"$date": "2020-01-01T00:00:00Z"}}}`, true},
+		{`{"$and": [{"age": 31}, {"name": "alice"}]}`, true},
+		{`{"$or": [{"age": 1}, {"name": "alice"}]}`, true},
+		{`{"$or": [{"age": 1}, {"name": "bob"}]}`, false},
+		{`{"$nor": [{"age": 1}, {"name": "bob"}]}`, true},
+		{`{"$comment": "x", "age": 31}`, true},
+	} {
+		q, err := ParseExtJSON([]byte(c.query))
+		if !assert.NoError(t, err, c.query) {
+			continue
+		}
+		f, err := NewFilter(q)
+		if !assert.NoError(t, err, c.query) {
+			continue
+		}
+		assert.Equal(t, c.match, f.Match(doc), c.query)
+	}
+}
+
+func TestFilterError(t *testing.T) {
+	for _, query := range []string{
+		`{"$foo": 1}`,
+		`{"$or": []}`,
+		`{"$and": [1]}`,
+		`{"a": {"$foo": 1}}`,
+		`{"a": {"$in": 1}}`,
+		`{"a": {"$type": "nope"}}`,
+		`{"a": {"$regex": "("}}`,
+		`{"a": {"$regex": "a", "$options": "x"}}`,
+		`{"a": {"$mod": [0, 1]}}`,
+		`{"a": {"$size": -1}}`,
+		`{"a": {"$size": 2.5}}`,
+		`{"a": {"$size": {"$numberDecimal": "2.0000000000000000001"}}}`,
+		`{"a": {"$options": "i"}}`,
+		`{"a": {"$not": 1}}`,
+		`{"a": {"$elemMatch": 1}}`,
+	} {
+		q, err := ParseExtJSON([]byte(query))
+		assert.NoError(t, err, query)
+		_, err = NewFilter(q)
+		assert.IsType(t, &FilterError{}, err, query)
+	}
+
+	q, err := ParseExtJSON([]byte(`{"$or": [{"a": 1}, {"b": {"$gt": 1, "$bad": 1}}]}`))
+	assert.NoError(t, err)
+	_, err = NewFilter(q)
+	assert.Equal(t, []string{"$or", "1", "b", "$bad"}, err.(*FilterError).Path)
+}
+
+func BenchmarkFilter(b *testing.B) {
+	doc, _ := ParseExtJSON([]byte(`{"name": "alice", "age": 31, "tags": ["x", "y"], "items": [{"sku": "a1"}, {"sku": "b2"}]}`))
+	q, _ := ParseExtJSON([]byte(`{"age": {"$gt": 30}, "tags": "y", "items.sku": {"$in": ["b2", "c3"]}}`))
+	f, err := NewFilter(q)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if !f.Match(doc) {
+			b.Fatal("no match")
+		}
+	}
+}
+
+func TestFilterSearchValues(t *testing.T) {
+	q, err := ParseExtJSON([]byte(`{
+		"name": "alice",
+		"age": 31,
+		"tags": {"$all": ["x", "y"]},
+		"id": {"$eq": {"$oid": "5f1d2c3b4a5968778695a4b3"}},
+		"$and": [{"city": "paris"}],
+		"$or": [{"a": "no"}, {"b": "no"}],
+		"other": {"$ne": "no"}
+	}`))
+	assert.NoError(t, err)
+	f, err := NewFilter(q)
+	assert.NoError(t, err)
+	var got []string
+	for _, v := range f.SearchValues() {
+		got = append(got, string(v.b))
+	}
+	assert.Equal(t, []string{"alice", "x", "y", string(gbson.ObjectIdHex("5f1d2c3b4a5968778695a4b3")), "paris"}, got)
+}
@@ -4,8 +4,8 @@ go 1.18
 
 require (
 	github.com/globalsign/mgo v0.0.0-20181015135952-eeefdecb41b8
-	github.com/sbunce/bson v0.0.0-20181119052045-2aa5ebe749b2
 	github.com/stretchr/testify v1.5.1
+	go.mongodb.org/mongo-driver v1.17.6
 )
 
 require (
@@ -0,0 +1,82 @@
+package bsonex
+
+// Iterator walks the elements of a document or array in order without
+// allocating. Use it like:
+//
+//	it := b.Elements()
+//	for it.Next() {
+//		key, val := it.Key(), it.Value()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type Iterator struct {
+	elements BSON
+	off      int
+	key      []byte
+	val      Value
+	err      error
+}
+
+// Elements returns an iterator over the elements of b.
+func (b BSON) Elements() Iterator {
+	elements, err := b.elements()
+	return Iterator{elements: elements, off: 4, err: err}
+}
+
+// Elements returns an iterator over the elements of a document or array
+// value.
+func (v Value) Elements() Iterator {
+	d, err := v.DocumentErr()
+	if err != nil {
+		return Iterator{err: err}
+	}
+	return d.Elements()
+}
+
+// Next advances to the next element. It returns false at the end of the
+// document or when the document is malformed, see Err.
+func (it *Iterator) Next() bool {
+	if it.err != nil || len(it.elements) == 0 {
+		return false
+	}
+	key, val, next, err := readElement(it.elements)
+	if err != nil {
+		it.err = withOffset(err, it.off)
+		return false
+	}
+	it.off += len(it.elements) - len(next)
+	it.elements, it.key, it.val = next, key, val
+	return true
+}
+
+// Key returns the key of the current element. It points into the document
+// and must not be modified.
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the value of the current element.
+func (it *Iterator) Value() Value {
+	return it.val
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// valueOffset returns the offset of the current value in the document.
+func (it *Iterator) valueOffset() int {
+	return it.off - len(it.val.valueData)
+}
+
+// Range calls f for every element of b until f returns false.
+func (b BSON) Range(f func(key []byte, v Value) bool) error {
+	it := b.Elements()
+	for it.Next() {
+		if !f(it.key, it.val) {
+			break
+		}
+	}
+	return it.err
+}
@@ -0,0 +1,71 @@
+package bsonex
+
+import (
+	"errors"
+	"testing"
+
+	gbson "github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterator(t *testing.T) {
+	b, err := Marshal(gbson.D{{Name: "a", Value: 1}, {Name: "b", Value: "x"}, {Name: "c", Value: []int{1, 2}}})
+	assert.NoError(t, err)
+	bs := BSON(b)
+	var keys []string
+	it := bs.Elements()
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+
+	keys = nil
+	err = bs.Range(func(key []byte, v Value) bool {
+		keys = append(keys, string(key))
+		return v.Type() != TypeString
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, keys)
+
+	var sum int32
+	it = bs.Lookup("c").Elements()
+	for it.Next() {
+		sum += it.Value().Int32()
+	}
+	assert.Equal(t, int32(3), sum)
+
+	it = bs.Lookup("b").Elements()
+	assert.False(t, it.Next())
+	var te *TypeError
+	assert.True(t, errors.As(it.Err(), &te))
+
+	bad := append([]byte{}, b...)
+	bad[4+len("\x10a\x00")+4] = 0x42
+	err = BSON(bad).Range(func([]byte, Value) bool { return true })
+	var ite *InvalidTypeError
+	assert.True(t, errors.As(err, &ite), err)
+	assert.Equal(t, int64(11), ite.Offset)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		it := bs.Elements()
+		for it.Next() {
+			_ = it.Value()
+		}
+		_ = bs.Range(func(key []byte, v Value) bool { return true })
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+func BenchmarkIterator(b *testing.B) {
+	bs, err := Marshal(doc)
+	assert.NoError(b, err)
+	bsb := BSON(bs)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		it := bsb.Elements()
+		for it.Next() {
+			_ = it.Value()
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package bsonex
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+)
+
+// AppendJSON appends the plain JSON form of b to dst. Keys are written in
+// document order, values are formatted like encoding/json formats the result
+// of Value.Value().
+func (b BSON) AppendJSON(dst []byte) ([]byte, error) {
+	return appendJSONDocument(dst, b, false, Value.AppendJSON)
+}
+
+// AppendJSON appends the plain JSON form of v to dst, see BSON.AppendJSON.
+func (v Value) AppendJSON(dst []byte) ([]byte, error) {
+	switch v.valueType {
+	case TypeDouble:
+		f, err := v.Float64Err()
+		if err != nil {
+			return dst, err
+		}
+		return appendJSONFloat(dst, f)
+	case TypeString:
+		if err := validateString(v.valueData); err != nil {
+			return dst, err
+		}
+		return appendJSONString(dst, string(v.valueData[4:len(v.valueData)-1])), nil
+	case TypeDocument:
+		return appendJSONDocument(dst, v.valueData, false, Value.AppendJSON)
+	case TypeArray:
+		return appendJSONDocument(dst, v.valueData, true, Value.AppendJSON)
+	case TypeBinary:
+		bin, err := v.BinaryErr()
+		dst = appendBase64(append(dst, '"'), bin.Data)
+		return append(dst, '"'), err
+	case TypeUndefined:
+		return append(dst, "{}"...), nil
+	case TypeObjectId:
+		_, err := v.ObjidErr()
+		dst = appendHex(append(dst, '"'), v.valueData)
+		return append(dst, '"'), err
+	case TypeBoolean:
+		b, err := v.BoolErr()
+		return strconv.AppendBool(dst, b), err
+	case TypeDatetime:
+		t, err := v.TimeErr()
+		dst = append(dst, '"')
+		dst = t.AppendFormat(dst, time.RFC3339Nano)
+		return append(dst, '"'), err
+	case TypeNull:
+		return append(dst, "null"...), nil
+	case TypeRegex:
+		r, err := v.RegexpErr()
+		dst = append(dst, `{"Pattern":`...)
+		dst = appendJSONString(dst, r.Pattern)
+		dst = append(dst, `,"Options":`...)
+		return append(appendJSONString(dst, r.Options), '}'), err
+	case TypeDBPointer:
+		p, err := v.DBPointerErr()
+		dst = append(dst, `{"Namespace":`...)
+		dst = appendJSONString(dst, p.Namespace)
+		dst = appendHex(append(dst, `,"Id":"`...), []byte(p.Id))
+		return append(dst, `"}`...), err
+	case TypeJSCode:
+		code, err := v.JSCodeErr()
+		dst = append(dst, `{"Code":`...)
+		return append(appendJSONString(dst, code), `,"Scope":null}`...), err
+	case TypeSymbol:
+		s, err := v.SymbolErr()
+		return appendJSONString(dst, string(s)), err
+	case TypeJSCodeScope:
+		code, scope, err := v.JSCodeWithScopeErr()
+		if err != nil {
+			return dst, err
+		}
+		dst = append(dst, `{"Code":`...)
+		dst = appendJSONString(dst, code)
+		dst = append(dst, `,"Scope":`...)
+		dst, err = appendJSONDocument(dst, scope, false, Value.AppendJSON)
+		return append(dst, '}'), withOffset(err, 8+len(code)+1)
+	case TypeInt32:
+		i, err := v.Int32Err()
+		return strconv.AppendInt(dst, int64(i), 10), err
+	case TypeTimestamp, TypeInt64:
+		i, err := v.Int64Err()
+		return strconv.AppendInt(dst, i, 10), err
+	case TypeDecimal128:
+		d, err := v.Decimal128Err()
+		return appendJSONString(dst, d.String()), err
+	case TypeMinKey:
+		return strconv.AppendInt(dst, math.MinInt64, 10), nil
+	case TypeMaxKey:
+		return strconv.AppendInt(dst, math.MaxInt64, 10), nil
+	default:
+		return dst, &InvalidTypeError{Type: v.valueType}
+	}
+}
+
+// appendJSONDocument appends b as a JSON object, or array if isArray is set,
+// using appendValue to format the values.
+func appendJSONDocument(dst []byte, b BSON, isArray bool,
+	appendValue func(Value, []byte) ([]byte, error)) ([]byte, error) {
+	open, end := byte('{'), byte('}')
+	if isArray {
+		open, end = '[', ']'
+	}
+	dst = append(dst, open)
+	it := b.Elements()
+	for first := true; it.Next(); first = false {
+		if !first {
+			dst = append(dst, ',')
+		}
+		if !isArray {
+			dst = append(appendJSONString(dst, string(it.key)), ':')
+		}
+		var err error
+		dst, err = appendValue(it.val, dst)
+		if err != nil {
+			return dst, withOffset(withKey(err, it.key), it.valueOffset())
+		}
+	}
+	return append(dst, end), it.err
+}
+
+// appendJSONFloat formats f like encoding/json does.
+func appendJSONFloat(dst []byte, f float64) ([]byte, error) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return dst, &json.UnsupportedValueError{Str: strconv.FormatFloat(f, 'g', -1, 64)}
+	}
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	start := len(dst)
+	dst = strconv.AppendFloat(dst, f, format, -1, 64)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		if n := len(dst) - start; n >= 4 && dst[len(dst)-4] == 'e' && dst[len(dst)-3] == '-' && dst[len(dst)-2] == '0' {
+			dst[len(dst)-2] = dst[len(dst)-1]
+			dst = dst[:len(dst)-1]
+		}
+	}
+	return dst, nil
+}
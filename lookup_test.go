@@ -0,0 +1,179 @@
+package bsonex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func lookupTestDoc(t testing.TB) BSON {
+	doc, err := ParseExtJSON([]byte(`{
+		"name": "order",
+		"items": [
+			{"price": 1, "tags": [{"k": "a"}, {"k": "b"}]},
+			{"price": 2, "tags": []},
+			{"other": 3},
+			4
+		],
+		"matrix": [[{"x": 1}], [{"x": 2}]],
+		"obj": {"0": "zero", "arr": [10, 20]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestLookupAll(t *testing.T) {
+	doc := lookupTestDoc(t)
+	toJSON := func(vals []Value) (s []string) {
+		for _, v := range vals {
+			s = append(s, v.String())
+		}
+		return s
+	}
+	for _, c := range []struct {
+		path string
+		want []string
+	}{
+		{"name", []string{`"order"`}},
+		{"missing", nil},
+		{"", nil},
+		{"items.price", []string{"1", "2"}},
+		{"items.0.price", []string{"1"}},
+		{"items.3", []string{"4"}},
+		{"items.tags.k", []string{`"a"`, `"b"`}},
+		{"items.tags", []string{`[{"k":"a"},{"k":"b"}]`, `[]`}},
+		{"items.tags.1.k", []string{`"b"`}},
+		{"matrix.x", nil},
+		{"matrix.1.0.x", []string{"2"}},
+		{"obj.0", []string{`"zero"`}},
+		{"obj.arr.1", []string{"20"}},
+		{"obj.arr.x", nil},
+		{"name.x", nil},
+	} {
+		assert.Equal(t, c.want, toJSON(doc.LookupAll(c.path)), c.path)
+	}
+
+	// Lookup keeps matching literal keys only
+	assert.True(t, doc.Lookup("items.price").IsEmpty())
+
+	_, err := BSON(doc[:len(doc)-1]).LookupAllErr("items.price")
+	assert.Error(t, err)
+	assert.Panics(t, func() { BSON(doc[:len(doc)-1]).LookupAll("name") })
+}
+
+func TestLookupPath(t *testing.T) {
+	doc, err := ParseExtJSON([]byte(`{"a": {"b.c": {"": [1, {"d/e~f": 2}]}}, "x.y": 3}`))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), doc.LookupPath([]string{"x.y"}).Int32())
+	assert.Equal(t, int32(2), doc.LookupPath([]string{"a", "b.c", "", "1", "d/e~f"}).Int32())
+	assert.True(t, doc.LookupPath(nil).IsEmpty())
+	assert.True(t, doc.LookupPath([]string{"a", "b"}).IsEmpty())
+	assert.True(t, doc.Lookup("x.y").IsEmpty())
+
+	for _, c := range []struct {
+		pointer string
+		want    []string
+	}{
+		{"", nil},
+		{"/", []string{""}},
+		{"/x.y", []string{"x.y"}},
+		{"/a/b.c//1/d~1e~0f", []string{"a", "b.c", "", "1", "d/e~f"}},
+	} {
+		keys, err := ParseJSONPointer(c.pointer)
+		assert.NoError(t, err, c.pointer)
+		assert.Equal(t, c.want, keys, c.pointer)
+	}
+	keys, _ := ParseJSONPointer("/a/b.c//1/d~1e~0f")
+	assert.Equal(t, int32(2), doc.LookupPath(keys).Int32())
+	for _, pointer := range []string{"a", "/a~", "/a~2"} {
+		_, err := ParseJSONPointer(pointer)
+		assert.IsType(t, &PathSyntaxError{}, err, pointer)
+	}
+
+	for _, c := range []struct {
+		path string
+		want []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a.b", []string{"a", "b"}},
+		{`["x.y"]`, []string{"x.y"}},
+		{`a["b.c"][""][1]["d/e~f"]`, []string{"a", "b.c", "", "1", "d/e~f"}},
+		{`a["b\"]"].c[0].d`, []string{"a", `b"]`, "c", "0", "d"}},
+	} {
+		keys, err := ParseBracketPath(c.path)
+		assert.NoError(t, err, c.path)
+		assert.Equal(t, c.want, keys, c.path)
+	}
+	keys, _ = ParseBracketPath(`a["b.c"][""][1]["d/e~f"]`)
+	assert.Equal(t, int32(2), doc.LookupPath(keys).Int32())
+	for _, path := range []string{"a.", ".a", "a..b", "a[", `a["b`, `a["b"`, "a[x]", "a[01]", "a[1", `a["b"]c`} {
+		_, err := ParseBracketPath(path)
+		assert.IsType(t, &PathSyntaxError{}, err, path)
+	}
+}
+
+func TestCompilePath(t *testing.T) {
+	doc := lookupTestDoc(t)
+	for _, path := range []string{"", "name", "missing", "items.0.price", "items.1.tags", "obj.arr.1", "name.x", "items.price"} {
+		p := CompilePath(path)
+		assert.Equal(t, path, p.String())
+		assert.Equal(t, doc.Lookup(path), p.Get(doc), path)
+	}
+	assert.Equal(t, "zero", CompileKeys([]string{"obj", "0"}).Get(doc).Str())
+	_, err := CompilePath("name").GetErr(doc[:len(doc)-1])
+	assert.Error(t, err)
+}
+
+func TestMultiPath(t *testing.T) {
+	doc := lookupTestDoc(t)
+	paths := []string{"obj.arr.1", "name", "missing", "items.0.price", "obj.0", "name", "", "items.0.tags.1.k", "obj.arr"}
+	m := NewMultiPath(paths...)
+	vals := m.Get(doc)
+	assert.Len(t, vals, len(paths))
+	for i, path := range paths {
+		assert.Equal(t, doc.Lookup(path), vals[i], path)
+	}
+
+	// values are appended so the slice can be reused
+	vals, err := m.AppendValues(vals[:0], doc)
+	assert.NoError(t, err)
+	assert.Len(t, vals, len(paths))
+
+	dup, err := ParseExtJSON([]byte(`{"a": 1, "a": 2}`))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), NewMultiPath("a").Get(dup)[0].Int32())
+
+	_, err = m.GetErr(doc[:len(doc)-1])
+	assert.Error(t, err)
+}
+
+func BenchmarkLookupPath(b *testing.B) {
+	bs, err := Marshal(doc)
+	assert.NoError(b, err)
+	bsb := BSON(bs)
+	pf, pi, ps := CompilePath("float64"), CompilePath("int64"), CompilePath("string")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = pf.Get(bsb).Float64()
+		_ = pi.Get(bsb).Int64()
+		_ = ps.Get(bsb).Str()
+	}
+}
+
+func BenchmarkMultiPath(b *testing.B) {
+	bs, err := Marshal(doc)
+	assert.NoError(b, err)
+	bsb := BSON(bs)
+	m := NewMultiPath("float64", "int64", "string")
+	var vals []Value
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		vals, _ = m.AppendValues(vals[:0], bsb)
+		_ = vals[0].Float64()
+		_ = vals[1].Int64()
+		_ = vals[2].Str()
+	}
+}
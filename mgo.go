@@ -0,0 +1,366 @@
+package bsonex
+
+import (
+	"reflect"
+
+	gbson "github.com/globalsign/mgo/bson"
+)
+
+// Conversions between the bsonex types and the globalsign/mgo/bson types.
+// The bsonex types also implement gbson.Getter and gbson.Setter, and Marshal
+// and Unmarshal accept the mgo types, so code using both can be mixed.
+//
+// ObjectId, RegEx, DBPointer, MongoTimestamp, M, JavaScript, Symbol, MinKey,
+// MaxKey and Undefined used to be aliases of the mgo types and values and
+// are now distinct, so code assigning one to the other needs the
+// conversions below. All mgo specific encoding and decoding
+// lives in this file.
+
+func ObjectIdFromMgo(id gbson.ObjectId) ObjectId {
+	return ObjectId(id)
+}
+
+func (id ObjectId) ToMgo() gbson.ObjectId {
+	return gbson.ObjectId(id)
+}
+
+func RegExFromMgo(r gbson.RegEx) RegEx {
+	return RegEx(r)
+}
+
+func (r RegEx) ToMgo() gbson.RegEx {
+	return gbson.RegEx(r)
+}
+
+func DBPointerFromMgo(p gbson.DBPointer) DBPointer {
+	return DBPointer{Namespace: p.Namespace, Id: ObjectId(p.Id)}
+}
+
+func (p DBPointer) ToMgo() gbson.DBPointer {
+	return gbson.DBPointer{Namespace: p.Namespace, Id: gbson.ObjectId(p.Id)}
+}
+
+func MongoTimestampFromMgo(ts gbson.MongoTimestamp) MongoTimestamp {
+	return MongoTimestamp(ts)
+}
+
+func (ts MongoTimestamp) ToMgo() gbson.MongoTimestamp {
+	return gbson.MongoTimestamp(ts)
+}
+
+func BinaryFromMgo(b gbson.Binary) Binary {
+	return Binary(b)
+}
+
+func (b Binary) ToMgo() gbson.Binary {
+	return gbson.Binary(b)
+}
+
+// Decimal128FromMgo copies the 128 bits of d. mgo keeps them unexported, so
+// they go through its BSON encoding, which writes them as is.
+func Decimal128FromMgo(d gbson.Decimal128) Decimal128 {
+	bs, err := gbson.Marshal(gbson.D{{Name: "", Value: d}})
+	must(err)
+	// the value is followed by the document terminator
+	return decimal128FromBytes(bs[len(bs)-17:])
+}
+
+// ToMgo copies the 128 bits of d, see Decimal128FromMgo.
+func (d Decimal128) ToMgo() gbson.Decimal128 {
+	var g gbson.Decimal128
+	must(gbson.Raw{Kind: TypeDecimal128, Data: d.AppendBytes(nil)}.Unmarshal(&g))
+	return g
+}
+
+// JavaScriptFromMgo converts js and the mgo values nested in its scope.
+func JavaScriptFromMgo(js gbson.JavaScript) JavaScript {
+	return fromMgoValue(js).(JavaScript)
+}
+
+// ToMgo converts js and the bsonex values nested in its scope.
+func (js JavaScript) ToMgo() gbson.JavaScript {
+	return toMgoValue(js).(gbson.JavaScript)
+}
+
+func SymbolFromMgo(s gbson.Symbol) Symbol {
+	return Symbol(s)
+}
+
+func (s Symbol) ToMgo() gbson.Symbol {
+	return gbson.Symbol(s)
+}
+
+// MFromMgo converts m and the mgo values nested in it.
+func MFromMgo(m gbson.M) M {
+	return fromMgoValue(m).(M)
+}
+
+// ToMgo converts m and the bsonex values nested in it.
+func (m M) ToMgo() gbson.M {
+	return toMgoValue(m).(gbson.M)
+}
+
+func (id ObjectId) GetBSON() (interface{}, error)       { return id.ToMgo(), nil }
+func (r RegEx) GetBSON() (interface{}, error)           { return r.ToMgo(), nil }
+func (p DBPointer) GetBSON() (interface{}, error)       { return p.ToMgo(), nil }
+func (ts MongoTimestamp) GetBSON() (interface{}, error) { return ts.ToMgo(), nil }
+func (b Binary) GetBSON() (interface{}, error)          { return b.ToMgo(), nil }
+func (js JavaScript) GetBSON() (interface{}, error)     { return js.ToMgo(), nil }
+func (s Symbol) GetBSON() (interface{}, error)          { return s.ToMgo(), nil }
+func (k orderKey) GetBSON() (interface{}, error)        { return toMgoValue(k), nil }
+func (u undefined) GetBSON() (interface{}, error)       { return gbson.Undefined, nil }
+
+func (id *ObjectId) SetBSON(raw gbson.Raw) error       { return setBSON(raw, id) }
+func (r *RegEx) SetBSON(raw gbson.Raw) error           { return setBSON(raw, r) }
+func (p *DBPointer) SetBSON(raw gbson.Raw) error       { return setBSON(raw, p) }
+func (ts *MongoTimestamp) SetBSON(raw gbson.Raw) error { return setBSON(raw, ts) }
+func (b *Binary) SetBSON(raw gbson.Raw) error          { return setBSON(raw, b) }
+func (d *Decimal128) SetBSON(raw gbson.Raw) error      { return setBSON(raw, d) }
+func (js *JavaScript) SetBSON(raw gbson.Raw) error     { return setBSON(raw, js) }
+func (s *Symbol) SetBSON(raw gbson.Raw) error          { return setBSON(raw, s) }
+
+// setBSON decodes raw with Unmarshal, reporting mismatched types as a
+// *gbson.TypeError so mgo skips the value like it does for its own types.
+func setBSON(raw gbson.Raw, out interface{}) error {
+	err := Value{raw.Kind, raw.Data}.Unmarshal(out)
+	if e, ok := err.(*UnmarshalTypeError); ok {
+		return &gbson.TypeError{Type: e.GoType, Kind: e.Type}
+	}
+	return err
+}
+
+// toMgoValue converts v, and the values nested in documents and arrays, to
+// the mgo types.
+func toMgoValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case M:
+		m := make(gbson.M, len(v))
+		for k, e := range v {
+			m[k] = toMgoValue(e)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = toMgoValue(e)
+		}
+		return a
+	case D:
+		d := make(gbson.D, len(v))
+		for i, e := range v {
+			d[i] = gbson.DocElem{Name: e.Key, Value: toMgoValue(e.Value)}
+		}
+		return d
+	case gbson.D:
+		d := make(gbson.D, len(v))
+		for i, e := range v {
+			d[i] = gbson.DocElem{Name: e.Name, Value: toMgoValue(e.Value)}
+		}
+		return d
+	case ObjectId:
+		return v.ToMgo()
+	case RegEx:
+		return v.ToMgo()
+	case DBPointer:
+		return v.ToMgo()
+	case MongoTimestamp:
+		return v.ToMgo()
+	case Binary:
+		return v.ToMgo()
+	case Decimal128:
+		return v.ToMgo()
+	case JavaScript:
+		return gbson.JavaScript{Code: v.Code, Scope: toMgoValue(v.Scope)}
+	case Symbol:
+		return v.ToMgo()
+	case orderKey:
+		if v == MaxKey {
+			return gbson.MaxKey
+		}
+		return gbson.MinKey
+	case undefined:
+		return gbson.Undefined
+	}
+	return v
+}
+
+// fromMgoValue is the reverse of toMgoValue.
+func fromMgoValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case gbson.M:
+		m := make(M, len(v))
+		for k, e := range v {
+			m[k] = fromMgoValue(e)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = fromMgoValue(e)
+		}
+		return a
+	case gbson.D:
+		d := make(D, len(v))
+		for i, e := range v {
+			d[i] = E{Key: e.Name, Value: fromMgoValue(e.Value)}
+		}
+		return d
+	case gbson.ObjectId:
+		return ObjectIdFromMgo(v)
+	case gbson.RegEx:
+		return RegExFromMgo(v)
+	case gbson.DBPointer:
+		return DBPointerFromMgo(v)
+	case gbson.MongoTimestamp:
+		return MongoTimestampFromMgo(v)
+	case gbson.Binary:
+		return BinaryFromMgo(v)
+	case gbson.Decimal128:
+		return Decimal128FromMgo(v)
+	case gbson.JavaScript:
+		return JavaScript{Code: v.Code, Scope: fromMgoValue(v.Scope)}
+	case gbson.Symbol:
+		return SymbolFromMgo(v)
+	}
+	switch v {
+	case gbson.MinKey:
+		return MinKey
+	case gbson.MaxKey:
+		return MaxKey
+	case gbson.Undefined:
+		return Undefined
+	}
+	return v
+}
+
+// mgoTypes are the mgo types Marshal and Unmarshal convert from and to the
+// bsonex type of the same kind.
+var mgoTypes = map[reflect.Type]reflect.Type{
+	reflect.TypeOf(gbson.ObjectId("")):      typeOfObjectId,
+	reflect.TypeOf(gbson.RegEx{}):           typeOfRegEx,
+	reflect.TypeOf(gbson.DBPointer{}):       typeOfDBPointer,
+	reflect.TypeOf(gbson.MongoTimestamp(0)): typeOfTimestamp,
+	reflect.TypeOf(gbson.Decimal128{}):      typeOfDecimal128,
+	reflect.TypeOf(gbson.M{}):               typeOfM,
+	reflect.TypeOf(gbson.JavaScript{}):      typeOfJavaScript,
+	reflect.TypeOf(gbson.Symbol("")):        typeOfSymbol,
+	reflect.TypeOf(gbson.MinKey):            typeOfOrderKey,
+	reflect.TypeOf(gbson.Undefined):         typeOfUndefined,
+}
+
+var (
+	typeOfRaw     = reflect.TypeOf(gbson.Raw{})
+	typeOfGBinary = reflect.TypeOf(gbson.Binary{})
+	typeOfGD      = reflect.TypeOf(gbson.D{})
+	typeOfGRawD   = reflect.TypeOf(gbson.RawD{})
+	typeOfSetter  = reflect.TypeOf((*gbson.Setter)(nil)).Elem()
+	typeOfGetter  = reflect.TypeOf((*gbson.Getter)(nil)).Elem()
+)
+
+// newMgoDecoder returns the decoder of the mgo types, or nil.
+func newMgoDecoder(t reflect.Type) decodeFunc {
+	switch t {
+	case typeOfRaw:
+		return func(v Value, out reflect.Value) (bool, error) {
+			out.Set(reflect.ValueOf(gbson.Raw{Kind: v.valueType, Data: v.valueData}))
+			return true, nil
+		}
+	case typeOfGBinary:
+		return zeroOnNull(newConvertDecoder(typeOfBinary, toMgoValue))
+	case typeOfGD:
+		return zeroOnNull(func(v Value, out reflect.Value) (bool, error) {
+			if v.valueType != TypeDocument {
+				return false, nil
+			}
+			var d gbson.D
+			it := BSON(v.valueData).Elements()
+			for it.Next() {
+				val, err := it.val.ValueErr()
+				if err != nil {
+					return false, withOffset(withKey(err, it.key), it.valueOffset())
+				}
+				d = append(d, gbson.DocElem{Name: string(it.key), Value: toMgoValue(val)})
+			}
+			out.Set(reflect.ValueOf(d))
+			return true, it.err
+		})
+	}
+	if own, ok := mgoTypes[t]; ok {
+		return zeroOnNull(newConvertDecoder(own, toMgoValue))
+	}
+	return nil
+}
+
+// newMgoEncoder returns the encoder of the mgo types, or nil.
+func newMgoEncoder(t reflect.Type) encodeFunc {
+	switch t {
+	case typeOfRaw:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			raw := v.Interface().(gbson.Raw)
+			if raw.Kind == TypeEmpty {
+				raw.Kind = TypeDocument
+			}
+			return append(dst, raw.Data...), raw.Kind, nil
+		}
+	case typeOfGBinary:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			return appendBinary(dst, BinaryFromMgo(v.Interface().(gbson.Binary))), TypeBinary, nil
+		}
+	case typeOfGD:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			dst, start := startDocument(dst)
+			var err error
+			for _, e := range v.Interface().(gbson.D) {
+				if dst, err = appendValueElement(dst, e.Name, reflect.ValueOf(e.Value), false); err != nil {
+					return dst, 0, err
+				}
+			}
+			return endDocument(dst, start), TypeDocument, nil
+		}
+	case typeOfGRawD:
+		return func(dst []byte, v reflect.Value, _ bool) ([]byte, ValueType, error) {
+			dst, start := startDocument(dst)
+			var err error
+			for _, e := range v.Interface().(gbson.RawD) {
+				if dst, err = appendValueElement(dst, e.Name, reflect.ValueOf(e.Value), false); err != nil {
+					return dst, 0, err
+				}
+			}
+			return endDocument(dst, start), TypeDocument, nil
+		}
+	}
+	if own, ok := mgoTypes[t]; ok && isLeafType(own) {
+		return newConvertEncoder(fromMgoValue)
+	}
+	return nil
+}
+
+func decodeSetter(v Value, out reflect.Value) (bool, error) {
+	if !out.CanAddr() {
+		return false, nil
+	}
+	err := out.Addr().Interface().(gbson.Setter).SetBSON(gbson.Raw{Kind: v.valueType, Data: v.valueData})
+	if err == gbson.ErrSetZero {
+		out.Set(reflect.Zero(out.Type()))
+		return true, nil
+	}
+	if _, ok := err.(*gbson.TypeError); ok {
+		return false, nil
+	}
+	return true, err
+}
+
+func encodeGetter(dst []byte, v reflect.Value, minSize bool) ([]byte, ValueType, error) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return dst, TypeNull, nil
+	}
+	getv, err := v.Interface().(gbson.Getter).GetBSON()
+	if err != nil {
+		return dst, 0, err
+	}
+	if getv == nil {
+		return dst, TypeNull, nil
+	}
+	gv := reflect.ValueOf(getv)
+	return encoderFor(gv.Type())(dst, gv, minSize)
+}
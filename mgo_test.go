@@ -0,0 +1,93 @@
+package bsonex
+
+import (
+	"testing"
+
+	gbson "github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+type mgoStruct struct {
+	Id   ObjectId
+	Re   RegEx
+	Ptr  DBPointer
+	Ts   MongoTimestamp
+	Bin  Binary
+	Dec  Decimal128
+	Doc  M
+	GId  gbson.ObjectId
+	GTs  gbson.MongoTimestamp
+	GDec gbson.Decimal128
+	GDoc gbson.M
+	GD   gbson.D
+	JS   JavaScript
+	Sym  Symbol
+	Min  orderKey
+	GJS  gbson.JavaScript
+	GSym gbson.Symbol
+}
+
+func TestMgoConversions(t *testing.T) {
+	dec, _ := ParseDecimal128("1.25")
+	gdec, _ := gbson.ParseDecimal128("1.25")
+	assert.Equal(t, gbson.ObjectId(id), id.ToMgo())
+	assert.Equal(t, id, ObjectIdFromMgo(id.ToMgo()))
+	assert.Equal(t, RegEx{"a", "i"}, RegExFromMgo(RegEx{"a", "i"}.ToMgo()))
+	assert.Equal(t, DBPointer{"a.b", id}, DBPointerFromMgo(DBPointer{"a.b", id}.ToMgo()))
+	assert.Equal(t, ts, MongoTimestampFromMgo(ts.ToMgo()))
+	assert.Equal(t, Binary{0x80, []byte{1}}, BinaryFromMgo(Binary{0x80, []byte{1}}.ToMgo()))
+	assert.Equal(t, gdec, dec.ToMgo())
+	assert.Equal(t, dec, Decimal128FromMgo(gdec))
+	// every bit pattern is kept, including NaN payloads and non canonical
+	// coefficients
+	for _, d := range []Decimal128{NewDecimal128(0x7c00000000000000, 42), NewDecimal128(0x6fffffffffffffff, 1), NewDecimal128(1<<63, 0)} {
+		assert.Equal(t, d, Decimal128FromMgo(d.ToMgo()))
+	}
+
+	assert.Equal(t, gbson.JavaScript{Code: "f()", Scope: gbson.M{"id": id.ToMgo()}}, JavaScript{Code: "f()", Scope: M{"id": id}}.ToMgo())
+	assert.Equal(t, JavaScript{Code: "f()"}, JavaScriptFromMgo(gbson.JavaScript{Code: "f()"}))
+	assert.Equal(t, Symbol("s"), SymbolFromMgo(Symbol("s").ToMgo()))
+
+	m := M{"id": id, "a": []interface{}{M{"ts": ts}, MinKey, MaxKey, Undefined, Symbol("s")}, "d": D{{Key: "b", Value: Binary{Data: []byte{1}}}}}
+	gm := gbson.M{
+		"id": id.ToMgo(),
+		"a":  []interface{}{gbson.M{"ts": ts.ToMgo()}, gbson.MinKey, gbson.MaxKey, gbson.Undefined, gbson.Symbol("s")},
+		"d":  gbson.D{{Name: "b", Value: gbson.Binary{Data: []byte{1}}}},
+	}
+	assert.Equal(t, gm, m.ToMgo())
+	assert.Equal(t, m, MFromMgo(gm))
+}
+
+func TestMgoMarshal(t *testing.T) {
+	dec, _ := ParseDecimal128("1.25")
+	gdec, _ := gbson.ParseDecimal128("1.25")
+	in := mgoStruct{
+		Id: id, Re: RegEx{"a", "i"}, Ptr: DBPointer{"a.b", id}, Ts: ts, Bin: Binary{0x80, []byte{1}}, Dec: dec,
+		Doc: M{"id": id}, GId: id.ToMgo(), GTs: ts.ToMgo(), GDec: gdec, GDoc: gbson.M{"id": id.ToMgo()},
+		GD: gbson.D{{Name: "id", Value: id.ToMgo()}}, JS: JavaScript{Code: "f()", Scope: M{"a": int32(1)}},
+		Sym: "s", Min: MaxKey, GJS: gbson.JavaScript{Code: "g()"}, GSym: "t",
+	}
+
+	// bsonex and mgo encode the same bytes and decode each other's
+	want, err := gbson.Marshal(&in)
+	assert.NoError(t, err)
+	got, err := Marshal(&in)
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	var out, gout mgoStruct
+	assert.NoError(t, Unmarshal(got, &out))
+	assert.Equal(t, in, out)
+	assert.NoError(t, gbson.Unmarshal(got, &gout))
+	// mgo fills an M with its own types
+	assert.Equal(t, M{"id": id.ToMgo()}, gout.Doc)
+	gout.Doc = in.Doc
+	assert.Equal(t, in, gout)
+
+	// a mismatched type is skipped by mgo and reported by Unmarshal
+	bs, _ := Marshal(M{"id": 1})
+	assert.NoError(t, gbson.Unmarshal(bs, &gout))
+	assert.Equal(t, ObjectId(""), gout.Id)
+	var oid ObjectId
+	assert.Error(t, BSON(bs).Lookup("id").Unmarshal(&oid))
+}
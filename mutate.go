@@ -0,0 +1,176 @@
+package bsonex
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrPathNotFound  = errors.New("bsonex: path not found")
+	ErrInvalidPath   = errors.New("bsonex: invalid path")
+	ErrArrayTooLarge = errors.New("bsonex: array padding exceeds " + strconv.Itoa(maxArrayPadding) + " elements")
+)
+
+// maxArrayPadding is the most nulls Set adds to reach an array index, the
+// same limit as MongoDB.
+const maxArrayPadding = 1500000
+
+// Set returns a copy of b with the element at the dotted path set to value,
+// creating intermediate documents when needed. value may be a Value, a BSON
+// document or anything Marshal accepts. Setting an array index past the end
+// pads the array with nulls, like MongoDB does, up to maxArrayPadding nulls.
+func (b BSON) Set(path string, value interface{}) (BSON, error) {
+	v, err := toValue(value)
+	if err != nil {
+		return nil, err
+	}
+	if v.IsEmpty() {
+		return nil, &InvalidTypeError{Pos{Key: path}, v.valueType}
+	}
+	return b.splice(path, v, true)
+}
+
+// Replace returns a copy of b with the value of the existing element at the
+// dotted path replaced by v. It returns ErrPathNotFound if there is no such
+// element.
+func (b BSON) Replace(path string, v Value) (BSON, error) {
+	if v.IsEmpty() {
+		return nil, &InvalidTypeError{Pos{Key: path}, v.valueType}
+	}
+	return b.splice(path, v, false)
+}
+
+// Unset returns a copy of b without the element at the dotted path. Like
+// MongoDB's $unset, array elements are set to null instead of being removed
+// so that the following indices do not change. Unsetting a missing element,
+// or a path going through a value that is neither a document nor an array,
+// is not an error.
+func (b BSON) Unset(path string) (BSON, error) {
+	nb, err := b.splice(path, Value{}, false)
+	if err == ErrPathNotFound {
+		return append(BSON(nil), b...), nil
+	}
+	return nb, err
+}
+
+// Rename returns a copy of b with the element at oldPath moved to newPath.
+// Renaming a missing element is not an error.
+func (b BSON) Rename(oldPath, newPath string) (BSON, error) {
+	v, err := b.LookupErr(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	if v.IsEmpty() || oldPath == newPath {
+		return append(BSON(nil), b...), nil
+	}
+	if strings.HasPrefix(newPath+".", oldPath+".") || strings.HasPrefix(oldPath+".", newPath+".") {
+		return nil, ErrInvalidPath
+	}
+	nb, err := b.Unset(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	return nb.Set(newPath, v)
+}
+
+// toValue converts a Go value to a Value.
+func toValue(value interface{}) (Value, error) {
+	switch v := value.(type) {
+	case Value:
+		return v, nil
+	case BSON:
+		return Value{TypeDocument, v}, nil
+	}
+	bs, err := Marshal(M{"v": value})
+	if err != nil {
+		return Value{}, err
+	}
+	// bson_size(4) + type(1) + key(v,1) + \0 (1) ...value.... \0 (1)
+	return Value{bs[4], bs[4+1+1+1 : len(bs)-1]}, nil
+}
+
+// splice returns a copy of b with the element at path set to v, or removed if
+// v is empty. create allows missing elements and intermediate documents to
+// be created.
+func (b BSON) splice(path string, v Value, create bool) (BSON, error) {
+	if path == "" {
+		return nil, ErrInvalidPath
+	}
+	return spliceDocument(b, false, strings.Split(path, "."), v, create)
+}
+
+// spliceDocument rewrites doc, an array if isArray is set, and returns the
+// new encoding with its length prefix updated.
+func spliceDocument(doc BSON, isArray bool, path []string, v Value, create bool) (BSON, error) {
+	key := path[0]
+	start, end, n := -1, -1, 0
+	var cur Value
+	it := doc.Elements()
+	for it.Next() {
+		n++
+		if string(it.key) == key {
+			end = it.off
+			start = it.valueOffset() - len(key) - 2
+			cur = it.val
+			break
+		}
+	}
+	if it.err != nil {
+		return nil, it.err
+	}
+	if len(path) > 1 {
+		switch {
+		case cur.valueType == TypeDocument || cur.valueType == TypeArray:
+		case cur.IsEmpty() && create:
+			cur = Value{TypeDocument, []byte{5, 0, 0, 0, 0}}
+		case cur.IsEmpty():
+			return nil, ErrPathNotFound
+		case v.IsEmpty():
+			// MongoDB ignores an $unset through a scalar
+			return nil, ErrPathNotFound
+		default:
+			return nil, &TypeError{[]ValueType{TypeDocument, TypeArray}, cur.valueType}
+		}
+		child, err := spliceDocument(cur.valueData, cur.valueType == TypeArray, path[1:], v, create)
+		if err != nil {
+			return nil, err
+		}
+		v = Value{cur.valueType, child}
+	} else if start < 0 && !create {
+		return nil, ErrPathNotFound
+	}
+	if v.IsEmpty() && isArray {
+		v = Value{valueType: TypeNull}
+	}
+
+	nb := make(BSON, 0, len(doc)+len(key)+len(v.valueData)+2)
+	if start >= 0 {
+		nb = append(nb, doc[:start]...)
+		if !v.IsEmpty() {
+			nb = append(appendElementHeader(nb, v.valueType, key), v.valueData...)
+		}
+		nb = append(nb, doc[end:]...)
+	} else {
+		nb = append(nb, doc[:len(doc)-1]...)
+		if isArray {
+			if !isArrayIndex(key) {
+				return nil, ErrInvalidPath
+			}
+			i, err := strconv.Atoi(key)
+			if err != nil || i < n {
+				return nil, ErrInvalidPath
+			}
+			if i-n > maxArrayPadding {
+				return nil, ErrArrayTooLarge
+			}
+			for ; n < i; n++ {
+				nb = appendElementHeader(nb, TypeNull, strconv.Itoa(n))
+			}
+			key = strconv.Itoa(i)
+		}
+		nb = append(appendElementHeader(nb, v.valueType, key), v.valueData...)
+		nb = append(nb, 0x00)
+	}
+	return setLength(nb, 0), nil
+}
@@ -0,0 +1,139 @@
+package bsonex
+
+import (
+	"testing"
+
+	gbson "github.com/globalsign/mgo/bson"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustMarshalD(t *testing.T, d gbson.D) BSON {
+	b, err := Marshal(d)
+	assert.NoError(t, err)
+	return b
+}
+
+func TestSet(t *testing.T) {
+	orig := mustMarshalD(t, gbson.D{
+		{Name: "a", Value: int32(1)},
+		{Name: "b", Value: gbson.D{{Name: "c", Value: "x"}, {Name: "d", Value: true}}},
+		{Name: "arr", Value: []interface{}{"p", "q"}},
+	})
+	saved := append(BSON(nil), orig...)
+
+	got, err := orig.Set("b.c", "longer value")
+	assert.NoError(t, err)
+	assert.NoError(t, got.Validate())
+	assert.Equal(t, mustMarshalD(t, gbson.D{
+		{Name: "a", Value: int32(1)},
+		{Name: "b", Value: gbson.D{{Name: "c", Value: "longer value"}, {Name: "d", Value: true}}},
+		{Name: "arr", Value: []interface{}{"p", "q"}},
+	}), got)
+	assert.Equal(t, saved, orig)
+
+	got, err = orig.Set("x.y.z", int64(5))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), got.Lookup("x.y.z").Int64())
+	assert.Equal(t, "x", got.Lookup("b.c").Str())
+
+	got, err = orig.Set("arr.1", int32(7))
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"p", int32(7)}, got.Lookup("arr").Array())
+
+	got, err = orig.Set("arr.3", "s")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"p", "q", nil, "s"}, got.Lookup("arr").Array())
+
+	got, err = orig.Set("b", orig.Lookup("arr"))
+	assert.NoError(t, err)
+	assert.Equal(t, TypeArray, got.Lookup("b").Type())
+
+	_, err = orig.Set("a.b", 1)
+	assert.IsType(t, &TypeError{}, err)
+	_, err = orig.Set("arr.x", 1)
+	assert.Equal(t, ErrInvalidPath, err)
+	for _, path := range []string{"arr.03", "arr.+3", "arr.-1", "arr.99999999999999999999"} {
+		_, err = orig.Set(path, 1)
+		assert.Equal(t, ErrInvalidPath, err, path)
+	}
+	_, err = orig.Set("arr.1500003", 1)
+	assert.Equal(t, ErrArrayTooLarge, err)
+	got, err = orig.Set("arr.1500002", 1)
+	assert.NoError(t, err)
+	assert.Len(t, got.Lookup("arr").Array(), 1500003)
+	_, err = orig.Set("", 1)
+	assert.Equal(t, ErrInvalidPath, err)
+	_, err = orig.Set("a", Value{})
+	assert.IsType(t, &InvalidTypeError{}, err)
+}
+
+func TestReplace(t *testing.T) {
+	orig := mustMarshalD(t, gbson.D{
+		{Name: "a", Value: int32(1)},
+		{Name: "b", Value: gbson.D{{Name: "c", Value: "x"}}},
+	})
+	got, err := orig.Replace("b.c", orig.Lookup("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, mustMarshalD(t, gbson.D{
+		{Name: "a", Value: int32(1)},
+		{Name: "b", Value: gbson.D{{Name: "c", Value: int32(1)}}},
+	}), got)
+
+	_, err = orig.Replace("b.x", orig.Lookup("a"))
+	assert.Equal(t, ErrPathNotFound, err)
+	_, err = orig.Replace("x.c", orig.Lookup("a"))
+	assert.Equal(t, ErrPathNotFound, err)
+}
+
+func TestUnset(t *testing.T) {
+	orig := mustMarshalD(t, gbson.D{
+		{Name: "a", Value: int32(1)},
+		{Name: "b", Value: gbson.D{{Name: "c", Value: "x"}, {Name: "d", Value: true}}},
+		{Name: "arr", Value: []interface{}{"p", "q"}},
+	})
+	got, err := orig.Unset("b.c")
+	assert.NoError(t, err)
+	assert.Equal(t, mustMarshalD(t, gbson.D{
+		{Name: "a", Value: int32(1)},
+		{Name: "b", Value: gbson.D{{Name: "d", Value: true}}},
+		{Name: "arr", Value: []interface{}{"p", "q"}},
+	}), got)
+
+	got, err = orig.Unset("arr.0")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{nil, "q"}, got.Lookup("arr").Array())
+
+	got, err = orig.Unset("missing.path")
+	assert.NoError(t, err)
+	assert.Equal(t, orig, got)
+
+	// like MongoDB, unsetting through a scalar does nothing
+	for _, path := range []string{"a.x", "b.c.x", "arr.0.x"} {
+		got, err = orig.Unset(path)
+		assert.NoError(t, err, path)
+		assert.Equal(t, orig, got, path)
+	}
+	_, err = orig.Replace("a.x", orig.Lookup("a"))
+	assert.IsType(t, &TypeError{}, err)
+}
+
+func TestRename(t *testing.T) {
+	orig := mustMarshalD(t, gbson.D{
+		{Name: "a", Value: int32(1)},
+		{Name: "b", Value: gbson.D{{Name: "c", Value: "x"}}},
+	})
+	got, err := orig.Rename("b.c", "e.f")
+	assert.NoError(t, err)
+	assert.Equal(t, mustMarshalD(t, gbson.D{
+		{Name: "a", Value: int32(1)},
+		{Name: "b", Value: gbson.D{}},
+		{Name: "e", Value: gbson.D{{Name: "f", Value: "x"}}},
+	}), got)
+
+	got, err = orig.Rename("missing", "x")
+	assert.NoError(t, err)
+	assert.Equal(t, orig, got)
+
+	_, err = orig.Rename("b", "b.c")
+	assert.Equal(t, ErrInvalidPath, err)
+}
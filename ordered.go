@@ -0,0 +1,118 @@
+package bsonex
+
+import (
+	"context"
+	"sync"
+)
+
+// orderedBatch is a batch of documents mapped by a worker, done is closed
+// once vals is filled.
+type orderedBatch struct {
+	*batch
+	vals []interface{}
+	done chan struct{}
+}
+
+// DoOrdered is like Do but splits the work in two: mapFn runs concurrently on
+// parallel workers and sinkFn is called sequentially with each document and
+// the result of mapFn, in the order of the documents in the stream. At most
+// parallel+QueueDepth batches wait for the sink, so a slow document stalls
+// the reading instead of growing the memory.
+func (d *Decoder) DoOrdered(parallel int, mapFn func(b BSONEX) (interface{}, error), sinkFn func(b BSONEX, v interface{}) error) error {
+	return d.DoOrderedContext(context.Background(), parallel, mapFn, sinkFn)
+}
+
+// DoOrderedContext is like DoOrdered but stops like DoContext.
+func (d *Decoder) DoOrderedContext(ctx context.Context, parallel int, mapFn func(b BSONEX) (interface{}, error), sinkFn func(b BSONEX, v interface{}) error) error {
+	if parallel <= 1 {
+		return d.forEach(ctx, func(b BSONEX) error {
+			v, err := mapFn(b)
+			if err != nil {
+				return err
+			}
+			return sinkFn(b, v)
+		})
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	failed := &firstError{cancel: cancel}
+
+	jobs := make(chan *orderedBatch, parallel)
+	window := make(chan *orderedBatch, parallel+d.opts.queueDepth(parallel))
+	var wg sync.WaitGroup
+	wg.Add(parallel + 1)
+	for i := 0; i < parallel; i++ {
+		go func(id int) {
+			defer wg.Done()
+			for bs := range jobs {
+				mapBatch(ctx, failed, id, bs, mapFn)
+			}
+		}(i)
+	}
+	go func() {
+		defer wg.Done()
+		defer close(window)
+		defer close(jobs)
+		err := d.dispatch(ctx, func(b *batch) bool {
+			bs := &orderedBatch{batch: b, vals: make([]interface{}, len(b.docs)), done: make(chan struct{})}
+			// the batch takes its place in the window before any worker
+			// can see it, so the sink gets the batches in stream order
+			select {
+			case window <- bs:
+			case <-ctx.Done():
+				return false
+			}
+			select {
+			case jobs <- bs:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+		if err != nil {
+			failed.set(err)
+		}
+	}()
+
+sink:
+	for bs := range window {
+		select {
+		case <-bs.done:
+		case <-ctx.Done():
+		}
+		// a batch cut short by a failure is done too
+		if err := ctx.Err(); err != nil {
+			failed.set(err)
+			break
+		}
+		for i := range bs.docs {
+			b := &bs.docs[i]
+			if err := sinkFn(*b, bs.vals[i]); err != nil {
+				failed.set(callbackError(b, err))
+				break sink
+			}
+		}
+		d.release(bs.batch)
+	}
+	cancel()
+	wg.Wait()
+	return failed.err
+}
+
+func mapBatch(ctx context.Context, failed *firstError, id int, bs *orderedBatch, mapFn func(b BSONEX) (interface{}, error)) {
+	defer close(bs.done)
+	for i := range bs.docs {
+		b := &bs.docs[i]
+		if err := ctx.Err(); err != nil {
+			failed.set(err)
+			return
+		}
+		b.runnerID = id
+		v, err := mapFn(*b)
+		if err != nil {
+			failed.set(callbackError(b, err))
+			return
+		}
+		bs.vals[i] = v
+	}
+}
@@ -0,0 +1,101 @@
+package bsonex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoOrdered(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, e.Encode(M{"i": i}))
+	}
+	stream := buf.Bytes()
+
+	for _, parallel := range []int{1, 8} {
+		var got []int32
+		last := int64(-1)
+		err := NewDecoder(bytes.NewReader(stream)).DoOrdered(parallel, func(b BSONEX) (interface{}, error) {
+			if rand.Intn(50) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			return b.Lookup("i").Int32(), nil
+		}, func(b BSONEX, v interface{}) error {
+			assert.True(t, b.Offset() > last)
+			last = b.Offset()
+			got = append(got, v.(int32))
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Len(t, got, 1000)
+		for i, v := range got {
+			if !assert.Equal(t, int32(i), v, parallel) {
+				break
+			}
+		}
+	}
+
+	errStop := errors.New("stop")
+	doc, _ := Marshal(M{"a": 1})
+	for _, parallel := range []int{1, 4} {
+		lc := &leakCheck{t: t, r: &repeatReader{doc: doc}}
+		err := NewDecoder(lc).DoOrdered(parallel, func(b BSONEX) (interface{}, error) {
+			defer lc.track()()
+			if b.Offset() == 500*int64(len(doc)) {
+				return nil, errStop
+			}
+			if b.Offset() > 500*int64(len(doc)) {
+				// still mapping when DoOrdered stops
+				time.Sleep(time.Millisecond)
+			}
+			return nil, nil
+		}, func(b BSONEX, v interface{}) error {
+			defer lc.track()()
+			assert.True(t, b.Offset() < 500*int64(len(doc)))
+			return nil
+		})
+		var ce *CallbackError
+		assert.True(t, errors.As(err, &ce), parallel)
+		assert.Equal(t, 500*int64(len(doc)), ce.DocOffset)
+		assert.True(t, ce.RunnerID >= 0 && ce.RunnerID < parallel)
+		assert.Equal(t, errStop, ce.Err)
+		lc.returned(parallel)
+
+		var sunk int
+		lc = &leakCheck{t: t, r: &repeatReader{doc: doc}}
+		err = NewDecoder(lc).DoOrdered(parallel, func(b BSONEX) (interface{}, error) {
+			defer lc.track()()
+			return nil, nil
+		}, func(b BSONEX, v interface{}) error {
+			defer lc.track()()
+			if sunk++; sunk == 500 {
+				return errStop
+			}
+			return nil
+		})
+		assert.True(t, errors.Is(err, errStop), parallel)
+		assert.Equal(t, 500, sunk)
+		lc.returned(parallel)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		lc = &leakCheck{t: t, r: &repeatReader{doc: doc}}
+		err = NewDecoder(lc).DoOrderedContext(ctx, parallel, func(b BSONEX) (interface{}, error) {
+			defer lc.track()()
+			return nil, nil
+		}, func(b BSONEX, v interface{}) error {
+			defer lc.track()()
+			cancel()
+			return nil
+		})
+		assert.Equal(t, context.Canceled, err, parallel)
+		// no read or callback is left running once DoOrdered returns
+		lc.returned(parallel)
+	}
+}
@@ -0,0 +1,331 @@
+package bsonex
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PathSyntaxError reports an invalid JSON Pointer or bracket path. Offset is
+// the byte position in Path where the problem was found.
+type PathSyntaxError struct {
+	Path   string
+	Offset int
+	Msg    string
+}
+
+func (e *PathSyntaxError) Error() string {
+	return fmt.Sprintf("bsonex: path %s: %s at offset %d", strconv.Quote(e.Path), e.Msg, e.Offset)
+}
+
+// LookupPath is like Lookup but takes the path already split into keys, so
+// keys may contain dots or be empty.
+func (b BSON) LookupPath(keys []string) Value {
+	val, err := b.LookupPathErr(keys)
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+// LookupPathErr is like LookupPath but returns an error instead of panicking
+// when the document is malformed along the path.
+func (b BSON) LookupPathErr(keys []string) (val Value, err error) {
+	if len(keys) == 0 {
+		return
+	}
+	val = Value{valueType: TypeDocument, valueData: b}
+	for _, k := range keys {
+		if val.valueType != TypeDocument && val.valueType != TypeArray {
+			return Value{}, nil
+		}
+		val, err = BSON(val.valueData).lookupOne(k)
+		if err != nil || val.valueType == TypeEmpty {
+			return
+		}
+	}
+	return
+}
+
+// ParseJSONPointer splits an RFC 6901 JSON Pointer such as "/a/b~1c/0" into
+// keys for LookupPath. The empty pointer refers to the whole document and
+// returns no keys.
+func ParseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, &PathSyntaxError{pointer, 0, "pointer must start with /"}
+	}
+	keys := strings.Split(pointer[1:], "/")
+	off := 1
+	for i, k := range keys {
+		if strings.IndexByte(k, '~') >= 0 {
+			var sb strings.Builder
+			for j := 0; j < len(k); j++ {
+				if k[j] != '~' {
+					sb.WriteByte(k[j])
+					continue
+				}
+				if j+1 == len(k) || (k[j+1] != '0' && k[j+1] != '1') {
+					return nil, &PathSyntaxError{pointer, off + j, "invalid escape"}
+				}
+				if j++; k[j] == '0' {
+					sb.WriteByte('~')
+				} else {
+					sb.WriteByte('/')
+				}
+			}
+			keys[i] = sb.String()
+		}
+		off += len(k) + 1
+	}
+	return keys, nil
+}
+
+// ParseBracketPath splits a path written in dotted and bracket notation such
+// as `a["b.c"][0].d` into keys for LookupPath. Bracketed keys are JSON
+// strings or array indices, plain keys are separated by dots.
+func ParseBracketPath(path string) ([]string, error) {
+	var keys []string
+	for i := 0; i < len(path); {
+		if path[i] == '[' {
+			key, n, err := parseBracketKey(path, i)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+			i = n
+			continue
+		}
+		if i > 0 {
+			if path[i] != '.' {
+				return nil, &PathSyntaxError{path, i, "unexpected " + strconv.QuoteRune(rune(path[i]))}
+			}
+			i++
+		}
+		j := i
+		for j < len(path) && path[j] != '.' && path[j] != '[' {
+			j++
+		}
+		if j == i {
+			return nil, &PathSyntaxError{path, i, "empty key"}
+		}
+		keys = append(keys, path[i:j])
+		i = j
+	}
+	return keys, nil
+}
+
+// parseBracketKey parses a ["key"] or [index] segment starting at path[i] and
+// returns the key and the offset after the closing bracket.
+func parseBracketKey(path string, i int) (string, int, error) {
+	start := i + 1
+	if start < len(path) && path[start] == '"' {
+		j := start + 1
+		for ; j < len(path) && path[j] != '"'; j++ {
+			if path[j] == '\\' {
+				j++
+			}
+		}
+		if j >= len(path) {
+			return "", 0, &PathSyntaxError{path, start, "unterminated string"}
+		}
+		var key string
+		if err := json.Unmarshal([]byte(path[start:j+1]), &key); err != nil {
+			return "", 0, &PathSyntaxError{path, start, "invalid string"}
+		}
+		if j+1 >= len(path) || path[j+1] != ']' {
+			return "", 0, &PathSyntaxError{path, j + 1, "missing ]"}
+		}
+		return key, j + 2, nil
+	}
+	j := start
+	for j < len(path) && path[j] >= '0' && path[j] <= '9' {
+		j++
+	}
+	if j == start || !isArrayIndex(path[start:j]) {
+		return "", 0, &PathSyntaxError{path, start, "expect a string or an array index"}
+	}
+	if j >= len(path) || path[j] != ']' {
+		return "", 0, &PathSyntaxError{path, j, "missing ]"}
+	}
+	return path[start:j], j + 1, nil
+}
+
+// Path is a compiled lookup path. It keeps the keys as bytes so Get does not
+// split or convert anything.
+type Path struct {
+	keys [][]byte
+}
+
+// CompilePath compiles a dotted path, Get then returns the same value as
+// Lookup(path).
+func CompilePath(path string) Path {
+	if path == "" {
+		return Path{}
+	}
+	return CompileKeys(strings.Split(path, "."))
+}
+
+// CompileKeys compiles a path already split into keys, see LookupPath.
+func CompileKeys(keys []string) Path {
+	p := Path{keys: make([][]byte, len(keys))}
+	for i, k := range keys {
+		p.keys[i] = []byte(k)
+	}
+	return p
+}
+
+// String returns the keys of p joined with dots.
+func (p Path) String() string {
+	return string(bytes.Join(p.keys, []byte{'.'}))
+}
+
+// Get returns the value at p in b, an empty Value if the path does not
+// exist. It panics if b is malformed along the path.
+func (p Path) Get(b BSON) Value {
+	val, err := p.GetErr(b)
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+// GetErr is like Get but returns an error instead of panicking.
+func (p Path) GetErr(b BSON) (val Value, err error) {
+	if len(p.keys) == 0 {
+		return
+	}
+	val = Value{valueType: TypeDocument, valueData: b}
+	for _, k := range p.keys {
+		if val.valueType != TypeDocument && val.valueType != TypeArray {
+			return Value{}, nil
+		}
+		val, err = BSON(val.valueData).lookupKey(k)
+		if err != nil || val.valueType == TypeEmpty {
+			return
+		}
+	}
+	return
+}
+
+func (b BSON) lookupKey(key []byte) (Value, error) {
+	it := b.Elements()
+	for it.Next() {
+		if bytes.Equal(it.key, key) {
+			return it.val, nil
+		}
+	}
+	return Value{}, it.err
+}
+
+// MultiPath extracts several dotted paths with a single scan of each
+// document level. Paths sharing a prefix share the scan of that prefix.
+// A MultiPath is safe for concurrent use.
+type MultiPath struct {
+	paths []Path
+	root  multiPathNode
+}
+
+type multiPathNode struct {
+	key      []byte
+	indices  []int // paths ending at this node
+	children []*multiPathNode
+}
+
+// NewMultiPath compiles the dotted paths. The values returned by Get are in
+// the same order as paths.
+func NewMultiPath(paths ...string) *MultiPath {
+	m := &MultiPath{}
+	for i, path := range paths {
+		p := CompilePath(path)
+		m.paths = append(m.paths, p)
+		if len(p.keys) == 0 {
+			continue
+		}
+		n := &m.root
+		for _, k := range p.keys {
+			n = n.child(k)
+		}
+		n.indices = append(n.indices, i)
+	}
+	return m
+}
+
+func (n *multiPathNode) child(key []byte) *multiPathNode {
+	for _, c := range n.children {
+		if bytes.Equal(c.key, key) {
+			return c
+		}
+	}
+	c := &multiPathNode{key: key}
+	n.children = append(n.children, c)
+	return c
+}
+
+// Paths returns the compiled paths.
+func (m *MultiPath) Paths() []Path {
+	return m.paths
+}
+
+// Get returns the value of every path in b, in the order they were given,
+// with an empty Value for the paths that do not exist. It panics if b is
+// malformed.
+func (m *MultiPath) Get(b BSON) []Value {
+	vals, err := m.GetErr(b)
+	if err != nil {
+		panic(err)
+	}
+	return vals
+}
+
+// GetErr is like Get but returns an error instead of panicking.
+func (m *MultiPath) GetErr(b BSON) ([]Value, error) {
+	return m.AppendValues(nil, b)
+}
+
+// AppendValues appends one value per path to dst, an empty Value if the path
+// does not exist, so that dst can be reused across documents.
+func (m *MultiPath) AppendValues(dst []Value, b BSON) ([]Value, error) {
+	start := len(dst)
+	for range m.paths {
+		dst = append(dst, Value{})
+	}
+	return dst, m.root.fill(dst[start:], b)
+}
+
+// fill scans doc once and sets the values of all paths below n. Like
+// lookupOne, the first element with a matching key wins.
+func (n *multiPathNode) fill(vals []Value, doc BSON) error {
+	var buf [16]bool
+	var seen []bool
+	if len(n.children) <= len(buf) {
+		seen = buf[:len(n.children)]
+	} else {
+		seen = make([]bool, len(n.children))
+	}
+	found := 0
+	it := doc.Elements()
+	for found < len(n.children) && it.Next() {
+		for i, c := range n.children {
+			if seen[i] || !bytes.Equal(c.key, it.key) {
+				continue
+			}
+			seen[i] = true
+			found++
+			for _, idx := range c.indices {
+				vals[idx] = it.val
+			}
+			if len(c.children) > 0 && (it.val.valueType == TypeDocument || it.val.valueType == TypeArray) {
+				if err := c.fill(vals, it.val.valueData); err != nil {
+					return withOffset(withKey(err, it.key), it.valueOffset())
+				}
+			}
+			break
+		}
+	}
+	return it.err
+}
@@ -0,0 +1,204 @@
+package bsonex
+
+import (
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Conversions between the bsonex types and the types of the official driver
+// in go.mongodb.org/mongo-driver/bson/primitive. Marshal and Unmarshal also
+// accept the primitive types.
+
+func ObjectIdFromPrimitive(id primitive.ObjectID) ObjectId {
+	return ObjectId(id[:])
+}
+
+// ToPrimitive returns the zero ObjectID if id is not valid.
+func (id ObjectId) ToPrimitive() (p primitive.ObjectID) {
+	if id.Valid() {
+		copy(p[:], id)
+	}
+	return
+}
+
+func RegExFromPrimitive(r primitive.Regex) RegEx {
+	return RegEx{Pattern: r.Pattern, Options: r.Options}
+}
+
+func (r RegEx) ToPrimitive() primitive.Regex {
+	return primitive.Regex{Pattern: r.Pattern, Options: r.Options}
+}
+
+func DBPointerFromPrimitive(p primitive.DBPointer) DBPointer {
+	return DBPointer{Namespace: p.DB, Id: ObjectIdFromPrimitive(p.Pointer)}
+}
+
+func (p DBPointer) ToPrimitive() primitive.DBPointer {
+	return primitive.DBPointer{DB: p.Namespace, Pointer: p.Id.ToPrimitive()}
+}
+
+func MongoTimestampFromPrimitive(ts primitive.Timestamp) MongoTimestamp {
+	return MongoTimestamp(int64(ts.T)<<32 | int64(ts.I))
+}
+
+func (ts MongoTimestamp) ToPrimitive() primitive.Timestamp {
+	return primitive.Timestamp{T: ts.T(), I: ts.I()}
+}
+
+func BinaryFromPrimitive(b primitive.Binary) Binary {
+	return Binary{Kind: b.Subtype, Data: b.Data}
+}
+
+func (b Binary) ToPrimitive() primitive.Binary {
+	return primitive.Binary{Subtype: b.Kind, Data: b.Data}
+}
+
+func Decimal128FromPrimitive(d primitive.Decimal128) Decimal128 {
+	return NewDecimal128(d.GetBytes())
+}
+
+func (d Decimal128) ToPrimitive() primitive.Decimal128 {
+	return primitive.NewDecimal128(d.GetBytes())
+}
+
+// MFromPrimitive converts m and the primitive values nested in it.
+func MFromPrimitive(m primitive.M) M {
+	return fromPrimitiveValue(m).(M)
+}
+
+// ToPrimitive converts m and the bsonex values nested in it.
+func (m M) ToPrimitive() primitive.M {
+	return toPrimitiveValue(m).(primitive.M)
+}
+
+// toPrimitiveValue converts v, and the values nested in documents and
+// arrays, to the primitive types.
+func toPrimitiveValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case M:
+		m := make(primitive.M, len(v))
+		for k, e := range v {
+			m[k] = toPrimitiveValue(e)
+		}
+		return m
+	case []interface{}:
+		a := make(primitive.A, len(v))
+		for i, e := range v {
+			a[i] = toPrimitiveValue(e)
+		}
+		return a
+	case D:
+		d := make(primitive.D, len(v))
+		for i, e := range v {
+			d[i] = primitive.E{Key: e.Key, Value: toPrimitiveValue(e.Value)}
+		}
+		return d
+	case ObjectId:
+		return v.ToPrimitive()
+	case RegEx:
+		return v.ToPrimitive()
+	case DBPointer:
+		return v.ToPrimitive()
+	case MongoTimestamp:
+		return v.ToPrimitive()
+	case Binary:
+		return v.ToPrimitive()
+	case Decimal128:
+		return v.ToPrimitive()
+	case time.Time:
+		return primitive.NewDateTimeFromTime(v)
+	case Symbol:
+		return primitive.Symbol(v)
+	case JavaScript:
+		if v.Scope == nil {
+			return primitive.JavaScript(v.Code)
+		}
+		return primitive.CodeWithScope{Code: primitive.JavaScript(v.Code), Scope: toPrimitiveValue(v.Scope)}
+	}
+	switch v {
+	case MinKey:
+		return primitive.MinKey{}
+	case MaxKey:
+		return primitive.MaxKey{}
+	case Undefined:
+		return primitive.Undefined{}
+	}
+	return v
+}
+
+// fromPrimitiveValue is the reverse of toPrimitiveValue.
+func fromPrimitiveValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case primitive.M:
+		m := make(M, len(v))
+		for k, e := range v {
+			m[k] = fromPrimitiveValue(e)
+		}
+		return m
+	case primitive.A:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = fromPrimitiveValue(e)
+		}
+		return a
+	case primitive.D:
+		d := make(D, len(v))
+		for i, e := range v {
+			d[i] = E{Key: e.Key, Value: fromPrimitiveValue(e.Value)}
+		}
+		return d
+	case primitive.ObjectID:
+		return ObjectIdFromPrimitive(v)
+	case primitive.Regex:
+		return RegExFromPrimitive(v)
+	case primitive.DBPointer:
+		return DBPointerFromPrimitive(v)
+	case primitive.Timestamp:
+		return MongoTimestampFromPrimitive(v)
+	case primitive.Binary:
+		return BinaryFromPrimitive(v)
+	case primitive.Decimal128:
+		return Decimal128FromPrimitive(v)
+	case primitive.DateTime:
+		return v.Time()
+	case primitive.Symbol:
+		return Symbol(v)
+	case primitive.JavaScript:
+		return JavaScript{Code: string(v)}
+	case primitive.CodeWithScope:
+		return JavaScript{Code: string(v.Code), Scope: fromPrimitiveValue(v.Scope)}
+	case primitive.MinKey:
+		return MinKey
+	case primitive.MaxKey:
+		return MaxKey
+	case primitive.Undefined:
+		return Undefined
+	case primitive.Null:
+		return nil
+	}
+	return v
+}
+
+// primitiveTypes are the primitive types Marshal and Unmarshal convert from
+// and to the bsonex type holding the same values.
+var primitiveTypes = map[reflect.Type]reflect.Type{
+	reflect.TypeOf(primitive.ObjectID{}):      typeOfObjectId,
+	reflect.TypeOf(primitive.Regex{}):         typeOfRegEx,
+	reflect.TypeOf(primitive.DBPointer{}):     typeOfDBPointer,
+	reflect.TypeOf(primitive.Timestamp{}):     typeOfTimestamp,
+	reflect.TypeOf(primitive.Binary{}):        typeOfBinary,
+	reflect.TypeOf(primitive.Decimal128{}):    typeOfDecimal128,
+	reflect.TypeOf(primitive.DateTime(0)):     typeOfTime,
+	reflect.TypeOf(primitive.Symbol("")):      typeOfSymbol,
+	reflect.TypeOf(primitive.JavaScript("")):  typeOfJavaScript,
+	reflect.TypeOf(primitive.CodeWithScope{}): typeOfJavaScript,
+	reflect.TypeOf(primitive.MinKey{}):        typeOfOrderKey,
+	reflect.TypeOf(primitive.MaxKey{}):        typeOfOrderKey,
+	reflect.TypeOf(primitive.Undefined{}):     typeOfUndefined,
+	reflect.TypeOf(primitive.Null{}):          typeOfInterface,
+	reflect.TypeOf(primitive.M{}):             typeOfM,
+	reflect.TypeOf(primitive.A{}):             typeOfArray,
+	reflect.TypeOf(primitive.D{}):             typeOfD,
+}
@@ -0,0 +1,83 @@
+package bsonex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type primitiveStruct struct {
+	Id    primitive.ObjectID
+	Re    primitive.Regex
+	Ptr   primitive.DBPointer
+	Ts    primitive.Timestamp
+	Bin   primitive.Binary
+	Dec   primitive.Decimal128
+	Time  primitive.DateTime
+	Sym   primitive.Symbol
+	JS    primitive.JavaScript
+	Scope primitive.CodeWithScope
+	Min   primitive.MinKey
+	Max   primitive.MaxKey
+	Undef primitive.Undefined
+	Doc   primitive.M
+	Arr   primitive.A
+	D     primitive.D
+}
+
+func TestPrimitiveConversions(t *testing.T) {
+	dec, _ := ParseDecimal128("1.25")
+	pid := id.ToPrimitive()
+	assert.Equal(t, id.Hex(), pid.Hex())
+	assert.Equal(t, id, ObjectIdFromPrimitive(pid))
+	assert.Equal(t, primitive.NilObjectID, ObjectId("short").ToPrimitive())
+	assert.Equal(t, RegEx{"a", "i"}, RegExFromPrimitive(RegEx{"a", "i"}.ToPrimitive()))
+	assert.Equal(t, DBPointer{"a.b", id}, DBPointerFromPrimitive(DBPointer{"a.b", id}.ToPrimitive()))
+	assert.Equal(t, primitive.Timestamp{T: ts.T(), I: ts.I()}, ts.ToPrimitive())
+	assert.Equal(t, ts, MongoTimestampFromPrimitive(ts.ToPrimitive()))
+	assert.Equal(t, Binary{0x80, []byte{1}}, BinaryFromPrimitive(Binary{0x80, []byte{1}}.ToPrimitive()))
+	assert.Equal(t, "1.25", dec.ToPrimitive().String())
+	assert.Equal(t, dec, Decimal128FromPrimitive(dec.ToPrimitive()))
+
+	m := M{"id": id, "a": []interface{}{M{"t": now}, MinKey}, "d": D{{Key: "s", Value: Symbol("x")}}}
+	pm := primitive.M{
+		"id": pid,
+		"a":  primitive.A{primitive.M{"t": primitive.NewDateTimeFromTime(now)}, primitive.MinKey{}},
+		"d":  primitive.D{{Key: "s", Value: primitive.Symbol("x")}},
+	}
+	assert.Equal(t, pm, m.ToPrimitive())
+	assert.Equal(t, m, MFromPrimitive(pm))
+}
+
+func TestPrimitiveMarshal(t *testing.T) {
+	dec, _ := ParseDecimal128("1.25")
+	in := primitiveStruct{
+		Id: id.ToPrimitive(), Re: primitive.Regex{Pattern: "a", Options: "i"},
+		Ptr: primitive.DBPointer{DB: "a.b", Pointer: id.ToPrimitive()}, Ts: ts.ToPrimitive(),
+		Bin: primitive.Binary{Subtype: 0x80, Data: []byte{1}}, Dec: dec.ToPrimitive(),
+		Time: primitive.NewDateTimeFromTime(now), Sym: "sym", JS: "f()",
+		Scope: primitive.CodeWithScope{Code: "g()", Scope: primitive.M{"a": int32(1)}},
+		Doc:   primitive.M{"id": id.ToPrimitive()}, Arr: primitive.A{int32(1), "a"},
+		D: primitive.D{{Key: "b", Value: int32(2)}, {Key: "a", Value: primitive.Timestamp{T: 1, I: 2}}},
+	}
+	bs, err := Marshal(&in)
+	assert.NoError(t, err)
+	b := BSON(bs)
+	assert.Equal(t, id, b.Lookup("id").Objid())
+	assert.Equal(t, ts, b.Lookup("ts").MongoTimestamp())
+	assert.Equal(t, now, b.Lookup("time").Time())
+	assert.True(t, b.Lookup("min").IsMinKey())
+	assert.True(t, b.Lookup("undef").IsUndefined())
+	assert.Equal(t, `{"b":2,"a":4294967298}`, b.Lookup("d").Document().String())
+	assert.Equal(t, MongoTimestamp(1<<32|2), b.Lookup("d.a").MongoTimestamp())
+
+	var out primitiveStruct
+	assert.NoError(t, Unmarshal(bs, &out))
+	assert.Equal(t, in, out)
+
+	// a CodeWithScope does not fit a JavaScript
+	bs, _ = Marshal(M{"js": JavaScript{Code: "f()", Scope: M{}}})
+	var js primitive.JavaScript
+	assert.Error(t, BSON(bs).Lookup("js").Unmarshal(&js))
+}
@@ -0,0 +1,342 @@
+package bsonex
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ProjectionError reports an invalid projection document. Path holds the
+// keys leading to the offending field.
+type ProjectionError struct {
+	Path []string
+	Msg  string
+}
+
+func (e *ProjectionError) Error() string {
+	if len(e.Path) == 0 {
+		return "bsonex: projection: " + e.Msg
+	}
+	return "bsonex: projection: " + e.Msg + " at key " + strconv.Quote(strings.Join(e.Path, "."))
+}
+
+func projectionErrorf(path string, format string, a ...interface{}) error {
+	return &ProjectionError{Path: []string{path}, Msg: fmt.Sprintf(format, a...)}
+}
+
+// Projection is a compiled MongoDB projection document. Fields are included
+// with 1 or true and excluded with 0 or false, the two can not be mixed
+// except for _id, which is included unless excluded explicitly. Paths are
+// dotted and descend into arrays. Arrays can be cut with {$slice: n} or
+// {$slice: [skip, limit]}, {$elemMatch: query} keeps the first matching
+// element only.
+//
+// The result is built by copying element bytes in document order. A
+// Projection is safe for concurrent use.
+type Projection struct {
+	spec      BSON
+	root      *projectionNode
+	inclusion bool
+}
+
+type projectionNode struct {
+	children  map[string]*projectionNode
+	include   bool
+	exclude   bool
+	slice     bool
+	skip      int
+	limit     int // -1 for no limit
+	elemMatch *elemMatchMatcher
+}
+
+func (n *projectionNode) isLeaf() bool {
+	return n.include || n.exclude || n.slice || n.elemMatch != nil
+}
+
+// NewProjection compiles spec. The spec is copied, so it may be reused after
+// NewProjection returns.
+func NewProjection(spec BSON) (*Projection, error) {
+	spec = append(BSON(nil), spec...)
+	if _, err := spec.elements(); err != nil {
+		return nil, err
+	}
+	p := &Projection{spec: spec, root: &projectionNode{}}
+	var hasInclude, hasExclude, hasElemMatch, idInclude bool
+	it := spec.Elements()
+	for it.Next() {
+		path := string(it.key)
+		n, err := p.root.add(path)
+		if err != nil {
+			return nil, err
+		}
+		switch v := it.val; {
+		case v.valueType == TypeBoolean || isNumber(v.valueType):
+			switch {
+			case path == "_id":
+				n.include = truthy(v)
+				n.exclude = !n.include
+				idInclude = n.include
+			case truthy(v):
+				n.include, hasInclude = true, true
+			default:
+				n.exclude, hasExclude = true, true
+			}
+		case v.valueType == TypeDocument:
+			if err := n.compileOperator(path, v.valueData); err != nil {
+				return nil, err
+			}
+			hasElemMatch = hasElemMatch || n.elemMatch != nil
+		default:
+			return nil, projectionErrorf(path, "invalid value %s", v)
+		}
+	}
+	if it.err != nil {
+		return nil, it.err
+	}
+	if hasInclude && hasExclude {
+		return nil, &ProjectionError{Msg: "cannot mix inclusion and exclusion"}
+	}
+	p.inclusion = hasInclude || hasElemMatch || (idInclude && !hasExclude)
+	if p.inclusion {
+		if _, ok := p.root.children["_id"]; !ok {
+			p.root.children["_id"] = &projectionNode{include: true}
+		}
+	}
+	return p, nil
+}
+
+// NewFieldsProjection returns a projection including the given dotted paths,
+// like {path1: 1, path2: 1, ...}.
+func NewFieldsProjection(paths ...string) (*Projection, error) {
+	b := NewBuilder()
+	for _, path := range paths {
+		b.AppendInt32(path, 1)
+	}
+	spec, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	return NewProjection(spec)
+}
+
+// add returns a new node for the dotted path.
+func (n *projectionNode) add(path string) (*projectionNode, error) {
+	for _, k := range strings.Split(path, ".") {
+		if k == "" {
+			return nil, projectionErrorf(path, "empty field name")
+		}
+		if n.isLeaf() {
+			return nil, projectionErrorf(path, "path collision")
+		}
+		if n.children == nil {
+			n.children = map[string]*projectionNode{}
+		}
+		child, ok := n.children[k]
+		if !ok {
+			child = &projectionNode{}
+			n.children[k] = child
+		}
+		n = child
+	}
+	if n.isLeaf() || n.children != nil {
+		return nil, projectionErrorf(path, "path collision")
+	}
+	return n, nil
+}
+
+func (n *projectionNode) compileOperator(path string, op BSON) error {
+	it := op.Elements()
+	if !it.Next() {
+		return projectionErrorf(path, "empty operator document")
+	}
+	switch v := it.val; string(it.key) {
+	case "$slice":
+		n.slice, n.limit = true, -1
+		if v.valueType == TypeArray {
+			arr, err := BSON(v.valueData).ToValueArrayErr()
+			if err != nil {
+				return err
+			}
+			if len(arr) != 2 || !isNumber(arr[0].valueType) || !isNumber(arr[1].valueType) {
+				return projectionErrorf(path, "$slice needs a number or [skip, limit]")
+			}
+			skip, _ := numberInt64(arr[0])
+			limit, _ := numberInt64(arr[1])
+			if limit <= 0 {
+				return projectionErrorf(path, "$slice limit must be positive")
+			}
+			n.skip, n.limit = int(skip), int(limit)
+		} else if i, ok := numberInt64(v); ok && isNumber(v.valueType) {
+			if i >= 0 {
+				n.limit = int(i)
+			} else {
+				n.skip = int(i)
+			}
+		} else {
+			return projectionErrorf(path, "$slice needs a number or [skip, limit]")
+		}
+	case "$elemMatch":
+		m, err := compileOperator("$elemMatch", v, Value{})
+		if err != nil {
+			return withFilterKey(err, path)
+		}
+		n.elemMatch = m.(*elemMatchMatcher)
+	default:
+		return projectionErrorf(path, "unknown operator %s", it.key)
+	}
+	if it.Next() {
+		return projectionErrorf(path, "operator document must have one key")
+	}
+	return it.err
+}
+
+// Spec returns the projection document the projection was compiled from.
+func (p *Projection) Spec() BSON {
+	return p.spec
+}
+
+// Apply returns a new document holding the projected fields of b.
+func (p *Projection) Apply(b BSON) (BSON, error) {
+	return p.AppendTo(make(BSON, 0, len(b)), b)
+}
+
+// AppendTo appends the projection of b to dst.
+func (p *Projection) AppendTo(dst []byte, b BSON) ([]byte, error) {
+	return p.appendDocument(dst, b, p.root)
+}
+
+// Project applies the projection spec to b, see Projection.
+func (b BSON) Project(spec BSON) (BSON, error) {
+	p, err := NewProjection(spec)
+	if err != nil {
+		return nil, err
+	}
+	return p.Apply(b)
+}
+
+func (p *Projection) appendDocument(dst []byte, doc BSON, node *projectionNode) ([]byte, error) {
+	dst, start := startDocument(dst)
+	it := doc.Elements()
+	for it.Next() {
+		var err error
+		dst, err = p.appendElement(dst, it.key, it.val, node.children[string(it.key)])
+		if err != nil {
+			return dst, withOffset(withKey(err, it.key), it.valueOffset())
+		}
+	}
+	if it.err != nil {
+		return dst, it.err
+	}
+	return endDocument(dst, start), nil
+}
+
+func (p *Projection) appendElement(dst []byte, key []byte, v Value, n *projectionNode) ([]byte, error) {
+	switch {
+	case n == nil:
+		if p.inclusion {
+			return dst, nil
+		}
+		return appendElement(dst, key, v), nil
+	case n.exclude:
+		return dst, nil
+	case n.include:
+		return appendElement(dst, key, v), nil
+	case n.slice:
+		if v.valueType != TypeArray {
+			return appendElement(dst, key, v), nil
+		}
+		return appendSlice(appendElementHeader(dst, TypeArray, string(key)), v.valueData, n.skip, n.limit)
+	case n.elemMatch != nil:
+		if v.valueType != TypeArray {
+			return dst, nil
+		}
+		it := BSON(v.valueData).Elements()
+		for it.Next() {
+			if n.elemMatch.matchElement(it.val) {
+				dst, start := startDocument(appendElementHeader(dst, TypeArray, string(key)))
+				dst = appendElement(dst, []byte("0"), it.val)
+				return endDocument(dst, start), nil
+			}
+		}
+		return dst, it.err
+	}
+	switch v.valueType {
+	case TypeDocument:
+		return p.appendDocument(appendElementHeader(dst, TypeDocument, string(key)), v.valueData, n)
+	case TypeArray:
+		return p.appendArray(appendElementHeader(dst, TypeArray, string(key)), v.valueData, n)
+	}
+	if p.inclusion {
+		return dst, nil
+	}
+	return appendElement(dst, key, v), nil
+}
+
+// appendArray projects every document in arr with node. Other elements are
+// kept in exclusion mode and dropped in inclusion mode.
+func (p *Projection) appendArray(dst []byte, arr BSON, node *projectionNode) ([]byte, error) {
+	dst, start := startDocument(dst)
+	var key []byte
+	i := 0
+	it := arr.Elements()
+	for it.Next() {
+		key = strconv.AppendInt(key[:0], int64(i), 10)
+		var err error
+		switch it.val.valueType {
+		case TypeDocument:
+			dst, err = p.appendDocument(append(append(append(dst, TypeDocument), key...), 0x00), it.val.valueData, node)
+		case TypeArray:
+			dst, err = p.appendArray(append(append(append(dst, TypeArray), key...), 0x00), it.val.valueData, node)
+		default:
+			if p.inclusion {
+				continue
+			}
+			dst = appendElement(dst, key, it.val)
+			i++
+			continue
+		}
+		if err != nil {
+			return dst, withOffset(withKey(err, it.key), it.valueOffset())
+		}
+		i++
+	}
+	if it.err != nil {
+		return dst, it.err
+	}
+	return endDocument(dst, start), nil
+}
+
+// appendSlice appends the elements of arr selected by skip and limit as a new
+// array. A negative skip counts from the end.
+func appendSlice(dst []byte, arr BSON, skip, limit int) ([]byte, error) {
+	n := 0
+	it := arr.Elements()
+	for it.Next() {
+		n++
+	}
+	if it.err != nil {
+		return dst, it.err
+	}
+	from := skip
+	if from < 0 {
+		from += n
+		if from < 0 {
+			from = 0
+		}
+	}
+	to := n
+	// limit may be as large as math.MaxInt64, compare without adding
+	if limit >= 0 && limit < n-from {
+		to = from + limit
+	}
+	dst, start := startDocument(dst)
+	var key []byte
+	it = arr.Elements()
+	for i := 0; it.Next(); i++ {
+		if i >= from && i < to {
+			key = strconv.AppendInt(key[:0], int64(i-from), 10)
+			dst = appendElement(dst, key, it.val)
+		}
+	}
+	return endDocument(dst, start), nil
+}
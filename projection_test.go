@@ -0,0 +1,82 @@
+package bsonex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProject(t *testing.T) {
+	doc, err := ParseExtJSON([]byte(`{
+		"_id": 1,
+		"name": "alice",
+		"addr": {"city": "paris", "zip": "75001", "geo": {"lat": 1, "lng": 2}},
+		"items": [{"sku": "a1", "qty": 2}, {"sku": "b2", "qty": 10}, 7],
+		"tags": ["a", "b", "c", "d", "e"]
+	}`))
+	assert.NoError(t, err)
+
+	for _, c := range []struct {
+		spec, want string
+	}{
+		{`{}`, `{"_id":1,"name":"alice","addr":{"city":"paris","zip":"75001","geo":{"lat":1,"lng":2}},"items":[{"sku":"a1","qty":2},{"sku":"b2","qty":10},7],"tags":["a","b","c","d","e"]}`},
+		{`{"name": 1}`, `{"_id":1,"name":"alice"}`},
+		{`{"name": true, "_id": 0}`, `{"name":"alice"}`},
+		{`{"_id": 1}`, `{"_id":1}`},
+		{`{"tags": 1, "name": 1}`, `{"_id":1,"name":"alice","tags":["a","b","c","d","e"]}`},
+		{`{"addr.city": 1, "addr.geo.lng": 1}`, `{"_id":1,"addr":{"city":"paris","geo":{"lng":2}}}`},
+		{`{"addr.nope": 1}`, `{"_id":1,"addr":{}}`},
+		{`{"name.nope": 1}`, `{"_id":1}`},
+		{`{"items.sku": 1}`, `{"_id":1,"items":[{"sku":"a1"},{"sku":"b2"}]}`},
+		{`{"addr": 0, "tags": 0, "items": 0}`, `{"_id":1,"name":"alice"}`},
+		{`{"_id": 0, "addr.geo": 0, "items.qty": 0, "tags": 0}`, `{"name":"alice","addr":{"city":"paris","zip":"75001"},"items":[{"sku":"a1"},{"sku":"b2"},7]}`},
+		{`{"_id": 1, "name": 0, "addr": 0, "items": 0}`, `{"_id":1,"tags":["a","b","c","d","e"]}`},
+		{`{"tags": {"$slice": 2}, "name": 1}`, `{"_id":1,"name":"alice","tags":["a","b"]}`},
+		{`{"tags": {"$slice": -2}, "name": 0, "addr": 0, "items": 0}`, `{"_id":1,"tags":["d","e"]}`},
+		{`{"tags": {"$slice": [1, 2]}, "_id": 0, "name": 0, "addr": 0, "items": 0}`, `{"tags":["b","c"]}`},
+		{`{"tags": {"$slice": [-2, 5]}, "_id": 0, "name": 0, "addr": 0, "items": 0}`, `{"tags":["d","e"]}`},
+		{`{"tags": {"$slice": [10, 1]}, "_id": 0, "name": 0, "addr": 0, "items": 0}`, `{"tags":[]}`},
+		{`{"tags": {"$slice": [1, {"$numberLong": "9223372036854775807"}]}, "_id": 0, "name": 0, "addr": 0, "items": 0}`, `{"tags":["b","c","d","e"]}`},
+		{`{"tags": {"$slice": [{"$numberLong": "-9223372036854775808"}, 1]}, "_id": 0, "name": 0, "addr": 0, "items": 0}`, `{"tags":["a"]}`},
+		{`{"tags": {"$slice": {"$numberLong": "9223372036854775807"}}, "_id": 0, "name": 0, "addr": 0, "items": 0}`, `{"tags":["a","b","c","d","e"]}`},
+		{`{"items": {"$elemMatch": {"qty": {"$gt": 5}}}}`, `{"_id":1,"items":[{"sku":"b2","qty":10}]}`},
+		{`{"items": {"$elemMatch": {"qty": {"$gt": 50}}}, "name": 1}`, `{"_id":1,"name":"alice"}`},
+		{`{"tags": {"$elemMatch": {"$gt": "b"}}}`, `{"_id":1,"tags":["c"]}`},
+	} {
+		spec, err := ParseExtJSON([]byte(c.spec))
+		if !assert.NoError(t, err, c.spec) {
+			continue
+		}
+		got, err := doc.Project(spec)
+		if !assert.NoError(t, err, c.spec) {
+			continue
+		}
+		assert.NoError(t, got.Validate(), c.spec)
+		j, err := got.ToJson()
+		assert.NoError(t, err)
+		assert.Equal(t, c.want, string(j), c.spec)
+	}
+}
+
+func TestProjectionError(t *testing.T) {
+	for _, spec := range []string{
+		`{"a": 1, "b": 0}`,
+		`{"a": 1, "a.b": 1}`,
+		`{"a.b": 1, "a": 1}`,
+		`{"a..b": 1}`,
+		`{"a": "x"}`,
+		`{"a": {"$slice": "x"}}`,
+		`{"a": {"$slice": [1, 0]}}`,
+		`{"a": {"$foo": 1}}`,
+		`{"a": {"$slice": 1, "$elemMatch": {}}}`,
+	} {
+		s, err := ParseExtJSON([]byte(spec))
+		assert.NoError(t, err, spec)
+		_, err = NewProjection(s)
+		assert.IsType(t, &ProjectionError{}, err, spec)
+	}
+	s, err := ParseExtJSON([]byte(`{"a": {"$elemMatch": {"$foo": 1}}}`))
+	assert.NoError(t, err)
+	_, err = NewProjection(s)
+	assert.IsType(t, &FilterError{}, err)
+}
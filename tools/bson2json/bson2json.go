@@ -5,13 +5,35 @@ import (
 	"io"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/ma6174/bsonex"
 )
 
 func main() {
 	parallel := flag.Int("p", 1, "parallel count")
+	recoverMode := flag.Bool("recover", false, "skip corrupted bytes instead of stopping")
+	mode := flag.String("mode", "json", "output format: json, canonical or relaxed (extended json v2)")
+	fields := flag.String("fields", "", "comma separated dotted paths to output, e.g. a,b.c")
 	flag.Parse()
+	var proj *bsonex.Projection
+	if *fields != "" {
+		var err error
+		proj, err = bsonex.NewFieldsProjection(strings.Split(*fields, ",")...)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+	toJson := func(b bsonex.BSON) ([]byte, error) { return b.ToJson() }
+	switch *mode {
+	case "json":
+	case "canonical":
+		toJson = func(b bsonex.BSON) ([]byte, error) { return b.ToExtJSON(bsonex.ExtJSONCanonical) }
+	case "relaxed":
+		toJson = func(b bsonex.BSON) ([]byte, error) { return b.ToExtJSON(bsonex.ExtJSONRelaxed) }
+	default:
+		log.Panicln("invalid mode:", *mode)
+	}
 	var r io.Reader = os.Stdin
 	var files []io.Reader
 	for _, name := range flag.Args() {
@@ -24,8 +46,25 @@ func main() {
 	if len(files) > 0 {
 		r = io.MultiReader(files...)
 	}
-	err := bsonex.NewDecoder(r).Do(*parallel, func(b bsonex.BSONEX) (err error) {
-		_, err = os.Stdout.Write(append(b.MustToJson(), '\n'))
+	d := bsonex.NewDecoderWithOptions(r, bsonex.Options{ZeroCopy: true})
+	if *recoverMode {
+		d.SetRecover(func(start, end int64, err error) {
+			log.Printf("skipped bytes [%d, %d): %v", start, end, err)
+		})
+	}
+	err := d.DoOrdered(*parallel, func(b bsonex.BSONEX) (_ interface{}, err error) {
+		if proj != nil {
+			if b.BSON, err = proj.Apply(b.BSON); err != nil {
+				return nil, err
+			}
+		}
+		j, err := toJson(b.BSON)
+		if err != nil {
+			return nil, err
+		}
+		return append(j, '\n'), nil
+	}, func(_ bsonex.BSONEX, j interface{}) error {
+		_, err := os.Stdout.Write(j.([]byte))
 		return err
 	})
 	if err != nil {
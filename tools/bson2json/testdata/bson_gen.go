@@ -4,11 +4,11 @@ import (
 	"fmt"
 	"log"
 
-	"github.com/globalsign/mgo/bson"
+	"github.com/ma6174/bsonex"
 )
 
 func main() {
-	b, err := bson.Marshal(map[string]interface{}{
+	b, err := bsonex.Marshal(map[string]interface{}{
 		"int":    int(123),
 		"float":  float64(4.5),
 		"array":  []string{"a", "b"},
@@ -19,7 +19,7 @@ func main() {
 		log.Panicln(err)
 	}
 	fmt.Print(string(b))
-	b, err = bson.Marshal([]string{"a", "b"})
+	b, err = bsonex.Marshal([]string{"a", "b"})
 	if err != nil {
 		log.Panicln(err)
 	}
@@ -11,7 +11,6 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/globalsign/mgo/bson"
 	"github.com/ma6174/bsonex"
 )
 
@@ -52,7 +51,7 @@ var ps = parsers{
 	"int32":   func(input string) interface{} { return int32(int64Parser(input).(int64)) },
 	"int64":   int64Parser,
 	"float64": float64Parser,
-	"objid":   func(input string) interface{} { return bson.ObjectIdHex(input) },
+	"objid":   func(input string) interface{} { return bsonex.ObjectIdHex(input) },
 }
 
 var (
@@ -61,41 +60,109 @@ var (
 	process      = flag.Int("p", 1, "process")
 	strFullMatch = flag.Bool("strfullmatch", false, "full match string")
 	outType      = flag.String("o", "json", "output format, json or bson")
+	recoverMode  = flag.Bool("recover", false, "skip corrupted bytes instead of stopping")
+	fields       = flag.String("fields", "", "comma separated dotted paths to output, e.g. a,b.c")
+	query        = flag.String("q", "", `query document in JSON or Extended JSON, e.g. '{"age":{"$gt":30}}'`)
 )
 
+// queryMatcher compiles the -q query. Strings, ObjectIds and dates compared
+// for equality are checked with FastContains before the filter is evaluated.
+func queryMatcher(query string) (func(b bsonex.BSONEX) bool, error) {
+	q, err := bsonex.ParseExtJSON([]byte(query))
+	if err != nil {
+		return nil, err
+	}
+	f, err := bsonex.NewFilter(q)
+	if err != nil {
+		return nil, err
+	}
+	svs := f.SearchValues()
+	return func(b bsonex.BSONEX) bool {
+		for _, sv := range svs {
+			if !b.FastContains(sv) {
+				return false
+			}
+		}
+		return f.Match(b.BSON)
+	}, nil
+}
+
+// keyMatcher matches the -k key against the value given as argument.
+func keyMatcher(input string) (func(b bsonex.BSONEX) bool, error) {
+	v := ps.Parse(*valueType, input)
+	b1, err := bsonex.NewToSearchValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return func(b bsonex.BSONEX) bool {
+		if !b.FastContains(b1) {
+			return false
+		}
+		if *key == "" {
+			return true
+		}
+		str, ok := v.(string)
+		if !ok || *strFullMatch {
+			return reflect.DeepEqual(b.Lookup(*key).Value(), v)
+		}
+		return strings.Contains(b.Lookup(*key).Str(), str)
+	}, nil
+}
+
 func main() {
 	flag.Parse()
-	if flag.NArg() == 0 {
-		fmt.Printf("usage:\ncat <xxx.bson> | %v -t <type> <to_search_value>\n", os.Args[0])
+	if flag.NArg() == 0 && *query == "" {
+		fmt.Printf("usage:\ncat <xxx.bson> | %v -t <type> <to_search_value>\ncat <xxx.bson> | %v -q <query>\n", os.Args[0], os.Args[0])
 		return
 	}
-	v := ps.Parse(*valueType, flag.Arg(0))
-	b1, err := bsonex.NewToSearchValue(v)
+	var match func(b bsonex.BSONEX) bool
+	var err error
+	if *query != "" {
+		match, err = queryMatcher(*query)
+	} else {
+		match, err = keyMatcher(flag.Arg(0))
+	}
 	if err != nil {
-		log.Panicln(err)
+		log.Fatalln(err)
+	}
+	var proj *bsonex.Projection
+	if *fields != "" {
+		proj, err = bsonex.NewFieldsProjection(strings.Split(*fields, ",")...)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
 	out := bufio.NewWriterSize(os.Stdout, 1<<20)
-	err = bsonex.NewDecoder(os.Stdin).Do(*process, func(b bsonex.BSONEX) (err error) {
-		if !b.FastContains(b1) {
-			return
+	d := bsonex.NewDecoderWithOptions(os.Stdin, bsonex.Options{ZeroCopy: true})
+	if *recoverMode {
+		d.SetRecover(func(start, end int64, err error) {
+			log.Printf("skipped bytes [%d, %d): %v", start, end, err)
+		})
+	}
+	err = d.DoOrdered(*process, func(b bsonex.BSONEX) (_ interface{}, err error) {
+		if !match(b) {
+			return nil, nil
 		}
-		isMatch := func() bool {
-			str, ok := v.(string)
-			if !ok || *strFullMatch {
-				return reflect.DeepEqual(b.Lookup(*key).Value(), v)
+		if proj != nil {
+			if b.BSON, err = proj.Apply(b.BSON); err != nil {
+				return nil, err
 			}
-			return strings.Contains(b.Lookup(*key).Str(), str)
 		}
-		if *key == "" || isMatch() {
-			switch *outType {
-			case "json":
-				out.Write(b.MustToJson())
-				err = out.WriteByte('\n')
-			case "bson":
-				_, err = out.Write(b.BSON)
-			default:
-				err = errors.New("invalid type")
+		switch *outType {
+		case "json":
+			j, err := b.ToJson()
+			if err != nil {
+				return nil, err
 			}
+			return append(j, '\n'), nil
+		case "bson":
+			return []byte(b.BSON), nil
+		default:
+			return nil, errors.New("invalid type")
+		}
+	}, func(_ bsonex.BSONEX, v interface{}) (err error) {
+		if v != nil {
+			_, err = out.Write(v.([]byte))
 		}
 		return
 	})
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/ma6174/bsonex"
+)
+
+func main() {
+	flag.Parse()
+	var r io.Reader = os.Stdin
+	var files []io.Reader
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Panicln(err)
+		}
+		files = append(files, f)
+	}
+	if len(files) > 0 {
+		r = io.MultiReader(files...)
+	}
+	out := bufio.NewWriterSize(os.Stdout, 1<<20)
+	jr := bsonex.NewExtJSONReader(bufio.NewReaderSize(r, 4<<20))
+	for {
+		b, err := jr.ReadOne()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Panicln(err)
+		}
+		if _, err = out.Write(b); err != nil {
+			log.Panicln(err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		log.Panicln(err)
+	}
+}
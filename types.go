@@ -0,0 +1,299 @@
+package bsonex
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ObjectId is a 12 byte MongoDB object id kept as a string, like mgo's
+// bson.ObjectId, so it can be compared and used as a map key. NewObjectId
+// uses the same layout as mgo: a 4 byte big endian timestamp in seconds, a 3
+// byte machine id, a 2 byte process id and a 3 byte big endian counter.
+type ObjectId string
+
+var (
+	objectIdMachine = readMachineId()
+	objectIdCounter = binary.BigEndian.Uint32(readRandom(4))
+)
+
+func readRandom(n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(fmt.Errorf("bsonex: cannot read random bytes: %v", err))
+	}
+	return b
+}
+
+// readMachineId returns the first 3 bytes of the md5 of the hostname, or
+// random bytes if it is not available.
+func readMachineId() []byte {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return readRandom(3)
+	}
+	sum := md5.Sum([]byte(hostname))
+	return sum[:3]
+}
+
+// NewObjectId returns a new unique ObjectId.
+func NewObjectId() ObjectId {
+	var b [12]byte
+	binary.BigEndian.PutUint32(b[:4], uint32(time.Now().Unix()))
+	copy(b[4:7], objectIdMachine)
+	pid := os.Getpid()
+	b[7], b[8] = byte(pid>>8), byte(pid)
+	i := atomic.AddUint32(&objectIdCounter, 1)
+	b[9], b[10], b[11] = byte(i>>16), byte(i>>8), byte(i)
+	return ObjectId(b[:])
+}
+
+// NewObjectIdWithTime returns an ObjectId with the timestamp of t and all
+// other bytes zero. It is only meant for range queries on _id.
+func NewObjectIdWithTime(t time.Time) ObjectId {
+	var b [12]byte
+	binary.BigEndian.PutUint32(b[:4], uint32(t.Unix()))
+	return ObjectId(b[:])
+}
+
+// ObjectIdHex returns the ObjectId of the 24 character hex string s. It
+// panics if s is invalid, see ObjectIdHexErr.
+func ObjectIdHex(s string) ObjectId {
+	id, err := ObjectIdHexErr(s)
+	must(err)
+	return id
+}
+
+func ObjectIdHexErr(s string) (ObjectId, error) {
+	var b [12]byte
+	if len(s) != 24 {
+		return "", fmt.Errorf("bsonex: invalid ObjectId hex %q", s)
+	}
+	if _, err := hex.Decode(b[:], []byte(s)); err != nil {
+		return "", fmt.Errorf("bsonex: invalid ObjectId hex %q", s)
+	}
+	return ObjectId(b[:]), nil
+}
+
+// IsObjectIdHex reports whether s is a valid ObjectId hex string.
+func IsObjectIdHex(s string) bool {
+	_, err := ObjectIdHexErr(s)
+	return err == nil
+}
+
+// Valid reports whether id is 12 bytes long.
+func (id ObjectId) Valid() bool {
+	return len(id) == 12
+}
+
+func (id ObjectId) Hex() string {
+	return hex.EncodeToString([]byte(id))
+}
+
+// String returns id in the same ObjectIdHex("...") form as mgo.
+func (id ObjectId) String() string {
+	return fmt.Sprintf(`ObjectIdHex("%x")`, string(id))
+}
+
+// Time returns the timestamp part of id. It panics if id is invalid.
+func (id ObjectId) Time() time.Time {
+	id.mustValid()
+	return time.Unix(int64(binary.BigEndian.Uint32([]byte(id[:4]))), 0)
+}
+
+// Machine returns the 3 byte machine id part of id. It panics if id is
+// invalid.
+func (id ObjectId) Machine() []byte {
+	id.mustValid()
+	return []byte(id[4:7])
+}
+
+// Pid returns the process id part of id. It panics if id is invalid.
+func (id ObjectId) Pid() uint16 {
+	id.mustValid()
+	return binary.BigEndian.Uint16([]byte(id[7:9]))
+}
+
+// Counter returns the 3 byte counter part of id. It panics if id is invalid.
+func (id ObjectId) Counter() int32 {
+	id.mustValid()
+	return int32(id[9])<<16 | int32(id[10])<<8 | int32(id[11])
+}
+
+func (id ObjectId) mustValid() {
+	if !id.Valid() {
+		panic(fmt.Sprintf("bsonex: invalid ObjectId %q", string(id)))
+	}
+}
+
+func (id ObjectId) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + id.Hex() + `"`), nil
+}
+
+// UnmarshalJSON accepts a hex string, {"$oid": hex}, "" or null.
+func (id *ObjectId) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*id = ""
+		return nil
+	}
+	var s string
+	if len(data) > 0 && data[0] == '{' {
+		var oid struct {
+			Oid string `json:"$oid"`
+		}
+		if err := json.Unmarshal(data, &oid); err != nil {
+			return err
+		}
+		s = oid.Oid
+	} else if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return id.UnmarshalText([]byte(s))
+}
+
+func (id ObjectId) MarshalText() ([]byte, error) {
+	return []byte(id.Hex()), nil
+}
+
+func (id *ObjectId) UnmarshalText(data []byte) (err error) {
+	if len(data) == 0 {
+		*id = ""
+		return nil
+	}
+	*id, err = ObjectIdHexErr(string(data))
+	return
+}
+
+// RegEx is a regular expression with its options, which are sorted when
+// encoded.
+type RegEx struct {
+	Pattern string
+	Options string
+}
+
+// DBPointer is the deprecated reference to a document of a collection.
+type DBPointer struct {
+	Namespace string
+	Id        ObjectId
+}
+
+// MongoTimestamp is the internal replication timestamp: the seconds since
+// the epoch in the high 32 bits and an ordinal in the low 32 bits.
+type MongoTimestamp int64
+
+// NewMongoTimestamp returns the timestamp of t, in seconds, and the ordinal
+// c. t must be between 1970 and 2106.
+func NewMongoTimestamp(t time.Time, c uint32) (MongoTimestamp, error) {
+	u := t.Unix()
+	if u < 0 || u > math.MaxUint32 {
+		return -1, errors.New("bsonex: time out of MongoTimestamp range")
+	}
+	return MongoTimestamp(u<<32 | int64(c)), nil
+}
+
+// T returns the seconds since the epoch.
+func (ts MongoTimestamp) T() uint32 {
+	return uint32(uint64(ts) >> 32)
+}
+
+// I returns the ordinal of the operation within the second.
+func (ts MongoTimestamp) I() uint32 {
+	return uint32(ts)
+}
+
+// Time returns T as a time.
+func (ts MongoTimestamp) Time() time.Time {
+	return time.Unix(int64(ts.T()), 0)
+}
+
+// M is an unordered document. It is not the mgo bson.M, see M.ToMgo and
+// MFromMgo.
+type M map[string]interface{}
+
+// D is a document that keeps the order of its elements, for command
+// documents, index keys and other places where order matters. Marshal and
+// MarshalJSON write the elements in order.
+type D []E
+
+// E is an element of D.
+type E struct {
+	Key   string
+	Value interface{}
+}
+
+// Map returns the elements of d as an M, nested values are not converted.
+func (d D) Map() M {
+	m := make(M, len(d))
+	for _, e := range d {
+		m[e.Key] = e.Value
+	}
+	return m
+}
+
+func (d D) MarshalJSON() ([]byte, error) {
+	if d == nil {
+		return []byte("null"), nil
+	}
+	buf := []byte{'{'}
+	for i, e := range d {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		k, err := json.Marshal(e.Key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(append(append(buf, k...), ':'), v...)
+	}
+	return append(buf, '}'), nil
+}
+
+// JavaScript is JavaScript code, with the variables in Scope if it is not
+// nil.
+type JavaScript struct {
+	Code  string
+	Scope interface{}
+}
+
+// Symbol is the deprecated symbol type, a string in other languages.
+type Symbol string
+
+// orderKey is the type of MinKey and MaxKey.
+type orderKey int64
+
+// MinKey and MaxKey compare lower and higher than every other value.
+const (
+	MinKey = orderKey(-1 << 63)
+	MaxKey = orderKey(1<<63 - 1)
+)
+
+type undefined struct{}
+
+// Undefined is the deprecated undefined value.
+var Undefined undefined
+
+// Binary is binary data with its subtype.
+type Binary struct {
+	Kind byte
+	Data []byte
+}
+
+func (b Binary) MarshalJSON() (bs []byte, err error) {
+	s := base64.StdEncoding.EncodeToString(b.Data)
+	return json.Marshal(s)
+}
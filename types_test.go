@@ -0,0 +1,121 @@
+package bsonex
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObjectId(t *testing.T) {
+	a, b := NewObjectId(), NewObjectId()
+	assert.True(t, a.Valid())
+	assert.NotEqual(t, a, b)
+	assert.Equal(t, a.Counter()+1, b.Counter())
+	assert.Equal(t, a.Machine(), b.Machine())
+	assert.Equal(t, uint16(os.Getpid()), a.Pid())
+	assert.WithinDuration(t, time.Now(), a.Time(), 2*time.Second)
+
+	oid := ObjectIdHex("5f1d2c3b4a5968778695a4b3")
+	assert.Equal(t, "5f1d2c3b4a5968778695a4b3", oid.Hex())
+	assert.Equal(t, `ObjectIdHex("5f1d2c3b4a5968778695a4b3")`, oid.String())
+	assert.Equal(t, time.Unix(0x5f1d2c3b, 0), oid.Time())
+	assert.Equal(t, []byte{0x4a, 0x59, 0x68}, oid.Machine())
+	assert.Equal(t, uint16(0x7786), oid.Pid())
+	assert.Equal(t, int32(0x95a4b3), oid.Counter())
+	assert.Equal(t, time.Unix(1000, 0), NewObjectIdWithTime(time.Unix(1000, 0)).Time())
+
+	assert.True(t, IsObjectIdHex("5f1d2c3b4a5968778695a4b3"))
+	for _, s := range []string{"", "5f1d2c3b4a5968778695a4b", "5f1d2c3b4a5968778695a4bx"} {
+		assert.False(t, IsObjectIdHex(s), s)
+	}
+	assert.Panics(t, func() { ObjectIdHex("x") })
+	assert.Panics(t, func() { ObjectId("short").Time() })
+
+	bs, err := json.Marshal(oid)
+	assert.NoError(t, err)
+	assert.Equal(t, `"5f1d2c3b4a5968778695a4b3"`, string(bs))
+	for _, in := range []string{`"5f1d2c3b4a5968778695a4b3"`, `{"$oid":"5f1d2c3b4a5968778695a4b3"}`} {
+		var got ObjectId
+		assert.NoError(t, json.Unmarshal([]byte(in), &got))
+		assert.Equal(t, oid, got)
+	}
+	got := oid
+	assert.NoError(t, json.Unmarshal([]byte(`null`), &got))
+	assert.Equal(t, ObjectId(""), got)
+	assert.Error(t, json.Unmarshal([]byte(`"zz"`), &got))
+
+	// map keys go through MarshalText
+	bs, err = json.Marshal(map[ObjectId]int{oid: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"5f1d2c3b4a5968778695a4b3":1}`, string(bs))
+	var m map[ObjectId]int
+	assert.NoError(t, json.Unmarshal(bs, &m))
+	assert.Equal(t, 1, m[oid])
+}
+
+func TestMongoTimestamp(t *testing.T) {
+	ts, err := NewMongoTimestamp(time.Unix(1600000000, 0), 7)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1600000000), ts.T())
+	assert.Equal(t, uint32(7), ts.I())
+	assert.Equal(t, time.Unix(1600000000, 0), ts.Time())
+	_, err = NewMongoTimestamp(time.Unix(-1, 0), 0)
+	assert.Error(t, err)
+}
+
+func TestReadOne(t *testing.T) {
+	a, _ := Marshal(M{"a": 1})
+	b, _ := Marshal(M{"b": 2})
+	r := bytes.NewReader(append(append([]byte(nil), a...), b...))
+	one, err := ReadOne(r)
+	assert.NoError(t, err)
+	assert.Equal(t, BSON(a), one)
+	// nothing past the document is consumed
+	assert.Equal(t, len(b), r.Len())
+	one, err = ReadOne(r)
+	assert.NoError(t, err)
+	assert.Equal(t, BSON(b), one)
+
+	_, err = ReadOne(bytes.NewReader(a[:len(a)-1]))
+	assert.IsType(t, &TruncatedError{}, err)
+	_, err = ReadOne(bytes.NewReader(nil))
+	assert.Error(t, err)
+}
+
+func TestD(t *testing.T) {
+	in := D{
+		{Key: "z", Value: int32(1)},
+		{Key: "a", Value: D{{Key: "y", Value: "s"}, {Key: "b", Value: []interface{}{D{{Key: "k", Value: true}}, int32(2)}}}},
+		{Key: "js", Value: JavaScript{Code: "f()", Scope: D{{Key: "q", Value: int32(3)}, {Key: "p", Value: int32(4)}}}},
+		{Key: "m", Value: M{"x": int32(5)}},
+	}
+	bs, err := Marshal(in)
+	assert.NoError(t, err)
+	b := BSON(bs)
+	assert.Equal(t, `{"z":1,"a":{"y":"s","b":[{"k":true},2]},"js":{"Code":"f()","Scope":{"q":3,"p":4}},"m":{"x":5}}`, b.String())
+
+	// documents come back as D at any depth
+	want := append(D(nil), in...)
+	want[3] = E{Key: "m", Value: D{{Key: "x", Value: int32(5)}}}
+	assert.Equal(t, want, b.D())
+	assert.Equal(t, want[1].Value, b.Lookup("a").D())
+	var out struct {
+		A D
+		M D
+	}
+	assert.NoError(t, Unmarshal(bs, &out))
+	assert.Equal(t, want[1].Value, out.A)
+	assert.Equal(t, want[3].Value, out.M)
+	_, err = b.Lookup("z").DErr()
+	assert.Error(t, err)
+	assert.Equal(t, D{}, BSON{5, 0, 0, 0, 0}.D())
+
+	js, err := json.Marshal(want)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"z":1,"a":{"y":"s","b":[{"k":true},2]},"js":{"Code":"f()","Scope":{"q":3,"p":4}},"m":{"x":5}}`, string(js))
+	assert.Equal(t, M{"z": int32(1), "m": want[3].Value}, D{want[0], want[3]}.Map())
+}
@@ -1,7 +1,78 @@
 package bsonex
 
-import "encoding/binary"
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"unicode/utf8"
+)
 
 func getint(bs []byte) int {
 	return int(binary.LittleEndian.Uint32(bs))
 }
+
+const hexDigits = "0123456789abcdef"
+
+func appendBase64(dst, b []byte) []byte {
+	n := len(dst)
+	dst = append(dst, make([]byte, base64.StdEncoding.EncodedLen(len(b)))...)
+	base64.StdEncoding.Encode(dst[n:], b)
+	return dst
+}
+
+func appendHex(dst, b []byte) []byte {
+	n := len(dst)
+	dst = append(dst, make([]byte, hex.EncodedLen(len(b)))...)
+	hex.Encode(dst[n:], b)
+	return dst
+}
+
+// appendJSONString appends s to dst as a quoted JSON string. Invalid UTF-8 is
+// replaced with U+FFFD.
+func appendJSONString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				dst = append(dst, '\\', c)
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 || r == '\u2028' || r == '\u2029' {
+			dst = append(dst, s[start:i]...)
+			switch r {
+			case '\u2028':
+				dst = append(dst, `\u2028`...)
+			case '\u2029':
+				dst = append(dst, `\u2029`...)
+			default:
+				dst = append(dst, `\ufffd`...)
+			}
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
@@ -0,0 +1,54 @@
+package bsonex
+
+import "unicode/utf8"
+
+// Validate walks the whole document tree and checks length prefixes,
+// terminators, keys and nested documents and arrays. It returns the first
+// problem found as one of the error types in errors.go, a document that
+// passes Validate can be read with the panicking accessors safely.
+func (b BSON) Validate() error {
+	return b.each(func(key []byte, val Value) error {
+		if !utf8.Valid(key) {
+			return &InvalidKeyError{Pos{Offset: -int64(len(key) + 1)}}
+		}
+		return val.validate()
+	})
+}
+
+// validate checks the content of a value whose size has already been checked
+// by readElement.
+func (v Value) validate() error {
+	d := v.valueData
+	switch v.valueType {
+	case TypeString, TypeJSCode, TypeSymbol:
+		return validateString(d)
+	case TypeDBPointer:
+		return validateString(d[:len(d)-12])
+	case TypeDocument, TypeArray:
+		return BSON(d).Validate()
+	case TypeJSCodeScope:
+		if len(d) < 8 {
+			return &TruncatedError{Pos{Offset: 4}, 4, len(d) - 4}
+		}
+		strLen := getint(d[4:])
+		if strLen < 1 || 8+strLen+5 > len(d) {
+			return &LengthError{Pos{Offset: 4}, strLen}
+		}
+		if err := validateString(d[4 : 8+strLen]); err != nil {
+			return withOffset(err, 4)
+		}
+		return withOffset(BSON(d[8+strLen:]).Validate(), 8+strLen)
+	}
+	return nil
+}
+
+// validateString checks a length prefixed, 0x00 terminated string.
+func validateString(d []byte) error {
+	if len(d) < 5 {
+		return &TruncatedError{Need: 5, Have: len(d)}
+	}
+	if d[len(d)-1] != 0x00 {
+		return &TerminatorError{Pos{Offset: int64(len(d) - 1)}}
+	}
+	return nil
+}
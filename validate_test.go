@@ -0,0 +1,85 @@
+package bsonex
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	b, err := Marshal(doc)
+	assert.NoError(t, err)
+	assert.NoError(t, BSON(b).Validate())
+
+	b, err = Marshal(M{"a": M{"b": "c"}})
+	assert.NoError(t, err)
+	// {a: {b: "c"}}: len(4) type(1) "a\0"(2) len(4) type(1) "b\0"(2) len(4) "c\0"
+	bad := append([]byte{}, b...)
+	bad[len(bad)-3] = 'x' // string terminator of "c"
+	err = BSON(bad).Validate()
+	var te *TerminatorError
+	assert.True(t, errors.As(err, &te), err)
+	assert.Equal(t, int64(len(bad)-3), te.Offset)
+	assert.Equal(t, "b", te.Key)
+
+	bad = append([]byte{}, b...)
+	bad[4] = 0x42
+	err = BSON(bad).Validate()
+	var ite *InvalidTypeError
+	assert.True(t, errors.As(err, &ite), err)
+	assert.Equal(t, int64(4), ite.Offset)
+	assert.Equal(t, ValueType(0x42), ite.Type)
+
+	err = BSON(b[:len(b)-3]).Validate()
+	var le *LengthError
+	assert.True(t, errors.As(err, &le), err)
+}
+
+func TestErrNoPanic(t *testing.T) {
+	b, err := Marshal(doc)
+	assert.NoError(t, err)
+	check := func(bs BSON) {
+		assert.NotPanics(t, func() {
+			if bs.Validate() != nil {
+				return
+			}
+			// a valid document must be readable by the panicking accessors
+			bs.Map()
+			for _, v := range bs.ToValueMap() {
+				v.Value()
+			}
+		})
+		assert.NotPanics(t, func() {
+			_, _ = bs.MapErr()
+			_, _ = bs.ToValueMapErr()
+			_, _ = bs.LookupErr("doc.int64")
+		})
+	}
+	for i := 0; i < len(b); i++ {
+		check(BSON(b[:i]))
+		for _, c := range []byte{0x00, 0x01, 0x0f, 0x13, 0x7f, 0xff} {
+			bad := append([]byte{}, b...)
+			bad[i] = c
+			check(BSON(bad))
+		}
+	}
+}
+
+func TestValueErr(t *testing.T) {
+	b, err := Marshal(doc)
+	assert.NoError(t, err)
+	bs := BSON(b)
+	_, err = bs.Lookup("string").Int32Err()
+	var te *TypeError
+	assert.True(t, errors.As(err, &te), err)
+	assert.Equal(t, TypeString, te.Actual)
+	s, err := bs.Lookup("string").StrErr()
+	assert.NoError(t, err)
+	assert.Equal(t, "value of str", s)
+	_, err = Value{TypeInt64, []byte{1, 2, 3}}.Int64Err()
+	assert.Error(t, err)
+	v, err := bs.LookupErr("string.x")
+	assert.NoError(t, err)
+	assert.True(t, v.IsEmpty())
+}
@@ -2,38 +2,14 @@ package bsonex
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"math"
 	"strconv"
 	"time"
-
-	gbson "github.com/globalsign/mgo/bson"
-	"github.com/sbunce/bson"
-)
-
-type (
-	ValueType      = byte
-	ObjectId       = gbson.ObjectId
-	RegEx          = gbson.RegEx
-	DBPointer      = gbson.DBPointer
-	MongoTimestamp = gbson.MongoTimestamp
-	M              = gbson.M
 )
 
-var (
-	Undefined         = gbson.Undefined
-	MinKey            = gbson.MinKey
-	MaxKey            = gbson.MaxKey
-	NewObjectId       = gbson.NewObjectId
-	NewMongoTimestamp = gbson.NewMongoTimestamp
-	Marshal           = gbson.Marshal
-	Unmarshal         = gbson.Unmarshal
-	NewEncoder        = gbson.NewEncoder
-	ReadOne           = bson.ReadOne
-)
+type ValueType = byte
 
 const (
 	TypeEmpty       ValueType = iota
@@ -77,72 +53,129 @@ func (v Value) RawValue() []byte {
 	return v.valueData
 }
 
-func (v Value) checkType(expects ...byte) {
+func (v Value) checkType(expects ...byte) error {
 	for _, e := range expects {
 		if e == v.valueType {
-			return
+			return nil
 		}
 	}
-	panic(fmt.Sprintf("invalid type, expect: %v, real: %v",
-		expects, v.valueType))
+	return &TypeError{Expect: append([]ValueType(nil), expects...), Actual: v.valueType}
 }
 
-func (v Value) checkValueLength(expect int) {
+func (v Value) checkValueLength(expect int) error {
 	if expect != len(v.valueData) {
-		panic(fmt.Sprintf("invalid length, expect: %v, real: %v",
-			expect, len(v.valueData)))
+		return &LengthError{Length: len(v.valueData)}
+	}
+	return nil
+}
+
+func must(err error) {
+	if err != nil {
+		panic(err)
 	}
 }
 
 func (v Value) Uint64() uint64 {
+	i, err := v.Uint64Err()
+	must(err)
+	return i
+}
+
+func (v Value) Uint64Err() (uint64, error) {
 	if len(v.valueData) == 0 {
-		return 0
+		return 0, nil
 	}
 	if v.valueType == TypeInt32 {
-		return uint64(v.Uint32())
+		i, err := v.Uint32Err()
+		return uint64(i), err
 	}
-	v.checkValueLength(8)
-	return binary.LittleEndian.Uint64(v.valueData)
+	if err := v.checkValueLength(8); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(v.valueData), nil
 }
 
 func (v Value) Int64() int64 {
+	i, err := v.Int64Err()
+	must(err)
+	return i
+}
+
+func (v Value) Int64Err() (int64, error) {
 	if v.valueType == TypeInt32 {
-		return int64(v.Int32())
+		i, err := v.Int32Err()
+		return int64(i), err
 	}
-	return int64(v.Uint64())
+	i, err := v.Uint64Err()
+	return int64(i), err
 }
 
 func (v Value) Uint32() uint32 {
+	i, err := v.Uint32Err()
+	must(err)
+	return i
+}
+
+func (v Value) Uint32Err() (uint32, error) {
 	if len(v.valueData) == 0 {
-		return 0
+		return 0, nil
 	}
-	v.checkType(TypeInt32)
-	v.checkValueLength(4)
-	return binary.LittleEndian.Uint32(v.valueData)
+	if err := v.checkType(TypeInt32); err != nil {
+		return 0, err
+	}
+	if err := v.checkValueLength(4); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(v.valueData), nil
 }
 
 func (v Value) Int32() int32 {
 	return int32(v.Uint32())
 }
 
+func (v Value) Int32Err() (int32, error) {
+	i, err := v.Uint32Err()
+	return int32(i), err
+}
+
 func (v Value) Float64() float64 {
+	f, err := v.Float64Err()
+	must(err)
+	return f
+}
+
+func (v Value) Float64Err() (float64, error) {
 	if len(v.valueData) == 0 {
-		return 0
+		return 0, nil
 	}
-	v.checkType(TypeDouble)
-	return math.Float64frombits(v.Uint64())
+	if err := v.checkType(TypeDouble); err != nil {
+		return 0, err
+	}
+	i, err := v.Uint64Err()
+	return math.Float64frombits(i), err
 }
 
 func (v Value) Str() string {
+	s, err := v.StrErr()
+	must(err)
+	return s
+}
+
+func (v Value) StrErr() (string, error) {
 	if len(v.valueData) == 0 {
-		return ""
+		return "", nil
+	}
+	if err := v.checkType(TypeString); err != nil {
+		return "", err
 	}
-	v.checkType(TypeString)
-	return string(v.valueData[4 : len(v.valueData)-1])
+	if err := validateString(v.valueData); err != nil {
+		return "", err
+	}
+	return string(v.valueData[4 : len(v.valueData)-1]), nil
 }
 
 func (v Value) String() string {
-	b, err := json.Marshal(v.Value())
+	b, err := v.AppendJSON(nil)
 	if err != nil {
 		return fmt.Sprint(v.Value())
 	}
@@ -150,79 +183,269 @@ func (v Value) String() string {
 }
 
 func (v Value) Document() BSON {
-	v.checkType(TypeDocument, TypeArray)
-	return BSON(v.valueData)
+	d, err := v.DocumentErr()
+	must(err)
+	return d
+}
+
+func (v Value) DocumentErr() (BSON, error) {
+	if err := v.checkType(TypeDocument, TypeArray); err != nil {
+		return nil, err
+	}
+	return BSON(v.valueData), nil
 }
 
 func (v Value) Map() M {
 	return v.Document().Map()
 }
 
+func (v Value) MapErr() (M, error) {
+	d, err := v.DocumentErr()
+	if err != nil {
+		return nil, err
+	}
+	return d.MapErr()
+}
+
+func (v Value) D() D {
+	return v.Document().D()
+}
+
+func (v Value) DErr() (D, error) {
+	d, err := v.DocumentErr()
+	if err != nil {
+		return nil, err
+	}
+	return d.DErr()
+}
+
 func (v Value) ValueMap() map[string]Value {
 	return v.Document().ToValueMap()
 }
 
+func (v Value) ValueMapErr() (map[string]Value, error) {
+	d, err := v.DocumentErr()
+	if err != nil {
+		return nil, err
+	}
+	return d.ToValueMapErr()
+}
+
 func (v Value) Array() (a []interface{}) {
-	v.checkType(TypeArray)
-	return BSON(v.valueData).Array()
+	a, err := v.ArrayErr()
+	must(err)
+	return
+}
+
+func (v Value) ArrayErr() (a []interface{}, err error) {
+	if err = v.checkType(TypeArray); err != nil {
+		return
+	}
+	return BSON(v.valueData).ArrayErr()
 }
 
 func (v Value) ValueArray() (a []Value) {
-	v.checkType(TypeArray)
-	return BSON(v.valueData).ToValueArray()
+	a, err := v.ValueArrayErr()
+	must(err)
+	return
+}
+
+func (v Value) ValueArrayErr() (a []Value, err error) {
+	if err = v.checkType(TypeArray); err != nil {
+		return
+	}
+	return BSON(v.valueData).ToValueArrayErr()
 }
 
 func (v Value) ArrayOf(i int) Value {
-	v.checkType(TypeArray)
-	return BSON(v.valueData).Lookup(strconv.Itoa(i))
+	val, err := v.ArrayOfErr(i)
+	must(err)
+	return val
+}
+
+func (v Value) ArrayOfErr(i int) (Value, error) {
+	if err := v.checkType(TypeArray); err != nil {
+		return Value{}, err
+	}
+	return BSON(v.valueData).LookupErr(strconv.Itoa(i))
 }
 
 func (v Value) Objid() ObjectId {
-	v.checkType(TypeObjectId)
-	return ObjectId(v.valueData)
+	id, err := v.ObjidErr()
+	must(err)
+	return id
+}
+
+func (v Value) ObjidErr() (ObjectId, error) {
+	if err := v.checkType(TypeObjectId); err != nil {
+		return "", err
+	}
+	if err := v.checkValueLength(12); err != nil {
+		return "", err
+	}
+	return ObjectId(v.valueData), nil
 }
 
 func (v Value) Bool() bool {
+	b, err := v.BoolErr()
+	must(err)
+	return b
+}
+
+func (v Value) BoolErr() (bool, error) {
 	if len(v.valueData) == 0 {
-		return false
+		return false, nil
+	}
+	if err := v.checkType(TypeBoolean); err != nil {
+		return false, err
 	}
-	v.checkType(TypeBoolean)
-	return v.valueData[0] == 0x1
+	return v.valueData[0] == 0x1, nil
 }
 
 func (v Value) Time() time.Time {
+	t, err := v.TimeErr()
+	must(err)
+	return t
+}
+
+func (v Value) TimeErr() (time.Time, error) {
 	if len(v.valueData) == 0 {
-		return time.Time{}
+		return time.Time{}, nil
+	}
+	if err := v.checkType(TypeDatetime); err != nil {
+		return time.Time{}, err
+	}
+	if err := v.checkValueLength(8); err != nil {
+		return time.Time{}, err
 	}
-	v.checkType(TypeDatetime)
-	v.checkValueLength(8)
 	ns := v.Int64() * int64(time.Millisecond)
-	return time.Unix(ns/1e9, ns%1e9)
+	return time.Unix(ns/1e9, ns%1e9), nil
 }
 
 func (v Value) Regexp() RegEx {
+	r, err := v.RegexpErr()
+	must(err)
+	return r
+}
+
+func (v Value) RegexpErr() (RegEx, error) {
 	if len(v.valueData) == 0 {
-		return RegEx{}
+		return RegEx{}, nil
+	}
+	if err := v.checkType(TypeRegex); err != nil {
+		return RegEx{}, err
 	}
-	v.checkType(TypeRegex)
 	i := bytes.IndexByte(v.valueData, 0x00)
+	if i < 0 || v.valueData[len(v.valueData)-1] != 0x00 {
+		return RegEx{}, &TerminatorError{Pos{Offset: int64(len(v.valueData) - 1)}}
+	}
 	return RegEx{
 		Pattern: string(v.valueData[:i]),
 		Options: string(v.valueData[i+1 : len(v.valueData)-1]),
-	}
+	}, nil
 }
 
 func (v Value) DBPointer() DBPointer {
-	v.checkType(TypeDBPointer)
+	p, err := v.DBPointerErr()
+	must(err)
+	return p
+}
+
+func (v Value) DBPointerErr() (DBPointer, error) {
+	if err := v.checkType(TypeDBPointer); err != nil {
+		return DBPointer{}, err
+	}
+	if len(v.valueData) < 4+1+12 {
+		return DBPointer{}, &LengthError{Length: len(v.valueData)}
+	}
+	if err := validateString(v.valueData[:len(v.valueData)-12]); err != nil {
+		return DBPointer{}, err
+	}
 	return DBPointer{
 		Namespace: string(v.valueData[4 : len(v.valueData)-13]),
 		Id:        ObjectId(v.valueData[len(v.valueData)-12:]),
-	}
+	}, nil
 }
 
 func (v Value) MongoTimestamp() MongoTimestamp {
-	v.checkType(TypeTimestamp)
-	return MongoTimestamp(v.Int64())
+	ts, err := v.MongoTimestampErr()
+	must(err)
+	return ts
+}
+
+func (v Value) MongoTimestampErr() (MongoTimestamp, error) {
+	if err := v.checkType(TypeTimestamp); err != nil {
+		return 0, err
+	}
+	i, err := v.Int64Err()
+	return MongoTimestamp(i), err
+}
+
+func (v Value) JSCode() string {
+	s, err := v.JSCodeErr()
+	must(err)
+	return s
+}
+
+func (v Value) JSCodeErr() (string, error) {
+	if err := v.checkType(TypeJSCode); err != nil {
+		return "", err
+	}
+	if err := validateString(v.valueData); err != nil {
+		return "", err
+	}
+	return string(v.valueData[4 : len(v.valueData)-1]), nil
+}
+
+func (v Value) Symbol() Symbol {
+	s, err := v.SymbolErr()
+	must(err)
+	return s
+}
+
+func (v Value) SymbolErr() (Symbol, error) {
+	if err := v.checkType(TypeSymbol); err != nil {
+		return "", err
+	}
+	if err := validateString(v.valueData); err != nil {
+		return "", err
+	}
+	return Symbol(v.valueData[4 : len(v.valueData)-1]), nil
+}
+
+// JSCodeWithScope returns the code and the scope document of a JavaScript
+// code with scope value.
+func (v Value) JSCodeWithScope() (code string, scope BSON) {
+	code, scope, err := v.JSCodeWithScopeErr()
+	must(err)
+	return
+}
+
+func (v Value) JSCodeWithScopeErr() (code string, scope BSON, err error) {
+	if err = v.checkType(TypeJSCodeScope); err != nil {
+		return
+	}
+	if err = v.validate(); err != nil {
+		return
+	}
+	strLen := getint(v.valueData[4:])
+	return string(v.valueData[8 : 8+strLen-1]), BSON(v.valueData[8+strLen:]), nil
+}
+
+func (v Value) Decimal128() Decimal128 {
+	d, err := v.Decimal128Err()
+	must(err)
+	return d
+}
+
+func (v Value) Decimal128Err() (Decimal128, error) {
+	if err := v.checkType(TypeDecimal128); err != nil {
+		return Decimal128{}, err
+	}
+	if err := v.checkValueLength(16); err != nil {
+		return Decimal128{}, err
+	}
+	return decimal128FromBytes(v.valueData), nil
 }
 
 func (v Value) IsNull() bool {
@@ -242,18 +465,29 @@ func (v Value) IsMaxKey() bool {
 }
 
 func (v Value) Binary() Binary {
+	b, err := v.BinaryErr()
+	must(err)
+	return b
+}
+
+func (v Value) BinaryErr() (Binary, error) {
 	if len(v.valueData) == 0 {
-		return Binary{}
+		return Binary{}, nil
 	}
-	v.checkType(TypeBinary)
-	return Binary{gbson.Binary{
+	if err := v.checkType(TypeBinary); err != nil {
+		return Binary{}, err
+	}
+	if len(v.valueData) < 5 {
+		return Binary{}, &TruncatedError{Need: 5, Have: len(v.valueData)}
+	}
+	return Binary{
 		Kind: v.valueData[4],
 		Data: v.valueData[5:],
-	}}
+	}, nil
 }
 
 func (v Value) MarshalJSON() (bs []byte, err error) {
-	return json.Marshal(v.Value())
+	return v.AppendJSON(nil)
 }
 
 func (v Value) MarshalBSON() (bs []byte, err error) {
@@ -261,61 +495,93 @@ func (v Value) MarshalBSON() (bs []byte, err error) {
 }
 
 func (v Value) GetBSON() (interface{}, error) {
-	return v.Value(), nil
+	return v.ValueErr()
 }
 
 func (v Value) Value() (r interface{}) {
+	r, err := v.ValueErr()
+	must(err)
+	return
+}
+
+// ValueErr is like Value but returns an error instead of panicking on
+// malformed or unsupported values.
+func (v Value) ValueErr() (r interface{}, err error) {
 	switch v.valueType {
 	case TypeDouble:
-		return v.Float64()
+		return v.Float64Err()
 	case TypeString:
-		return v.Str()
+		return v.StrErr()
 	case TypeDocument:
-		return v.Map()
+		return v.MapErr()
 	case TypeArray:
-		return v.Array()
+		return v.ArrayErr()
 	case TypeBinary:
-		return v.Binary()
+		return v.BinaryErr()
 	case TypeUndefined:
-		return Undefined
+		return Undefined, nil
 	case TypeObjectId:
-		return v.Objid()
+		return v.ObjidErr()
 	case TypeBoolean:
-		return v.Bool()
+		return v.BoolErr()
 	case TypeDatetime:
-		return v.Time()
+		return v.TimeErr()
 	case TypeNull:
-		return nil
+		return nil, nil
 	case TypeRegex:
-		return v.Regexp()
+		return v.RegexpErr()
 	case TypeDBPointer:
-		return v.DBPointer()
-	case TypeJSCode, TypeSymbol, TypeJSCodeScope, TypeDecimal128:
-		panic("not supported")
+		return v.DBPointerErr()
+	case TypeJSCode:
+		code, err := v.JSCodeErr()
+		return JavaScript{Code: code}, err
+	case TypeSymbol:
+		return v.SymbolErr()
+	case TypeJSCodeScope:
+		code, scope, err := v.JSCodeWithScopeErr()
+		if err != nil {
+			return nil, err
+		}
+		m, err := scope.MapErr()
+		return JavaScript{Code: code, Scope: m}, withOffset(err, 8+len(code)+1)
 	case TypeInt32:
-		return v.Int32()
+		return v.Int32Err()
 	case TypeTimestamp:
-		return v.MongoTimestamp()
+		return v.MongoTimestampErr()
 	case TypeInt64:
-		return v.Int64()
+		return v.Int64Err()
+	case TypeDecimal128:
+		return v.Decimal128Err()
 	case TypeMinKey:
-		return MinKey
+		return MinKey, nil
 	case TypeMaxKey:
-		return MaxKey
+		return MaxKey, nil
 	default:
-		panic(fmt.Sprintf("invalid bson type %#v", v.valueType))
+		return nil, &InvalidTypeError{Type: v.valueType}
 	}
 }
 
-type Binary struct {
-	gbson.Binary
-}
-
-func (b Binary) MarshalJSON() (bs []byte, err error) {
-	s := base64.StdEncoding.EncodeToString(b.Data)
-	return json.Marshal(s)
-}
-
-func (v Binary) GetBSON() (interface{}, error) {
-	return v.Binary.Data, nil
+// valueD is like ValueErr but decodes documents, also inside arrays and
+// scopes, as D.
+func (v Value) valueD() (interface{}, error) {
+	switch v.valueType {
+	case TypeDocument:
+		return BSON(v.valueData).DErr()
+	case TypeArray:
+		var arr []interface{}
+		err := BSON(v.valueData).each(func(key []byte, val Value) error {
+			e, err := val.valueD()
+			arr = append(arr, e)
+			return err
+		})
+		return arr, err
+	case TypeJSCodeScope:
+		code, scope, err := v.JSCodeWithScopeErr()
+		if err != nil {
+			return nil, err
+		}
+		d, err := scope.DErr()
+		return JavaScript{Code: code, Scope: d}, withOffset(err, 8+len(code)+1)
+	}
+	return v.ValueErr()
 }